@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// accuWeather looks up current conditions from AccuWeather, which first needs
+// the city resolved to one of its own location keys.
+type accuWeather struct {
+	apiKey  string
+	client  *http.Client
+	baseURL string // defaults to defaultAccuWeatherURL
+}
+
+const defaultAccuWeatherURL = "http://dataservice.accuweather.com"
+
+func (w accuWeather) name() string {
+	return "accuWeather"
+}
+
+func (w accuWeather) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := w.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (w accuWeather) conditions(ctx context.Context, city string) (Conditions, error) {
+	if city == "" {
+		return Conditions{}, errCityRequired
+	}
+
+	key, err := w.locationKey(ctx, city)
+	if err != nil {
+		return Conditions{}, err
+	}
+
+	var conditions []struct {
+		Temperature struct {
+			Metric struct {
+				Value *float64 `json:"Value"` // °C
+			} `json:"Metric"`
+		} `json:"Temperature"`
+		RealFeelTemperature struct {
+			Metric struct {
+				Value *float64 `json:"Value"`
+			} `json:"Metric"`
+		} `json:"RealFeelTemperature"`
+		RelativeHumidity *float64 `json:"RelativeHumidity"`
+		Wind             struct {
+			Direction struct {
+				Degrees *float64 `json:"Degrees"`
+			} `json:"Direction"`
+			Speed struct {
+				Metric struct {
+					Value *float64 `json:"Value"` // km/h
+				} `json:"Metric"`
+			} `json:"Speed"`
+		} `json:"Wind"`
+	}
+	err = w.get(ctx, w.apiURL("/currentconditions/v1/"+url.PathEscape(key)+"?apikey="+url.QueryEscape(w.apiKey)+"&details=true"), &conditions)
+	if err != nil {
+		return Conditions{}, err
+	}
+	if len(conditions) == 0 {
+		return Conditions{}, errors.New("accuweather: no current conditions for " + city)
+	}
+
+	celsius := conditions[0].Temperature.Metric.Value
+	if celsius == nil {
+		return Conditions{}, errors.New("accuweather: response has no temperature")
+	}
+	t, err := rawTemperature("accuweather", *celsius, unitCelsius)
+	if err != nil {
+		return Conditions{}, err
+	}
+	c := Conditions{
+		TempKelvin:           t.Kelvin(),
+		HumidityPercent:      conditions[0].RelativeHumidity,
+		WindDirectionDegrees: conditions[0].Wind.Direction.Degrees,
+	}
+	if kmh := conditions[0].Wind.Speed.Metric.Value; kmh != nil {
+		ms := *kmh / 3.6
+		c.WindSpeedMetersPerSec = &ms
+	}
+	if rf := conditions[0].RealFeelTemperature.Metric.Value; rf != nil {
+		k := FromCelsius(*rf).Kelvin()
+		c.ApparentTempKelvin = &k
+	}
+	logf(ctx, "accuWeather: %s: %.2f", city, c.TempKelvin)
+	return c, nil
+}
+
+// locationKey resolves city to an AccuWeather location key.
+func (w accuWeather) locationKey(ctx context.Context, city string) (string, error) {
+	var locations []struct {
+		Key string `json:"Key"`
+	}
+	err := w.get(ctx, w.buildURL(ctx, city), &locations)
+	if err != nil {
+		return "", err
+	}
+	if len(locations) == 0 || locations[0].Key == "" {
+		return "", fmt.Errorf("accuweather: %w: %s", errCityNotFound, city)
+	}
+	return locations[0].Key, nil
+}
+
+// buildURL returns the URL to search for city, the first of the two
+// requests a lookup takes. The second asks for the current conditions at
+// the location found.
+func (w accuWeather) buildURL(ctx context.Context, city string) string {
+	search := "/locations/v1/cities/search"
+	if cc := countryFrom(ctx); cc != "" {
+		search = "/locations/v1/cities/" + url.PathEscape(cc) + "/search"
+	}
+	return w.apiURL(search + "?q=" + url.QueryEscape(city) + "&apikey=" + url.QueryEscape(w.apiKey))
+}
+
+func (w accuWeather) secret() string {
+	return w.apiKey
+}
+
+// apiURL returns the URL of path on the AccuWeather API.
+func (w accuWeather) apiURL(path string) string {
+	return orDefault(w.baseURL, defaultAccuWeatherURL) + path
+}
+
+// get fetches u from the AccuWeather API and decodes the JSON response into v.
+func (w accuWeather) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("accuweather", resp); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return malformedResponse("accuweather", err)
+	}
+	return nil
+}
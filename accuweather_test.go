@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccuWeather(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apikey") != "secret" {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/locations/v1/cities/search":
+			if r.URL.Query().Get("q") != "london" {
+				t.Errorf("got q=%q, want london", r.URL.Query().Get("q"))
+			}
+			w.Write([]byte(`[{"Key":"328328","LocalizedName":"London"}]`))
+		case "/currentconditions/v1/328328":
+			w.Write([]byte(`[{"Temperature":{"Metric":{"Value":12.5,"Unit":"C"},"Imperial":{"Value":55,"Unit":"F"}}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	p := accuWeather{apiKey: "secret", client: serverClient(srv)}
+	k, err := p.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(k.Kelvin()-285.65) > 1e-9 {
+		t.Errorf("got %v, want 285.65", k)
+	}
+}
+
+func TestAccuWeatherLocationErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"unknown city", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`))
+		}},
+		{"bad key", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad key", http.StatusUnauthorized)
+		}},
+	}
+
+	for _, tt := range tests {
+		srv := httptest.NewServer(tt.handler)
+		p := accuWeather{apiKey: "secret", client: serverClient(srv)}
+		if _, err := p.temperature(context.Background(), "atlantis"); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		srv.Close()
+	}
+}
+
+func TestAccuWeatherConditionsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/locations/v1/cities/search" {
+			w.Write([]byte(`[{"Key":"328328"}]`))
+			return
+		}
+		http.Error(w, "oops", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	p := accuWeather{apiKey: "secret", client: serverClient(srv)}
+	_, err := p.temperature(context.Background(), "london")
+	var se statusError
+	if !errors.As(err, &se) || se.code != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want a 503 status error", err)
+	}
+}
+
+func TestAccuWeatherNoTemperature(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/locations/v1/cities/search" {
+			w.Write([]byte(`[{"Key":"328328"}]`))
+			return
+		}
+		w.Write([]byte(`[{"Temperature":{"Imperial":{"Value":55,"Unit":"F"}}}]`))
+	}))
+	defer srv.Close()
+
+	p := accuWeather{apiKey: "secret", client: serverClient(srv)}
+	if _, err := p.temperature(context.Background(), "london"); err == nil || !strings.Contains(err.Error(), "no temperature") {
+		t.Errorf("got %v, want an error about the missing temperature", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// errProviderDisabled stands in for the reading of a provider that has been
+// taken out of rotation.
+var errProviderDisabled = errors.New("provider disabled")
+
+// errUnknownProvider is returned when toggling a provider that isn't
+// configured.
+var errUnknownProvider = errors.New("no such provider")
+
+// providerSwitches records which providers have been taken out of rotation.
+// A nil *providerSwitches has every provider enabled.
+type providerSwitches struct {
+	mu  sync.RWMutex
+	off map[string]bool
+}
+
+func (s *providerSwitches) disabled(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.off[name]
+}
+
+// setEnabled takes the named provider in or out of rotation. It refuses to
+// disable the last enabled provider.
+func (w multiWeatherProvider) setEnabled(name string, enabled bool) error {
+	s := w.switches
+	if s == nil {
+		return errors.New("providers can't be toggled")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, on := false, 0
+	for _, p := range w.providers {
+		n := providerName(p)
+		if n == name {
+			found = true
+		} else if !s.off[n] {
+			on++
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %q", errUnknownProvider, name)
+	}
+	if !enabled && on == 0 {
+		return fmt.Errorf("can't disable %s, it is the only enabled provider", name)
+	}
+
+	if s.off == nil {
+		s.off = make(map[string]bool)
+	}
+	s.off[name] = !enabled
+	return nil
+}
+
+// providerAdminHandler serves POST /providers/<name>/enable and
+// /providers/<name>/disable. Requests must carry token in the X-Admin-Token
+// header; with no token configured every request is refused.
+type providerAdminHandler struct {
+	mw    multiWeatherProvider
+	token string
+}
+
+func (h providerAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/providers/"), "/")
+	if len(parts) != 2 || (parts[1] != "enable" && parts[1] != "disable") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(h.token)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	name, enable := parts[0], parts[1] == "enable"
+	if err := h.mw.setEnabled(name, enable); errors.Is(err, errUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	logf(r.Context(), "provider %s %sd", name, parts[1])
+	w.WriteHeader(http.StatusNoContent)
+}
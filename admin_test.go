@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetEnabled(t *testing.T) {
+	mw := multiWeatherProvider{
+		providers: []weatherProvider{openWeatherMapStub{}, testSlowWeatherProvider{}},
+		switches:  &providerSwitches{},
+	}
+
+	if err := mw.setEnabled("openWeatherMap", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	readings, err := mw.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(readings[0].Err, errProviderDisabled) {
+		t.Errorf("got %v for the disabled provider, want %v", readings[0].Err, errProviderDisabled)
+	}
+	if k := mw.aggregate(readings); k != 280 {
+		t.Errorf("got %v, want 280 from the enabled provider only", k)
+	}
+
+	if err := mw.setEnabled("main.testSlowWeatherProvider", false); err == nil {
+		t.Error("expected an error disabling the last enabled provider")
+	}
+
+	if err := mw.setEnabled("openWeatherMap", true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k, _ := mw.temperature(context.Background(), "london"); k != 285.05 {
+		t.Errorf("got %v, want 285.05 with both providers", k)
+	}
+
+	if err := mw.setEnabled("nope", false); !errors.Is(err, errUnknownProvider) {
+		t.Errorf("got %v, want %v", err, errUnknownProvider)
+	}
+}
+
+func TestProviderAdminHandler(t *testing.T) {
+	h := providerAdminHandler{
+		mw: multiWeatherProvider{
+			providers: []weatherProvider{openWeatherMapStub{}, testSlowWeatherProvider{}},
+			switches:  &providerSwitches{},
+		},
+		token: "s3cret",
+	}
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"POST", "/providers/openWeatherMap/disable", "", http.StatusForbidden},
+		{"POST", "/providers/openWeatherMap/disable", "wrong", http.StatusForbidden},
+		{"GET", "/providers/openWeatherMap/disable", "s3cret", http.StatusMethodNotAllowed},
+		{"POST", "/providers/openWeatherMap/disable", "s3cret", http.StatusNoContent},
+		{"POST", "/providers/main.testSlowWeatherProvider/disable", "s3cret", http.StatusConflict},
+		{"POST", "/providers/openWeatherMap/enable", "s3cret", http.StatusNoContent},
+		{"POST", "/providers/nope/disable", "s3cret", http.StatusNotFound},
+		{"POST", "/providers/openWeatherMap/restart", "s3cret", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			req.Header.Set("X-Admin-Token", tt.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestProviderAdminHandlerWithoutToken(t *testing.T) {
+	h := providerAdminHandler{mw: multiWeatherProvider{
+		providers: []weatherProvider{openWeatherMapStub{}, testSlowWeatherProvider{}},
+		switches:  &providerSwitches{},
+	}}
+
+	req := httptest.NewRequest("POST", "/providers/openWeatherMap/disable", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// An Aggregator combines the temperatures reported by several providers into
+// a single value. It is never called with an empty slice.
+type Aggregator interface {
+	Aggregate(temps []float64) float64
+}
+
+// A WeightedAggregator can also take a weight for each reading into account.
+type WeightedAggregator interface {
+	Aggregator
+	AggregateWeighted(temps, weights []float64) float64
+}
+
+// MeanAggregator returns the arithmetic mean of the readings, or their
+// weighted mean when given weights.
+type MeanAggregator struct{}
+
+func (MeanAggregator) Aggregate(temps []float64) float64 {
+	sum := 0.0
+	for _, t := range temps {
+		sum += t
+	}
+	return sum / float64(len(temps))
+}
+
+func (a MeanAggregator) AggregateWeighted(temps, weights []float64) float64 {
+	sum, total := 0.0, 0.0
+	for i, t := range temps {
+		sum += t * weights[i]
+		total += weights[i]
+	}
+	if total == 0 {
+		// Nothing left that we trust; fall back to treating them equally.
+		return a.Aggregate(temps)
+	}
+	return sum / total
+}
+
+// MedianAggregator returns the median of the readings, which is less affected
+// by a single provider returning a wildly wrong value. With an even number of
+// readings it returns the mean of the two middle values.
+type MedianAggregator struct{}
+
+func (MedianAggregator) Aggregate(temps []float64) float64 {
+	sorted := append([]float64(nil), temps...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// ClosestToMedianAggregator returns the reading nearest the median, so that
+// the answer is a temperature a provider actually reported rather than one
+// worked out from several. With two readings equally near, it returns the
+// first.
+type ClosestToMedianAggregator struct{}
+
+func (ClosestToMedianAggregator) Aggregate(temps []float64) float64 {
+	median := MedianAggregator{}.Aggregate(temps)
+	closest := temps[0]
+	for _, t := range temps[1:] {
+		if math.Abs(t-median) < math.Abs(closest-median) {
+			closest = t
+		}
+	}
+	return closest
+}
+
+// ModeAggregator rounds each reading to the nearest whole degree Celsius and
+// returns the most common one, so that providers agreeing on a temperature
+// outvote one that is a fraction of a degree off. Readings are taken to be in
+// Kelvin. If several degrees are equally common it returns the median of the
+// readings instead.
+type ModeAggregator struct{}
+
+func (ModeAggregator) Aggregate(temps []float64) float64 {
+	counts := make(map[float64]int)
+	var mode float64
+	best, tied := 0, false
+	for _, t := range temps {
+		deg := math.Round(t - 273.15)
+		counts[deg]++
+		switch n := counts[deg]; {
+		case n > best:
+			mode, best, tied = deg, n, false
+		case n == best:
+			tied = true
+		}
+	}
+	if tied {
+		return MedianAggregator{}.Aggregate(temps)
+	}
+	return mode + 273.15
+}
+
+// outliers reports, for each reading, whether it is within k standard
+// deviations of the mean and should be kept. With fewer than three readings
+// there is no telling which one is wrong, so all are kept.
+//
+// Note that a single outlier among n readings can be at most (n-1)/sqrt(n)
+// standard deviations from the mean, so small sets need a small k.
+func outliers(temps []float64, k float64) []bool {
+	keep := make([]bool, len(temps))
+	for i := range keep {
+		keep[i] = true
+	}
+	if len(temps) < 3 {
+		return keep
+	}
+
+	mean := MeanAggregator{}.Aggregate(temps)
+	sd := stddev(temps, mean)
+	if sd == 0 {
+		return keep
+	}
+	for i, t := range temps {
+		keep[i] = math.Abs(t-mean) <= k*sd
+	}
+	return keep
+}
+
+// stddev returns the population standard deviation of temps around mean.
+func stddev(temps []float64, mean float64) float64 {
+	sum := 0.0
+	for _, t := range temps {
+		sum += (t - mean) * (t - mean)
+	}
+	return math.Sqrt(sum / float64(len(temps)))
+}
+
+// spread summarizes how far a set of readings disagree.
+type spread struct {
+	min, max, stddev float64
+	count            int
+}
+
+// spreadOf returns the spread of temps, which must not be empty.
+func spreadOf(temps []float64) spread {
+	s := spread{min: temps[0], max: temps[0], count: len(temps)}
+	for _, t := range temps[1:] {
+		s.min = math.Min(s.min, t)
+		s.max = math.Max(s.max, t)
+	}
+	s.stddev = stddev(temps, MeanAggregator{}.Aggregate(temps))
+	return s
+}
+
+// errImplausibleReading is returned for readings outside the range set by
+// temperatureRange, or that providers find can't be in the unit expected.
+var errImplausibleReading = errors.New("implausible temperature")
+
+// temperatureRange returns a validator for multiWeatherProvider that rejects
+// readings below lo or above hi Kelvin, which are more likely to be a
+// glitch upstream than the weather. A bound of zero isn't checked, and with
+// neither set there is no validator.
+func temperatureRange(lo, hi float64) func(kelvin float64) error {
+	if lo == 0 && hi == 0 {
+		return nil
+	}
+	return func(k float64) error {
+		if k < lo || hi != 0 && k > hi {
+			return fmt.Errorf("%w: %.2f K", errImplausibleReading, k)
+		}
+		return nil
+	}
+}
+
+// aggregatorByName returns the built-in aggregator with the given name.
+func aggregatorByName(name string) (Aggregator, error) {
+	switch name {
+	case "mean":
+		return MeanAggregator{}, nil
+	case "median":
+		return MedianAggregator{}, nil
+	case "mode":
+		return ModeAggregator{}, nil
+	case "closest-median":
+		return ClosestToMedianAggregator{}, nil
+	}
+	return nil, fmt.Errorf("unknown aggregation %q", name)
+}
+
+// recencyWeight scales the weight of a reading observed at observedAt,
+// halving it for every halfLife that has passed by now. Readings of unknown
+// age, readings from the future and a halfLife of 0 all count in full.
+func recencyWeight(observedAt, now time.Time, halfLife time.Duration) float64 {
+	age := now.Sub(observedAt)
+	if observedAt.IsZero() || halfLife <= 0 || age <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMeanAggregator(t *testing.T) {
+	if got := (MeanAggregator{}).Aggregate([]float64{280, 290, 0}); got != 190 {
+		t.Errorf("got %v, want 190", got)
+	}
+}
+
+func TestMedianAggregator(t *testing.T) {
+	tests := []struct {
+		temps []float64
+		want  float64
+	}{
+		{[]float64{290}, 290},
+		{[]float64{291, 0, 289}, 289},
+		{[]float64{292, 0, 288, 290}, 289},
+	}
+
+	for _, tt := range tests {
+		if got := (MedianAggregator{}).Aggregate(tt.temps); got != tt.want {
+			t.Errorf("Aggregate(%v) = %v, want %v", tt.temps, got, tt.want)
+		}
+	}
+}
+
+func TestMedianAggregatorDoesNotReorderInput(t *testing.T) {
+	temps := []float64{3, 1, 2}
+	(MedianAggregator{}).Aggregate(temps)
+	if temps[0] != 3 || temps[1] != 1 || temps[2] != 2 {
+		t.Errorf("input was modified: %v", temps)
+	}
+}
+
+func TestClosestToMedianAggregator(t *testing.T) {
+	tests := []struct {
+		temps []float64
+		want  float64
+	}{
+		{[]float64{290}, 290},
+		{[]float64{291, 0, 289.5}, 289.5},
+		{[]float64{291, 0, 289.2, 289.6, 295}, 289.6},
+		// The median is 289.5, which no provider reported, and the two
+		// readings either side of it are equally near: the first wins.
+		{[]float64{292, 0, 290, 289}, 290},
+		{[]float64{288, 300, 289, 310}, 300},
+	}
+
+	for _, tt := range tests {
+		got := (ClosestToMedianAggregator{}).Aggregate(tt.temps)
+		if got != tt.want {
+			t.Errorf("Aggregate(%v) = %v, want %v", tt.temps, got, tt.want)
+		}
+
+		median := (MedianAggregator{}).Aggregate(tt.temps)
+		found := false
+		for _, temp := range tt.temps {
+			found = found || temp == got
+			if math.Abs(temp-median) < math.Abs(got-median) {
+				t.Errorf("Aggregate(%v) = %v, but %v is nearer the median %v", tt.temps, got, temp, median)
+			}
+		}
+		if !found {
+			t.Errorf("Aggregate(%v) = %v, which isn't one of the readings", tt.temps, got)
+		}
+	}
+}
+
+func TestModeAggregator(t *testing.T) {
+	tests := []struct {
+		name  string
+		temps []float64
+		want  float64
+	}{
+		// 15.0, 15.2 and 14.9°C all round to 15°C, outvoting 16.4°C.
+		{"clear mode", []float64{288.15, 288.35, 288.05, 289.55}, 288.15},
+		{"single reading", []float64{290.4}, 290.15},
+		// 15°C and 17°C once each: the median of the readings.
+		{"tie", []float64{288.15, 290.35}, 289.25},
+		{"tie among several", []float64{288.15, 288.25, 290.15, 290.05, 295}, 290.05},
+	}
+
+	for _, tt := range tests {
+		if got := (ModeAggregator{}).Aggregate(tt.temps); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: Aggregate(%v) = %v, want %v", tt.name, tt.temps, got, tt.want)
+		}
+	}
+}
+
+type testConstantWeatherProvider float64
+
+func (t testConstantWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return Temperature(t), nil
+}
+
+func TestMultiTemperatureMedian(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testConstantWeatherProvider(290),
+			testConstantWeatherProvider(0),
+			testConstantWeatherProvider(288),
+		},
+		aggregator: MedianAggregator{},
+	}
+
+	temp, err := w.temperature(context.Background(), "new york")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if temp != 288 {
+		t.Errorf("got %v, want 288", temp)
+	}
+}
+
+func TestNewWeightedMultiWeatherProvider(t *testing.T) {
+	providers := []weatherProvider{testConstantWeatherProvider(280), testConstantWeatherProvider(290)}
+
+	if _, err := NewWeightedMultiWeatherProvider(providers, []float64{1}); err == nil {
+		t.Error("expected an error for mismatched lengths")
+	}
+	if _, err := NewWeightedMultiWeatherProvider(providers, []float64{1, -1}); err == nil {
+		t.Error("expected an error for a negative weight")
+	}
+	if _, err := NewWeightedMultiWeatherProvider(providers, []float64{1, 2}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMultiTemperatureWeighted(t *testing.T) {
+	w, err := NewWeightedMultiWeatherProvider(
+		[]weatherProvider{
+			testConstantWeatherProvider(280),
+			testFailingWeatherProvider{errors.New("down")},
+			testConstantWeatherProvider(289),
+		},
+		[]float64{1, 5, 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temp, err := w.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// (280*1 + 289*2) / 3; the failed provider's weight is ignored.
+	if temp != 286 {
+		t.Errorf("got %v, want 286", temp)
+	}
+}
+
+func TestMultiTemperatureDefaultWeights(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{testConstantWeatherProvider(280), testConstantWeatherProvider(290)},
+	}
+
+	temp, err := w.temperature(context.Background(), "london")
+	if err != nil || temp != 285 {
+		t.Errorf("got %v, %v; want 285", temp, err)
+	}
+}
+
+func TestOutliers(t *testing.T) {
+	tests := []struct {
+		temps []float64
+		k     float64
+		want  []bool
+	}{
+		{[]float64{290, 400}, 0.5, []bool{true, true}},
+		{[]float64{290, 290, 290}, 0.5, []bool{true, true, true}},
+		{[]float64{289, 400, 290, 291}, 1.5, []bool{true, false, true, true}},
+	}
+
+	for _, tt := range tests {
+		got := outliers(tt.temps, tt.k)
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("outliers(%v, %v) = %v, want %v", tt.temps, tt.k, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMultiTemperatureRejectsOutliers(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testConstantWeatherProvider(289),
+			testConstantWeatherProvider(400),
+			testConstantWeatherProvider(290),
+			testConstantWeatherProvider(291),
+		},
+		outlierK: 1.5,
+	}
+
+	temp, err := w.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if temp != 290 {
+		t.Errorf("got %v, want 290 with the 400 K reading excluded", temp)
+	}
+}
+
+func TestCombineLeavesOutOutliers(t *testing.T) {
+	w := multiWeatherProvider{outlierK: 1.5}
+	readings := []ProviderReading{
+		{Name: "a", Conditions: Conditions{TempKelvin: 289}},
+		{Name: "b", Conditions: Conditions{TempKelvin: 400}},
+		{Name: "c", Err: errors.New("down")},
+		{Name: "d", Conditions: Conditions{TempKelvin: 290}},
+		{Name: "e", Conditions: Conditions{TempKelvin: 291}},
+	}
+
+	temp, sources := w.combine(readings)
+	if temp != 290 || len(sources) != 3 || sources[0] != "a" || sources[1] != "d" || sources[2] != "e" {
+		t.Errorf("got %v from %v, want 290 from [a d e]", temp, sources)
+	}
+}
+
+func TestCombineWeightsByRecency(t *testing.T) {
+	clk := newFakeClock()
+	readings := []ProviderReading{
+		{Name: "fresh", Conditions: Conditions{TempKelvin: 290, ObservedAt: clk.Now()}},
+		{Name: "stale", Conditions: Conditions{TempKelvin: 299, ObservedAt: clk.Now().Add(-time.Hour)}},
+	}
+
+	// By default the age of a reading makes no difference.
+	if temp, _ := (multiWeatherProvider{clock: clk}).combine(readings); temp != 294.5 {
+		t.Errorf("got %v, want 294.5 ignoring age", temp)
+	}
+
+	// Two half-lives old, the stale reading counts a quarter as much.
+	w := multiWeatherProvider{recencyHalfLife: 30 * time.Minute, clock: clk}
+	if temp, _ := w.combine(readings); math.Abs(temp-291.8) > 1e-9 {
+		t.Errorf("got %v, want 291.8 with the stale reading weighted a quarter", temp)
+	}
+
+	// Readings without a time count in full.
+	readings[1].ObservedAt = time.Time{}
+	if temp, _ := w.combine(readings); temp != 294.5 {
+		t.Errorf("got %v, want 294.5 with no time on the other reading", temp)
+	}
+}
+
+func TestSpreadOf(t *testing.T) {
+	// Mean 5, squared deviations 9+1+1+9 = 20, variance 5.
+	s := spreadOf([]float64{2, 4, 6, 8})
+	if s.min != 2 || s.max != 8 || s.count != 4 {
+		t.Errorf("got %+v, want min 2, max 8, count 4", s)
+	}
+	if want := math.Sqrt(5); math.Abs(s.stddev-want) > 1e-12 {
+		t.Errorf("got stddev %v, want %v", s.stddev, want)
+	}
+}
+
+func TestMultiDropsImplausibleReadings(t *testing.T) {
+	mw := multiWeatherProvider{
+		providers: []weatherProvider{
+			testConstantWeatherProvider(0),
+			testConstantWeatherProvider(290),
+			testConstantWeatherProvider(292),
+		},
+		validate: temperatureRange(180, 340),
+	}
+
+	readings, err := mw.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(readings[0].Err, errImplausibleReading) {
+		t.Errorf("got error %v for 0 K, want %v", readings[0].Err, errImplausibleReading)
+	}
+	if got := mw.aggregate(readings); got != 291 {
+		t.Errorf("got %v, want 291", got)
+	}
+}
+
+func TestTemperatureRange(t *testing.T) {
+	if temperatureRange(0, 0) != nil {
+		t.Error("expected no validator without bounds")
+	}
+
+	tests := []struct {
+		lo, hi, k float64
+		ok        bool
+	}{
+		{180, 340, 290, true},
+		{180, 340, 179, false},
+		{180, 340, 341, false},
+		{180, 0, 1000, true},
+		{0, 340, 0, true},
+	}
+	for _, tt := range tests {
+		err := temperatureRange(tt.lo, tt.hi)(tt.k)
+		if (err == nil) != tt.ok {
+			t.Errorf("range %v-%v, %v K: got error %v", tt.lo, tt.hi, tt.k, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// AirQuality describes the air somewhere. Pollutant concentrations are in
+// μg/m³, and nil when a provider doesn't report them.
+type AirQuality struct {
+	AQI  float64  `json:"aqi"` // from 1 (good) to 5 (very poor)
+	PM25 *float64 `json:"pm2_5,omitempty"`
+	PM10 *float64 `json:"pm10,omitempty"`
+	NO2  *float64 `json:"no2,omitempty"`
+	O3   *float64 `json:"o3,omitempty"`
+}
+
+// airQualityProvider is implemented by providers that can report on air
+// pollution.
+type airQualityProvider interface {
+	airQuality(ctx context.Context, city string) (AirQuality, error)
+}
+
+// airQuality averages the air quality reported by the providers that offer
+// it. Like temperatures it only fails if every one of them does.
+func (w multiWeatherProvider) airQuality(ctx context.Context, city string) (AirQuality, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		aq  AirQuality
+		err error
+	}
+	results := make(chan result, len(w.providers))
+
+	n := 0
+	for _, provider := range w.providers {
+		ap, ok := provider.(airQualityProvider)
+		if !ok || w.switches.disabled(providerName(provider)) {
+			continue
+		}
+		n++
+		go func(ap airQualityProvider) {
+			aq, err := ap.airQuality(ctx, city)
+			results <- result{aq, err}
+		}(ap)
+	}
+	if n == 0 {
+		return AirQuality{}, errors.New("no enabled provider offers air quality")
+	}
+
+	var reports []AirQuality
+	var failures []error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			if w.strict {
+				return AirQuality{}, r.err
+			}
+			failures = append(failures, r.err)
+			continue
+		}
+		reports = append(reports, r.aq)
+	}
+	if len(failures) == n {
+		return AirQuality{}, fmt.Errorf("all air quality providers failed: %w", errors.Join(failures...))
+	}
+
+	var aq AirQuality
+	for _, r := range reports {
+		aq.AQI += r.AQI / float64(len(reports))
+	}
+	aq.PM25 = averageOf(reports, func(a AirQuality) *float64 { return a.PM25 })
+	aq.PM10 = averageOf(reports, func(a AirQuality) *float64 { return a.PM10 })
+	aq.NO2 = averageOf(reports, func(a AirQuality) *float64 { return a.NO2 })
+	aq.O3 = averageOf(reports, func(a AirQuality) *float64 { return a.O3 })
+	return aq, nil
+}
+
+// averageOf returns the mean of field over the reports that have it, or nil
+// if none do.
+func averageOf(reports []AirQuality, field func(AirQuality) *float64) *float64 {
+	var sum float64
+	n := 0
+	for _, r := range reports {
+		if v := field(r); v != nil {
+			sum += *v
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	avg := sum / float64(n)
+	return &avg
+}
+
+func (w openWeatherMap) airQuality(ctx context.Context, city string) (AirQuality, error) {
+	// The Air Pollution API only takes coordinates.
+	if _, ok := coordinatesFrom(ctx); !ok && w.geoCode == nil {
+		return AirQuality{}, errors.New("openweathermap: air quality needs a geocoder or coordinates")
+	}
+	l, err := locate(ctx, "openweathermap", w.geoCode, city)
+	if err != nil {
+		return AirQuality{}, err
+	}
+
+	u := orDefault(w.baseURL, defaultOpenWeatherMapURL) + "/data/2.5/air_pollution?lat=" + strconv.FormatFloat(l.Lat, 'f', -1, 64) + "&lon=" + strconv.FormatFloat(l.Lng, 'f', -1, 64)
+	if w.apiKey != "" {
+		u += "&appid=" + url.QueryEscape(w.apiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return AirQuality{}, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return AirQuality{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("openweathermap", resp); err != nil {
+		return AirQuality{}, err
+	}
+
+	var d struct {
+		List []struct {
+			Main struct {
+				AQI *float64 `json:"aqi"`
+			} `json:"main"`
+			Components struct {
+				PM25 *float64 `json:"pm2_5"`
+				PM10 *float64 `json:"pm10"`
+				NO2  *float64 `json:"no2"`
+				O3   *float64 `json:"o3"`
+			} `json:"components"`
+		} `json:"list"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return AirQuality{}, malformedResponse("openweathermap", err)
+	}
+	if len(d.List) == 0 || d.List[0].Main.AQI == nil {
+		return AirQuality{}, errors.New("openweathermap: response has no air quality index")
+	}
+
+	cur := d.List[0]
+	return AirQuality{
+		AQI:  *cur.Main.AQI,
+		PM25: cur.Components.PM25,
+		PM10: cur.Components.PM10,
+		NO2:  cur.Components.NO2,
+		O3:   cur.Components.O3,
+	}, nil
+}
+
+// airHandler serves /air/<city>.
+type airHandler struct {
+	mw      multiWeatherProvider
+	timeout time.Duration
+}
+
+// AirResponse is the body of a /air/<city> response, with figures rounded
+// to two decimal places.
+type AirResponse struct {
+	City string `json:"city"`
+	AirQuality
+}
+
+func (h airHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, ok := cityFromPath(r.URL.Path, "/air/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if city == "" {
+		http.Error(w, "missing city, expected /air/<city>", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	aq, err := h.mw.airQuality(ctx, city)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	aq.AQI = roundTo(aq.AQI, defaultPrecision)
+	for _, p := range []**float64{&aq.PM25, &aq.PM10, &aq.NO2, &aq.O3} {
+		if *p != nil {
+			*p = roundedPtr(**p, defaultPrecision)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(AirResponse{City: city, AirQuality: aq})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testAirQualityProvider returns a fixed air quality report.
+type testAirQualityProvider struct {
+	aq  AirQuality
+	err error
+}
+
+func (t testAirQualityProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return 290, nil
+}
+
+func (t testAirQualityProvider) airQuality(ctx context.Context, city string) (AirQuality, error) {
+	return t.aq, t.err
+}
+
+func TestOpenWeatherMapAirQuality(t *testing.T) {
+	p := openWeatherMap{
+		apiKey:  "key",
+		baseURL: "http://owm.test",
+		geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}},
+		client: cannedClient(t, map[string]cannedResponse{
+			"http://owm.test/data/2.5/air_pollution?lat=51.5&lon=-0.12&appid=key": {body: `{
+				"coord":{"lon":-0.12,"lat":51.5},
+				"list":[{
+					"main":{"aqi":2},
+					"components":{"co":201.94,"no":0.02,"no2":15.77,"o3":68.66,"so2":0.64,"pm2_5":3.5,"pm10":5.54,"nh3":0.12},
+					"dt":1605182400
+				}]
+			}`},
+		}),
+	}
+
+	aq, err := p.airQuality(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aq.AQI != 2 || *aq.PM25 != 3.5 || *aq.PM10 != 5.54 || *aq.NO2 != 15.77 || *aq.O3 != 68.66 {
+		t.Errorf("got %+v", aq)
+	}
+}
+
+func TestOpenWeatherMapAirQualityRejectsZeroLocation(t *testing.T) {
+	var urls []string
+	p := openWeatherMap{
+		client:  recordingClient(&urls, `{"list": []}`),
+		geoCode: testGeoCode{l: location{}},
+	}
+
+	if _, err := p.airQuality(context.Background(), "xyzzy"); !errors.Is(err, errCityNotFound) {
+		t.Errorf("got %v, want %v", err, errCityNotFound)
+	}
+	if len(urls) != 0 {
+		t.Errorf("queried %v for a zero location", urls)
+	}
+}
+
+func TestMultiAirQuality(t *testing.T) {
+	pm25, pm10 := 4.0, 6.0
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testAirQualityProvider{aq: AirQuality{AQI: 2, PM25: &pm25}},
+			testAirQualityProvider{aq: AirQuality{AQI: 3, PM10: &pm10}},
+			testConstantWeatherProvider(300),
+			testAirQualityProvider{err: errors.New("down")},
+		},
+	}
+
+	aq, err := w.airQuality(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aq.AQI != 2.5 || *aq.PM25 != 4 || *aq.PM10 != 6 || aq.NO2 != nil {
+		t.Errorf("got %+v", aq)
+	}
+}
+
+// testDownAirQualityProvider fails, under a name of its own.
+type testDownAirQualityProvider struct {
+	testAirQualityProvider
+}
+
+func TestMultiAirQualitySkipsDisabledProviders(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testAirQualityProvider{aq: AirQuality{AQI: 2}},
+			testDownAirQualityProvider{testAirQualityProvider{err: errors.New("down")}},
+		},
+		strict:   true,
+		switches: &providerSwitches{off: map[string]bool{"main.testDownAirQualityProvider": true}},
+	}
+
+	aq, err := w.airQuality(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("disabled provider was asked: %v", err)
+	}
+	if aq.AQI != 2 {
+		t.Errorf("got %+v, want AQI 2", aq)
+	}
+}
+
+func TestMultiAirQualityUnsupported(t *testing.T) {
+	w := multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(300)}}
+	if _, err := w.airQuality(context.Background(), "london"); err == nil {
+		t.Error("expected an error with no air quality providers")
+	}
+}
+
+func TestAirHandler(t *testing.T) {
+	h := airHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testAirQualityProvider{aq: AirQuality{AQI: 1}}}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/air/London", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp AirResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.City != "london" || resp.AQI != 1 {
+		t.Errorf("got %+v", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/air/london/extra", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a deeper path, want 404", rec.Code)
+	}
+}
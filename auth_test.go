@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAPIKeys(t *testing.T) {
+	h := withAPIKeys(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), []string{"first-key", "second-key"})
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"first-key", http.StatusOK},
+		{"second-key", http.StatusOK},
+		{"wrong-key", http.StatusUnauthorized},
+		{"first-key-but-longer", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("key %q: got status %d, want %d", tt.key, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("key %q: missing WWW-Authenticate header", tt.key)
+		}
+	}
+}
+
+func TestWithAPIKeysDisabled(t *testing.T) {
+	h := withAPIKeys(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), nil)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d without any keys configured, want %d", rec.Code, http.StatusOK)
+	}
+}
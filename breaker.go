@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling a provider whose circuit
+// breaker is open. It wraps errUpstreamUnavailable, since the breaker only
+// opens once the provider keeps failing.
+var errCircuitOpen = fmt.Errorf("circuit breaker open: %w", errUpstreamUnavailable)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("circuitState(%d)", int(s))
+}
+
+// circuitBreakerProvider stops calling a provider after threshold consecutive
+// failures, failing immediately instead for cooldown. After the cooldown a
+// single trial call is let through: if it succeeds the breaker closes again,
+// otherwise it stays open for another cooldown.
+type circuitBreakerProvider struct {
+	provider  weatherProvider
+	threshold int
+	cooldown  time.Duration
+	clock     clock
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreakerProvider(p weatherProvider, threshold int, cooldown time.Duration) *circuitBreakerProvider {
+	return &circuitBreakerProvider{provider: p, threshold: threshold, cooldown: cooldown, clock: realClock{}}
+}
+
+func (b *circuitBreakerProvider) name() string {
+	return providerName(b.provider)
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreakerProvider) State() circuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && b.clock.Now().Sub(b.openedAt) >= b.cooldown {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+func (b *circuitBreakerProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := b.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (b *circuitBreakerProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	if err := b.allow(); err != nil {
+		return Conditions{}, err
+	}
+
+	c, err := conditionsOf(ctx, b.provider, city)
+	b.record(err)
+	return c, err
+}
+
+// allow reports whether a call may go through, moving an open breaker whose
+// cooldown has passed to half-open.
+func (b *circuitBreakerProvider) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return fmt.Errorf("%s: %w", b.name(), errCircuitOpen)
+		}
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		// A trial call is already in flight.
+		return fmt.Errorf("%s: %w", b.name(), errCircuitOpen)
+	}
+	return nil
+}
+
+func (b *circuitBreakerProvider) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A call we gave up on, or that the provider could never have answered,
+	// says nothing about its health. Nor does a city that doesn't exist, or a
+	// reading we didn't believe, or a few misspelt names would open the
+	// breaker for everyone.
+	if errors.Is(err, context.Canceled) || errors.Is(err, errCityRequired) || isNotFound(err) || errors.Is(err, errImplausibleReading) {
+		if b.state == circuitHalfOpen {
+			b.state = circuitOpen
+		}
+		return
+	}
+
+	if err == nil {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = b.clock.Now()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testSwitchableWeatherProvider fails while err is set.
+type testSwitchableWeatherProvider struct {
+	err   error
+	calls int
+}
+
+func (t *testSwitchableWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	t.calls++
+	return 290, t.err
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	p := &testSwitchableWeatherProvider{err: errors.New("forecastio: unexpected status 503")}
+	b := NewCircuitBreakerProvider(p, 3, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if b.State() != circuitClosed {
+			t.Fatalf("breaker %s after %d failures", b.State(), i)
+		}
+		b.temperature(context.Background(), "london")
+	}
+	if b.State() != circuitOpen {
+		t.Fatalf("got %s, want open", b.State())
+	}
+
+	if _, err := b.temperature(context.Background(), "london"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v, want %v", err, errCircuitOpen)
+	}
+	if p.calls != 3 {
+		t.Errorf("provider called %d times, want 3", p.calls)
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	p := &testSwitchableWeatherProvider{err: errors.New("forecastio: unexpected status 503")}
+	b := NewCircuitBreakerProvider(p, 1, 30*time.Second)
+	clock := newFakeClock()
+	b.clock = clock
+
+	b.temperature(context.Background(), "london")
+	if b.State() != circuitOpen {
+		t.Fatalf("got %s, want open", b.State())
+	}
+
+	// A failed trial re-opens the breaker.
+	clock.Advance(30 * time.Second)
+	if b.State() != circuitHalfOpen {
+		t.Fatalf("got %s, want half-open", b.State())
+	}
+	b.temperature(context.Background(), "london")
+	if b.State() != circuitOpen {
+		t.Fatalf("got %s, want open after failed trial", b.State())
+	}
+
+	// A successful trial closes it.
+	clock.Advance(30 * time.Second)
+	p.err = nil
+	if _, err := b.temperature(context.Background(), "london"); err != nil {
+		t.Fatalf("trial call failed: %v", err)
+	}
+	if b.State() != circuitClosed {
+		t.Errorf("got %s, want closed", b.State())
+	}
+	if p.calls != 3 {
+		t.Errorf("provider called %d times, want 3", p.calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresBadQueries(t *testing.T) {
+	for _, err := range []error{
+		fmt.Errorf("nominatim: %w: lndon", errCityNotFound),
+		fmt.Errorf("forecastio: %w: 600.00", errImplausibleReading),
+	} {
+		p := &testSwitchableWeatherProvider{err: err}
+		b := NewCircuitBreakerProvider(p, 3, time.Hour)
+
+		for i := 0; i < 5; i++ {
+			b.temperature(context.Background(), "lndon")
+		}
+		if b.State() != circuitClosed {
+			t.Errorf("%v: got %s after 5 calls, want closed", err, b.State())
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// cachingWeatherProvider remembers the temperatures reported by another
+// provider for ttl, so repeated lookups of the same city don't hit the
+// upstream API. Lookups that failed because the city doesn't exist are
+// remembered too, for negativeTTL. Concurrent lookups of a city that isn't
+// cached share a single upstream call.
+//
+// If hardTTL is longer than ttl, readings older than ttl but younger than
+// hardTTL are still answered with straight away, while they are refreshed
+// in the background.
+type cachingWeatherProvider struct {
+	provider    weatherProvider
+	ttl         time.Duration
+	hardTTL     time.Duration
+	negativeTTL time.Duration
+	clock       clock
+
+	mu         sync.RWMutex
+	entries    map[string]cacheEntry
+	refreshing map[string]bool // keys being refreshed in the background
+	flights    flightGroup
+	lastSweep  time.Time
+}
+
+type cacheEntry struct {
+	c       Conditions
+	l       *location // where the provider looked, if it geocoded
+	err     error     // set for a city that wasn't found
+	expires time.Time
+	stale   time.Time // when it can no longer be answered with at all
+}
+
+// dead reports whether e can no longer be answered with at all.
+func (e cacheEntry) dead(now time.Time) bool {
+	return !now.Before(e.expires) && !now.Before(e.stale)
+}
+
+// recordLocation reports where the cached reading was taken, as the
+// provider did when it was looked up.
+func (e cacheEntry) recordLocation(ctx context.Context) {
+	if e.l != nil {
+		recordLocation(ctx, *e.l)
+	}
+}
+
+// backgroundRefreshTimeout bounds a refresh of a stale reading, which no
+// request is waiting on.
+const backgroundRefreshTimeout = 30 * time.Second
+
+// flightTimeout bounds a call shared by concurrent lookups, which carries on
+// when the request that started it gives up.
+const flightTimeout = 30 * time.Second
+
+// maxCacheEntries bounds the memory held by a cache, since anyone can make
+// it remember a city by asking for it. Past it, expired entries are
+// forgotten, and new ones aren't cached until there is room, or evict the
+// oldest where entries needn't expire.
+const maxCacheEntries = 10000
+
+// cacheSweepInterval is how often a cache forgets its expired entries,
+// which are otherwise only dropped when looked up again.
+const cacheSweepInterval = time.Minute
+
+func NewCachingWeatherProvider(p weatherProvider, ttl, negativeTTL time.Duration) *cachingWeatherProvider {
+	return &cachingWeatherProvider{
+		provider:    p,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		clock:       realClock{},
+		entries:     make(map[string]cacheEntry),
+	}
+}
+
+func (c *cachingWeatherProvider) name() string {
+	return providerName(c.provider)
+}
+
+func (c *cachingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	cond, err := c.conditions(ctx, city)
+	return FromKelvin(cond.TempKelvin), err
+}
+
+func (c *cachingWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	key := queryKey(ctx, city)
+
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	now := c.clock.Now()
+	if ok && e.dead(now) {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok && e.dead(now) {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	if ok && now.Before(e.expires) {
+		e.recordLocation(ctx)
+		return e.c, e.err
+	}
+	if ok && now.Before(e.stale) {
+		e.recordLocation(ctx)
+		c.revalidate(ctx, key, city)
+		return e.c, nil
+	}
+	return c.fetch(ctx, key, city)
+}
+
+// revalidate refreshes key in the background, unless that is already
+// happening.
+func (c *cachingWeatherProvider) revalidate(ctx context.Context, key, city string) {
+	c.mu.Lock()
+	if c.refreshing[key] {
+		c.mu.Unlock()
+		return
+	}
+	if c.refreshing == nil {
+		c.refreshing = make(map[string]bool)
+	}
+	c.refreshing[key] = true
+	c.mu.Unlock()
+
+	// Keep the country and coordinates asked for, but not the request's
+	// deadline, nor where it records locations, since it will be answered
+	// before the refresh is done.
+	var discard *location
+	ctx = withLocationRecorder(context.WithoutCancel(ctx), &discard)
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.refreshing, key)
+			c.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(ctx, backgroundRefreshTimeout)
+		defer cancel()
+		if _, err := c.fetch(ctx, key, city); err != nil {
+			logf(ctx, "%s: refreshing %q: %v", c.name(), city, err)
+		}
+	}()
+}
+
+// refresh looks up city upstream and caches the result afresh, whether or
+// not the cached entry has expired.
+func (c *cachingWeatherProvider) refresh(ctx context.Context, city string) error {
+	_, err := c.fetch(ctx, queryKey(ctx, city), city)
+	return err
+}
+
+// fetch looks up city upstream, sharing the call with concurrent lookups of
+// key, and caches the result.
+func (c *cachingWeatherProvider) fetch(ctx context.Context, key, city string) (Conditions, error) {
+	return c.flights.do(ctx, key, func(ctx context.Context) (Conditions, error) {
+		var l *location
+		cond, err := conditionsOf(withLocationRecorder(ctx, &l), c.provider, city)
+		if l != nil {
+			recordLocation(ctx, *l)
+		}
+		if err != nil {
+			if isNotFound(err) && c.negativeTTL > 0 {
+				c.store(key, cacheEntry{err: err, expires: c.clock.Now().Add(c.negativeTTL)})
+			}
+			return Conditions{}, err
+		}
+
+		now := c.clock.Now()
+		c.store(key, cacheEntry{c: cond, l: l, expires: now.Add(c.ttl), stale: now.Add(c.hardTTL)})
+		return cond, nil
+	})
+}
+
+// store caches e under key, sweeping out expired entries every
+// cacheSweepInterval, or when the cache is full. If it is still full, e
+// isn't cached.
+func (c *cachingWeatherProvider) store(key string, e cacheEntry) {
+	now := c.clock.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, replacing := c.entries[key]
+	full := !replacing && len(c.entries) >= maxCacheEntries
+	if full || now.Sub(c.lastSweep) >= cacheSweepInterval {
+		for k, e := range c.entries {
+			if e.dead(now) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if !replacing && len(c.entries) >= maxCacheEntries {
+		return
+	}
+	c.entries[key] = e
+}
+
+// isNotFound reports whether err says that what was looked up doesn't
+// exist, which asking again won't change, rather than that the lookup
+// failed.
+func isNotFound(err error) bool {
+	return errors.Is(err, errCityNotFound)
+}
+
+// queryKey identifies a lookup of city, qualified by any country or
+// coordinates in ctx, for caching and collapsing duplicate lookups.
+func queryKey(ctx context.Context, city string) string {
+	key := normalizeCity(city)
+	if cc := countryFrom(ctx); cc != "" {
+		key += "," + cc
+	}
+	if l, ok := coordinatesFrom(ctx); ok {
+		key += "@" + strconv.FormatFloat(l.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(l.Lng, 'f', -1, 64)
+	}
+	return key
+}
+
+// singleFlightWeatherProvider shares one call to the wrapped provider
+// between concurrent lookups of the same city. Unlike
+// cachingWeatherProvider, it remembers nothing once the call returns.
+type singleFlightWeatherProvider struct {
+	provider weatherProvider
+	flights  *flightGroup
+}
+
+func NewSingleFlightWeatherProvider(p weatherProvider) singleFlightWeatherProvider {
+	return singleFlightWeatherProvider{provider: p, flights: &flightGroup{}}
+}
+
+func (s singleFlightWeatherProvider) name() string {
+	return providerName(s.provider)
+}
+
+func (s singleFlightWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := s.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (s singleFlightWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	return s.flights.do(ctx, queryKey(ctx, city), func(ctx context.Context) (Conditions, error) {
+		return conditionsOf(ctx, s.provider, city)
+	})
+}
+
+// flightGroup collapses concurrent calls for the same key into one.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	c    Conditions
+	l    *location // where the provider looked, if it geocoded
+	err  error
+}
+
+// do calls fn and returns its result, unless a call for key is already in
+// flight, in which case it waits for that call and returns its result instead.
+// Either way it stops waiting when ctx is done, leaving the call to finish
+// for anyone else waiting on it. The location fn records is recorded in ctx
+// for every caller.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (Conditions, error)) (Conditions, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f, ok := g.calls[key]
+	if ok {
+		logf(ctx, "waiting on the lookup of %q already in flight", key)
+	} else {
+		f = &flight{done: make(chan struct{})}
+		g.calls[key] = f
+		go g.run(ctx, key, f, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		if f.l != nil {
+			recordLocation(ctx, *f.l)
+		}
+		return f.c, f.err
+	case <-ctx.Done():
+		return Conditions{}, ctx.Err()
+	}
+}
+
+// run calls fn for f. It keeps the values in ctx, such as the country asked
+// for, but not its deadline, so that the request that started the call
+// giving up doesn't fail it for everyone else.
+func (g *flightGroup) run(ctx context.Context, key string, f *flight, fn func(context.Context) (Conditions, error)) {
+	ctx, cancel := context.WithTimeout(withLocationRecorder(context.WithoutCancel(ctx), &f.l), flightTimeout)
+	defer cancel()
+	f.c, f.err = fn(ctx)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// cachingGeoCode remembers the locations found by another geocoder. Entries
+// expire after ttl, or never if ttl is zero, since cities rarely move, though
+// the oldest are forgotten to make room once there are maxCacheEntries.
+// Cities that weren't found are remembered for negativeTTL.
+type cachingGeoCode struct {
+	geoCode     geoCode
+	ttl         time.Duration
+	negativeTTL time.Duration
+	clock       clock
+
+	mu        sync.RWMutex
+	entries   map[string]geoCacheEntry
+	lastSweep time.Time
+}
+
+type geoCacheEntry struct {
+	l       location
+	err     error     // set for a city that wasn't found
+	added   time.Time // when it was cached
+	expires time.Time // zero if it never does
+}
+
+func (e geoCacheEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func NewCachingGeoCode(gc geoCode, ttl, negativeTTL time.Duration) *cachingGeoCode {
+	return &cachingGeoCode{
+		geoCode:     gc,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		clock:       realClock{},
+		entries:     make(map[string]geoCacheEntry),
+	}
+}
+
+func (c *cachingGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	key := normalizeCity(city) + "," + country
+
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	now := c.clock.Now()
+	if ok && !e.expired(now) {
+		return e.l, e.err
+	}
+	if ok {
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok && e.expired(now) {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+
+	l, err := c.geoCode.findCityLocation(ctx, city, country)
+	if err != nil {
+		if isNotFound(err) && c.negativeTTL > 0 {
+			c.store(key, geoCacheEntry{err: err, expires: c.clock.Now().Add(c.negativeTTL)})
+		}
+		return location{}, err
+	}
+
+	e = geoCacheEntry{l: l}
+	if c.ttl > 0 {
+		e.expires = c.clock.Now().Add(c.ttl)
+	}
+	c.store(key, e)
+
+	return l, nil
+}
+
+// store caches e under key, sweeping out expired entries every
+// cacheSweepInterval, or when the cache is full. If it is still full, the
+// oldest entry is evicted to make room.
+func (c *cachingGeoCode) store(key string, e geoCacheEntry) {
+	now := c.clock.Now()
+	e.added = now
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, replacing := c.entries[key]
+	full := !replacing && len(c.entries) >= maxCacheEntries
+	if full || now.Sub(c.lastSweep) >= cacheSweepInterval {
+		for k, e := range c.entries {
+			if e.expired(now) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if !replacing && len(c.entries) >= maxCacheEntries {
+		c.evictOldest()
+	}
+	c.entries[key] = e
+}
+
+// evictOldest forgets the entry that was cached first. c.mu must be held.
+func (c *cachingGeoCode) evictOldest() {
+	var oldest string
+	var added time.Time
+	for k, e := range c.entries {
+		if added.IsZero() || e.added.Before(added) {
+			oldest, added = k, e.added
+		}
+	}
+	delete(c.entries, oldest)
+}
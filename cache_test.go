@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testCountingWeatherProvider counts how often it is asked for a temperature.
+type testCountingWeatherProvider struct {
+	calls int32
+	delay time.Duration
+	err   error
+}
+
+func (t *testCountingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	atomic.AddInt32(&t.calls, 1)
+	time.Sleep(t.delay)
+	if t.err != nil {
+		return 0, t.err
+	}
+	return 290, nil
+}
+
+func TestCachingWeatherProviderHitsCache(t *testing.T) {
+	p := &testCountingWeatherProvider{}
+	c := NewCachingWeatherProvider(p, time.Minute, 0)
+
+	for _, city := range []string{"London", "london"} {
+		k, err := c.temperature(context.Background(), city)
+		if err != nil || k != 290 {
+			t.Fatalf("got %v, %v", k, err)
+		}
+	}
+
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
+
+func TestCachingWeatherProviderRecordsLocation(t *testing.T) {
+	p := testGatedWeatherProvider{started: make(chan struct{}, 1), release: make(chan struct{})}
+	close(p.release)
+	c := NewCachingWeatherProvider(p, time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		var l *location
+		if _, err := c.temperature(withLocationRecorder(context.Background(), &l), "london"); err != nil {
+			t.Fatal(err)
+		}
+		if l == nil || *l != (location{Lat: 51.5, Lng: -0.12}) {
+			t.Errorf("lookup %d: recorded location %v, want 51.5,-0.12", i, l)
+		}
+	}
+}
+
+func TestCachingWeatherProviderExpires(t *testing.T) {
+	p := &testCountingWeatherProvider{}
+	c := NewCachingWeatherProvider(p, time.Minute, 0)
+	clock := newFakeClock()
+	c.clock = clock
+
+	c.temperature(context.Background(), "london")
+	clock.Advance(59 * time.Second)
+	c.temperature(context.Background(), "london")
+	if p.calls != 1 {
+		t.Errorf("provider called %d times before expiry, want 1", p.calls)
+	}
+	clock.Advance(time.Second)
+	c.temperature(context.Background(), "london")
+
+	if p.calls != 2 {
+		t.Errorf("provider called %d times, want 2", p.calls)
+	}
+}
+
+func TestCachingWeatherProviderStaleWhileRevalidate(t *testing.T) {
+	p := &testCountingWeatherProvider{delay: 20 * time.Millisecond}
+	c := NewCachingWeatherProvider(p, time.Minute, 0)
+	c.hardTTL = time.Hour
+	clock := newFakeClock()
+	c.clock = clock
+
+	c.temperature(context.Background(), "london")
+	clock.Advance(59 * time.Second)
+	c.temperature(context.Background(), "london")
+	if calls := atomic.LoadInt32(&p.calls); calls != 1 {
+		t.Fatalf("provider called %d times within the TTL, want 1", calls)
+	}
+
+	// Past the TTL, stale readings come straight back while one refresh
+	// runs in the background.
+	clock.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		begin := time.Now()
+		k, err := c.temperature(context.Background(), "london")
+		if err != nil || k != 290 {
+			t.Fatalf("got %v, %v, want the stale 290", k, err)
+		}
+		if took := time.Since(begin); took >= p.delay {
+			t.Errorf("stale lookup took %v, want it answered without waiting", took)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&p.calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(2 * p.delay)
+	if calls := atomic.LoadInt32(&p.calls); calls != 2 {
+		t.Errorf("provider called %d times, want 2 with a single refresh", calls)
+	}
+
+	// Refreshed, the reading is fresh again.
+	c.temperature(context.Background(), "london")
+	if calls := atomic.LoadInt32(&p.calls); calls != 2 {
+		t.Errorf("provider called %d times after the refresh, want 2", calls)
+	}
+
+	// Past the hard TTL, lookups wait for the provider again.
+	clock.Advance(time.Hour)
+	c.temperature(context.Background(), "london")
+	if calls := atomic.LoadInt32(&p.calls); calls != 3 {
+		t.Errorf("provider called %d times past the hard TTL, want 3", calls)
+	}
+}
+
+func TestCachingWeatherProviderCachesNotFound(t *testing.T) {
+	p := &testCountingWeatherProvider{err: statusError{provider: "test", code: http.StatusNotFound}}
+	c := NewCachingWeatherProvider(p, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.temperature(context.Background(), "lndon"); !isNotFound(err) {
+			t.Fatalf("got error %v, want a not found error", err)
+		}
+	}
+
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
+
+func TestCachingWeatherProviderDoesNotCacheTransientErrors(t *testing.T) {
+	p := &testCountingWeatherProvider{err: context.DeadlineExceeded}
+	c := NewCachingWeatherProvider(p, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.temperature(context.Background(), "london"); err != context.DeadlineExceeded {
+			t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+
+	if p.calls != 2 {
+		t.Errorf("provider called %d times, want 2", p.calls)
+	}
+}
+
+func TestCachingWeatherProviderCollapsesConcurrentMisses(t *testing.T) {
+	p := &testCountingWeatherProvider{delay: 50 * time.Millisecond}
+	c := NewCachingWeatherProvider(p, time.Minute, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.temperature(context.Background(), "london")
+		}()
+	}
+	wg.Wait()
+
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
+
+func TestSingleFlightWeatherProvider(t *testing.T) {
+	p := &testCountingWeatherProvider{delay: 50 * time.Millisecond}
+	s := NewSingleFlightWeatherProvider(p)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if k, err := s.temperature(context.Background(), "london"); err != nil || k != 290 {
+				t.Errorf("got %v, %v", k, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+
+	// Nothing is remembered once the call is done.
+	s.temperature(context.Background(), "london")
+	if p.calls != 2 {
+		t.Errorf("provider called %d times, want 2", p.calls)
+	}
+}
+
+// testGatedWeatherProvider answers once release is closed, or fails when
+// ctx is done first. It signals each call on started.
+type testGatedWeatherProvider struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t testGatedWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	t.started <- struct{}{}
+	select {
+	case <-t.release:
+		recordLocation(ctx, location{Lat: 51.5, Lng: -0.12})
+		return 290, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestSingleFlightOutlivesLeader(t *testing.T) {
+	p := testGatedWeatherProvider{started: make(chan struct{}, 1), release: make(chan struct{})}
+	s := NewSingleFlightWeatherProvider(p)
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := s.temperature(leaderCtx, "london")
+		leaderErr <- err
+	}()
+	<-p.started
+
+	var l *location
+	type result struct {
+		k   Temperature
+		err error
+	}
+	follower := make(chan result)
+	go func() {
+		k, err := s.temperature(withLocationRecorder(context.Background(), &l), "london")
+		follower <- result{k, err}
+	}()
+	time.Sleep(20 * time.Millisecond) // let the follower join the flight
+
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader got %v, want %v", err, context.Canceled)
+	}
+
+	close(p.release)
+	if r := <-follower; r.err != nil || r.k != 290 {
+		t.Errorf("follower got %v, %v; want 290", r.k, r.err)
+	}
+	if l == nil || *l != (location{Lat: 51.5, Lng: -0.12}) {
+		t.Errorf("follower recorded location %v, want 51.5,-0.12", l)
+	}
+}
+
+// testCountingGeoCode counts how often it is asked for a location.
+type testCountingGeoCode struct {
+	calls int
+	err   error
+}
+
+func (g *testCountingGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	g.calls++
+	if g.err != nil {
+		return location{}, g.err
+	}
+	return location{Lat: 51.5, Lng: -0.12}, nil
+}
+
+func TestCachingGeoCode(t *testing.T) {
+	gc := &testCountingGeoCode{}
+	c := NewCachingGeoCode(gc, 0, 0)
+
+	for _, city := range []string{"London", "london", "LONDON"} {
+		l, err := c.findCityLocation(context.Background(), city, "")
+		if err != nil || l.Lat != 51.5 {
+			t.Fatalf("got %+v, %v", l, err)
+		}
+	}
+
+	if gc.calls != 1 {
+		t.Errorf("geocoder called %d times, want 1", gc.calls)
+	}
+}
+
+func TestCachingGeoCodeExpires(t *testing.T) {
+	gc := &testCountingGeoCode{}
+	c := NewCachingGeoCode(gc, time.Hour, 0)
+	clock := newFakeClock()
+	c.clock = clock
+
+	c.findCityLocation(context.Background(), "london", "")
+	clock.Advance(time.Hour)
+	c.findCityLocation(context.Background(), "london", "")
+
+	if gc.calls != 2 {
+		t.Errorf("geocoder called %d times, want 2", gc.calls)
+	}
+}
+
+func TestCachingGeoCodeCachesNotFound(t *testing.T) {
+	gc := &testCountingGeoCode{err: fmt.Errorf("test: %w: lndon", errCityNotFound)}
+	c := NewCachingGeoCode(gc, 0, 30*time.Second)
+	clock := newFakeClock()
+	c.clock = clock
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.findCityLocation(context.Background(), "lndon", ""); !errors.Is(err, errCityNotFound) {
+			t.Fatalf("got error %v, want %v", err, errCityNotFound)
+		}
+	}
+	if gc.calls != 1 {
+		t.Errorf("geocoder called %d times, want 1", gc.calls)
+	}
+
+	clock.Advance(30 * time.Second)
+	c.findCityLocation(context.Background(), "lndon", "")
+	if gc.calls != 2 {
+		t.Errorf("geocoder called %d times after the negative TTL, want 2", gc.calls)
+	}
+}
+
+func TestCachingWeatherProviderForgetsNotFound(t *testing.T) {
+	p := &testCountingWeatherProvider{err: statusError{provider: "test", code: http.StatusNotFound}}
+	c := NewCachingWeatherProvider(p, time.Minute, time.Minute)
+	clock := newFakeClock()
+	c.clock = clock
+
+	for i := 0; i < 100; i++ {
+		c.temperature(context.Background(), fmt.Sprintf("nowhere%d", i))
+	}
+	clock.Advance(cacheSweepInterval)
+	c.temperature(context.Background(), "nowhere")
+
+	c.mu.RLock()
+	n := len(c.entries)
+	c.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("cache holds %d entries, want only the latest after a sweep", n)
+	}
+}
+
+func TestCachingGeoCodeIsBounded(t *testing.T) {
+	gc := &testCountingGeoCode{err: fmt.Errorf("test: %w", errCityNotFound)}
+	c := NewCachingGeoCode(gc, 0, time.Hour)
+	clock := newFakeClock()
+	c.clock = clock
+
+	for i := 0; i < maxCacheEntries+10; i++ {
+		c.findCityLocation(context.Background(), fmt.Sprintf("nowhere%d", i), "")
+	}
+	if n := len(c.entries); n != maxCacheEntries {
+		t.Errorf("cache holds %d entries, want at most %d", n, maxCacheEntries)
+	}
+
+	// Once expired, entries make room for new ones.
+	clock.Advance(time.Hour)
+	c.findCityLocation(context.Background(), "nowhere", "")
+	if n := len(c.entries); n != 1 {
+		t.Errorf("cache holds %d entries after they expired, want 1", n)
+	}
+}
+
+func TestCachingGeoCodeEvictsOldest(t *testing.T) {
+	gc := &testCountingGeoCode{}
+	c := NewCachingGeoCode(gc, 0, 0)
+	clock := newFakeClock()
+	c.clock = clock
+
+	for i := 0; i < maxCacheEntries; i++ {
+		c.findCityLocation(context.Background(), fmt.Sprintf("city%d", i), "")
+		clock.Advance(time.Millisecond)
+	}
+	c.findCityLocation(context.Background(), "london", "")
+	if n := len(c.entries); n != maxCacheEntries {
+		t.Errorf("cache holds %d entries, want %d", n, maxCacheEntries)
+	}
+
+	calls := gc.calls
+	c.findCityLocation(context.Background(), "london", "")
+	c.findCityLocation(context.Background(), "city1", "")
+	if gc.calls != calls {
+		t.Errorf("geocoder called %d times for cached cities, want 0", gc.calls-calls)
+	}
+	c.findCityLocation(context.Background(), "city0", "")
+	if gc.calls != calls+1 {
+		t.Errorf("geocoder called %d times for the evicted city, want 1", gc.calls-calls)
+	}
+}
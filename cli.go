@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// runQuery looks up the weather in city once, as the server would for
+// /weather/<city>, and writes it to out in format.
+func runQuery(mw multiWeatherProvider, city, unit, format string, timeout time.Duration, out io.Writer) error {
+	if format != "json" && format != "text" {
+		return fmt.Errorf("unknown format %q, expected json or text", format)
+	}
+	if _, err := convertFromKelvin(0, unit); err != nil {
+		return err
+	}
+
+	begin := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, _, err := mw.lookup(ctx, normalizeCity(city), unit, defaultPrecision)
+	if err != nil {
+		return err
+	}
+	resp.Took = time.Since(begin).String()
+
+	return writeQueryResult(out, resp, format)
+}
+
+// writeQueryResult writes resp to out, either as the same JSON the server
+// answers with or as a line of text.
+func writeQueryResult(out io.Writer, resp WeatherResponse, format string) error {
+	if format == "json" {
+		return json.NewEncoder(out).Encode(resp)
+	}
+
+	line := fmt.Sprintf("%s: %v %s", resp.City, resp.Temp, unitSymbol(resp.Unit))
+	if resp.FeelsLike != nil {
+		line += fmt.Sprintf(", feels like %v %s", *resp.FeelsLike, unitSymbol(resp.Unit))
+	}
+	if resp.Humidity != nil {
+		line += fmt.Sprintf(", %v%% humidity", *resp.Humidity)
+	}
+	_, err := fmt.Fprintln(out, line)
+	return err
+}
+
+// unitSymbol abbreviates unit for display.
+func unitSymbol(unit string) string {
+	switch unit {
+	case unitCelsius:
+		return "°C"
+	case unitFahrenheit:
+		return "°F"
+	}
+	return "K"
+}
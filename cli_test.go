@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWriteQueryResultText(t *testing.T) {
+	fl, h := 15.2, 60.0
+	tests := []struct {
+		resp WeatherResponse
+		want string
+	}{
+		{WeatherResponse{City: "london", Temp: 290, Unit: unitKelvin}, "london: 290 K\n"},
+		{WeatherResponse{City: "london", Temp: 16.85, Unit: unitCelsius, FeelsLike: &fl, Humidity: &h}, "london: 16.85 °C, feels like 15.2 °C, 60% humidity\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeQueryResult(&buf, tt.resp, "text"); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("got %q, want %q", buf.String(), tt.want)
+		}
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	mw := multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}}
+
+	var buf bytes.Buffer
+	if err := runQuery(mw, "London", unitCelsius, "json", time.Second, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp WeatherResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if resp.City != "london" || resp.Temp != 16.85 || resp.Unit != unitCelsius || resp.Took == "" {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestRunQueryBadArguments(t *testing.T) {
+	mw := multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}}
+
+	for _, args := range [][2]string{{"rankine", "json"}, {unitKelvin, "xml"}} {
+		var buf bytes.Buffer
+		if err := runQuery(mw, "london", args[0], args[1], time.Second, &buf); err == nil {
+			t.Errorf("units %q, format %q: expected an error", args[0], args[1])
+		}
+	}
+}
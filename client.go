@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultUserAgent identifies us to upstream APIs that reject Go's default.
+const defaultUserAgent = "how-i-start-go/1.0"
+
+// NewProviderClient returns the HTTP client shared by providers and
+// geocoders. Every request it sends carries userAgent, or defaultUserAgent
+// if that is empty, unless the request already sets its own.
+//
+// Without options the client uses http.DefaultTransport; otherwise it uses a
+// copy of it with the options applied.
+func NewProviderClient(timeout time.Duration, userAgent string, opts ...ClientOption) *http.Client {
+	base := http.DefaultTransport
+	if len(opts) > 0 {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		for _, opt := range opts {
+			opt(t)
+		}
+		base = t
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: userAgentTransport{
+			userAgent: orDefault(userAgent, defaultUserAgent),
+			base:      base,
+		},
+	}
+}
+
+// A ClientOption configures the transport of a provider client.
+type ClientOption func(*http.Transport)
+
+// WithProxy sends every request through the proxy at u, instead of the one
+// named by HTTP_PROXY and friends.
+func WithProxy(u *url.URL) ClientOption {
+	return func(t *http.Transport) {
+		t.Proxy = http.ProxyURL(u)
+	}
+}
+
+// WithRootCAs verifies servers against pool instead of the system roots.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(t *http.Transport) {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+}
+
+// WithMaxIdleConnsPerHost sets how many idle connections are kept per host.
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(t *http.Transport) {
+		t.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithDisableKeepAlives uses a new connection for every request.
+func WithDisableKeepAlives() ClientOption {
+	return func(t *http.Transport) {
+		t.DisableKeepAlives = true
+	}
+}
+
+// clientOptions returns the client options asked for by cfg.
+func clientOptions(cfg Config) ([]ClientOption, error) {
+	var opts []ClientOption
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+		opts = append(opts, WithProxy(u))
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.CAFile)
+		}
+		opts = append(opts, WithRootCAs(pool))
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		opts = append(opts, WithMaxIdleConnsPerHost(cfg.MaxIdleConnsPerHost))
+	}
+	if cfg.DisableKeepAlives {
+		opts = append(opts, WithDisableKeepAlives())
+	}
+	return opts, nil
+}
+
+// userAgentTransport sets the User-Agent header on outgoing requests.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("User-Agent") == "" {
+		// RoundTrippers mustn't modify the caller's request.
+		r = r.Clone(r.Context())
+		r.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(r)
+}
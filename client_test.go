@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProviderClientUserAgent(t *testing.T) {
+	for _, tt := range []struct {
+		userAgent, want string
+	}{
+		{"", defaultUserAgent},
+		{"my-service/2.0", "my-service/2.0"},
+	} {
+		var got []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = append(got, r.Header.Get("User-Agent"))
+			w.Write([]byte(`{"main":{"temp":290},"current_observation":{"temp_c":17},"currently":{"temperature":59}}`))
+		}))
+
+		c := NewProviderClient(time.Second, tt.userAgent)
+		openWeatherMap{client: c, baseURL: srv.URL}.temperature(context.Background(), "london")
+		weatherUnderground{client: c, baseURL: srv.URL}.temperature(context.Background(), "london")
+		forecastIo{client: c, baseURL: srv.URL, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}.temperature(context.Background(), "london")
+		srv.Close()
+
+		if len(got) != 3 {
+			t.Fatalf("got %d requests, want 3", len(got))
+		}
+		for _, ua := range got {
+			if ua != tt.want {
+				t.Errorf("got User-Agent %q, want %q", ua, tt.want)
+			}
+		}
+	}
+}
+
+func TestProviderClientKeepsRequestUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("User-Agent", "custom")
+	resp, err := NewProviderClient(time.Second, "").Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if got != "custom" {
+		t.Errorf("got User-Agent %q, want custom", got)
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "custom" {
+		t.Errorf("request header was modified to %q", ua)
+	}
+}
+
+func TestProviderClientDefaultTransport(t *testing.T) {
+	c := NewProviderClient(time.Second, "")
+	if tr := c.Transport.(userAgentTransport).base; tr != http.DefaultTransport {
+		t.Errorf("got transport %v, want http.DefaultTransport", tr)
+	}
+}
+
+func TestProviderClientOptions(t *testing.T) {
+	pool := x509.NewCertPool()
+	c := NewProviderClient(time.Second, "",
+		WithRootCAs(pool),
+		WithMaxIdleConnsPerHost(7),
+		WithDisableKeepAlives(),
+	)
+
+	tr := c.Transport.(userAgentTransport).base.(*http.Transport)
+	if tr.TLSClientConfig == nil || tr.TLSClientConfig.RootCAs != pool {
+		t.Error("root CAs not set")
+	}
+	if tr.MaxIdleConnsPerHost != 7 {
+		t.Errorf("got MaxIdleConnsPerHost %d, want 7", tr.MaxIdleConnsPerHost)
+	}
+	if !tr.DisableKeepAlives {
+		t.Error("keep-alives not disabled")
+	}
+	if http.DefaultTransport.(*http.Transport).DisableKeepAlives {
+		t.Error("http.DefaultTransport was modified")
+	}
+}
+
+func TestProviderClientProxy(t *testing.T) {
+	var got string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.String()
+		w.Write([]byte(`{"main":{"temp":290}}`))
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	p := openWeatherMap{client: NewProviderClient(time.Second, "", WithProxy(u))}
+	if _, err := p.temperature(context.Background(), "london"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := "http://api.openweathermap.org/data/2.5/weather?q=london"; got != want {
+		t.Errorf("proxy got %q, want %q", got, want)
+	}
+}
+
+func TestClientOptionsBadCAFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not a certificate")
+	f.Close()
+
+	if _, err := clientOptions(Config{CAFile: f.Name()}); err == nil {
+		t.Error("expected an error for a file with no certificates")
+	}
+}
+
+func TestSharedProviderClientReusesConnections(t *testing.T) {
+	var mu sync.Mutex
+	conns := 0
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"main":{"temp":290},"current_observation":{"temp_c":17}}`))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	c := NewProviderClient(time.Second, "")
+	providers := []weatherProvider{
+		openWeatherMap{client: c, baseURL: srv.URL},
+		weatherUnderground{client: c, baseURL: srv.URL},
+	}
+	for i := 0; i < 5; i++ {
+		for _, p := range providers {
+			if _, err := p.temperature(context.Background(), "london"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("opened %d connections for 10 sequential requests, want 1", conns)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// clock tells the time. Anything that expires or measures durations takes
+// one, so that tests can move time along instead of sleeping.
+type clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// since returns the time elapsed on c since t. A nil c is the system clock.
+func since(c clock, t time.Time) time.Duration {
+	return nowOn(c).Sub(t)
+}
+
+// nowOn returns the time on c, or the system time if c is nil.
+func nowOn(c clock) time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// compareHandler serves /weather/compare/<city>, putting every provider's
+// reading side by side, unaveraged, to show how far they disagree.
+type compareHandler struct {
+	mw      multiWeatherProvider
+	timeout time.Duration
+}
+
+// CompareResponse is the body of a /weather/compare/<city> response.
+// Temperatures are in Unit. Min, Max and Disagreement are left out when no
+// provider answered.
+type CompareResponse struct {
+	City      string            `json:"city"`
+	Unit      string            `json:"unit"`
+	Providers []ComparedReading `json:"providers"`
+
+	Min          *float64 `json:"min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	Disagreement *float64 `json:"disagreement,omitempty"` // max - min
+
+	// Failed names the providers that didn't answer.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// ComparedReading is one provider's answer in a CompareResponse.
+type ComparedReading struct {
+	Name  string   `json:"name"`
+	Temp  *float64 `json:"temp"`
+	Error string   `json:"error,omitempty"`
+}
+
+func (h compareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, unit, ok := parseStreamRequest(w, r, "/weather/compare/")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	// Every provider's reading is wanted, whatever mode mw is in.
+	check := h.mw
+	check.strict = false
+	readings, err := check.temperatures(ctx, city)
+	if readings == nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	resp := compareReadings(city, unit, readings)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(statusForError(err))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// compareReadings builds the comparison of readings, with temperatures
+// converted to unit.
+func compareReadings(city, unit string, readings []ProviderReading) CompareResponse {
+	resp := CompareResponse{City: city, Unit: unit, Providers: make([]ComparedReading, 0, len(readings))}
+
+	var temps []float64
+	for _, reading := range readings {
+		c := ComparedReading{Name: reading.Name}
+		if reading.Err != nil {
+			c.Error = reading.Err.Error()
+			resp.Failed = append(resp.Failed, reading.Name)
+		} else {
+			t, _ := convertFromKelvin(reading.TempKelvin, unit)
+			c.Temp = roundedPtr(t, defaultPrecision)
+			temps = append(temps, t)
+		}
+		resp.Providers = append(resp.Providers, c)
+	}
+
+	if len(temps) > 0 {
+		s := spreadOf(temps)
+		resp.Min = roundedPtr(s.min, defaultPrecision)
+		resp.Max = roundedPtr(s.max, defaultPrecision)
+		resp.Disagreement = roundedPtr(s.max-s.min, defaultPrecision)
+	}
+	return resp
+}
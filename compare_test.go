@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCompareHandler(t *testing.T) {
+	h := compareHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			testConstantWeatherProvider(290),
+			testConstantWeatherProvider(295.5),
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+			testConstantWeatherProvider(288),
+		}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/compare/London", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp CompareResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.City != "london" || resp.Unit != unitKelvin {
+		t.Errorf("got city %q, unit %q", resp.City, resp.Unit)
+	}
+	if resp.Disagreement == nil || *resp.Disagreement != 7.5 {
+		t.Errorf("got disagreement %v, want 7.5", resp.Disagreement)
+	}
+	if resp.Min == nil || *resp.Min != 288 || resp.Max == nil || *resp.Max != 295.5 {
+		t.Errorf("got min %v, max %v, want 288 and 295.5", resp.Min, resp.Max)
+	}
+
+	if len(resp.Providers) != 4 {
+		t.Fatalf("got %d providers, want 4", len(resp.Providers))
+	}
+	for i, want := range []float64{290, 295.5, 0, 288} {
+		p := resp.Providers[i]
+		if i == 2 {
+			if p.Temp != nil || p.Error != "wunderground: 500" {
+				t.Errorf("provider %d: got %+v, want it flagged as failed", i, p)
+			}
+			continue
+		}
+		if p.Temp == nil || *p.Temp != want || p.Error != "" {
+			t.Errorf("provider %d: got %+v, want %v", i, p, want)
+		}
+	}
+	if len(resp.Failed) != 1 {
+		t.Errorf("got failed %v, want one provider", resp.Failed)
+	}
+}
+
+func TestCompareHandlerAllFailing(t *testing.T) {
+	h := compareHandler{
+		mw: multiWeatherProvider{
+			providers: []weatherProvider{testFailingWeatherProvider{statusError{provider: "test", code: http.StatusServiceUnavailable}}},
+			strict:    true,
+		},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/compare/london?units=celsius", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+
+	var resp CompareResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if resp.Disagreement != nil || len(resp.Failed) != 1 || resp.Unit != unitCelsius {
+		t.Errorf("got %+v", resp)
+	}
+}
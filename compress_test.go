@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipCompressesLargeResponses(t *testing.T) {
+	large := strings.Repeat(`{"city":"london","temp":290}`, 100)
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(large))
+	}), gzipMinSize)
+
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("got Vary %q, want Accept-Encoding", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != large {
+		t.Errorf("body didn't survive compression: %q", b)
+	}
+}
+
+func TestGzipLeavesSmallResponses(t *testing.T) {
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`{"city":"london","temp":290}`))
+	}), gzipMinSize)
+
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q, want none", got)
+	}
+	if rec.Code != http.StatusTeapot || rec.Body.String() != `{"city":"london","temp":290}` {
+		t.Errorf("got %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestGzipNeedsAcceptEncoding(t *testing.T) {
+	large := strings.Repeat("x", 2*gzipMinSize)
+	h := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(large))
+	}), gzipMinSize)
+
+	for _, ae := range []string{"", "deflate", "gzip;q=0"} {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		req.Header.Set("Accept-Encoding", ae)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != "" || rec.Body.String() != large {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q", ae, got)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Conditions describes the current weather somewhere. Only the temperature is
+// always known; other fields are nil when a provider doesn't report them.
+type Conditions struct {
+	TempKelvin            float64
+	HumidityPercent       *float64
+	WindSpeedMetersPerSec *float64
+	WindDirectionDegrees  *float64 // the direction the wind blows from
+	ApparentTempKelvin    *float64 // what the temperature feels like
+	UVIndex               *float64
+	PressureHPa           *float64  // at sea level
+	ObservedAt            time.Time // zero if the provider doesn't say
+}
+
+// conditionsProvider is implemented by providers that can report more than
+// just the temperature.
+type conditionsProvider interface {
+	conditions(ctx context.Context, city string) (Conditions, error)
+}
+
+// conditionsOf returns the current conditions from p, or just the
+// temperature if that's all p knows about.
+func conditionsOf(ctx context.Context, p weatherProvider, city string) (Conditions, error) {
+	if cp, ok := p.(conditionsProvider); ok {
+		return cp.conditions(ctx, city)
+	}
+	k, err := p.temperature(ctx, city)
+	return Conditions{TempKelvin: k.Kelvin()}, err
+}
+
+// unixTime converts a Unix time from a provider, treating 0 as unknown.
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+// reported returns field's value for each successful reading that has one.
+func reported(readings []ProviderReading, field func(Conditions) *float64) []float64 {
+	var vs []float64
+	for _, r := range readings {
+		if r.Err != nil {
+			continue
+		}
+		if v := field(r.Conditions); v != nil {
+			vs = append(vs, *v)
+		}
+	}
+	return vs
+}
+
+// averageReported returns the mean of field across the successful readings
+// that report it, or nil if none do.
+func averageReported(readings []ProviderReading, field func(Conditions) *float64) *float64 {
+	vs := reported(readings, field)
+	if len(vs) == 0 {
+		return nil
+	}
+	avg := MeanAggregator{}.Aggregate(vs)
+	return &avg
+}
+
+// averageHumidity returns the mean humidity across the successful readings
+// that report one, or nil if none do.
+func averageHumidity(readings []ProviderReading) *float64 {
+	return averageReported(readings, func(c Conditions) *float64 { return c.HumidityPercent })
+}
+
+// averageWindSpeed returns the mean wind speed across the successful readings
+// that report one, or nil if none do.
+func averageWindSpeed(readings []ProviderReading) *float64 {
+	return averageReported(readings, func(c Conditions) *float64 { return c.WindSpeedMetersPerSec })
+}
+
+// averagePressure returns the mean pressure across the successful readings
+// that report one, or nil if none do.
+func averagePressure(readings []ProviderReading) *float64 {
+	return averageReported(readings, func(c Conditions) *float64 { return c.PressureHPa })
+}
+
+// averageUVIndex returns the mean UV index across the successful readings
+// that report one, or nil if none do.
+func averageUVIndex(readings []ProviderReading) *float64 {
+	return averageReported(readings, func(c Conditions) *float64 { return c.UVIndex })
+}
+
+// averageFeelsLike returns the mean apparent temperature across the
+// successful readings, or nil if there are none. Readings from providers
+// that don't report one use an estimate from the other conditions.
+func averageFeelsLike(readings []ProviderReading) *float64 {
+	return averageReported(readings, func(c Conditions) *float64 {
+		if c.ApparentTempKelvin != nil {
+			return c.ApparentTempKelvin
+		}
+		k := apparentTemperature(c.TempKelvin, c.HumidityPercent, c.WindSpeedMetersPerSec)
+		return &k
+	})
+}
+
+// apparentTemperature estimates what a temperature feels like, using the
+// wind chill index when it is cold and windy, and the heat index when it is
+// hot and humidity is known. Otherwise it is the temperature itself.
+func apparentTemperature(kelvin float64, humidityPercent, windSpeedMetersPerSec *float64) float64 {
+	c := kelvin - 273.15
+
+	// Wind chill, as used by Environment Canada and the US National Weather
+	// Service, is defined for temperatures up to 10°C and winds over 4.8 km/h.
+	if windSpeedMetersPerSec != nil && c <= 10 {
+		if v := *windSpeedMetersPerSec * 3.6; v > 4.8 {
+			v16 := math.Pow(v, 0.16)
+			return 13.12 + 0.6215*c - 11.37*v16 + 0.3965*c*v16 + 273.15
+		}
+	}
+
+	// The NWS heat index (Rothfusz's regression) works in Fahrenheit and is
+	// defined from 80°F.
+	if humidityPercent != nil {
+		if t := c*1.8 + 32; t >= 80 {
+			rh := *humidityPercent
+			hi := -42.379 + 2.04901523*t + 10.14333127*rh -
+				0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+				0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+			return (hi-32)/1.8 + 273.15
+		}
+	}
+
+	return kelvin
+}
+
+// averageWindDirection returns the circular mean of the wind directions
+// reported by the successful readings, or nil if none report one.
+func averageWindDirection(readings []ProviderReading) *float64 {
+	degs := reported(readings, func(c Conditions) *float64 { return c.WindDirectionDegrees })
+	if len(degs) == 0 {
+		return nil
+	}
+	avg := circularMean(degs)
+	return &avg
+}
+
+// circularMean averages compass bearings in degrees, so that 350° and 10°
+// average to 0° rather than 180°. The result is in [0, 360).
+func circularMean(degs []float64) float64 {
+	var sin, cos float64
+	for _, d := range degs {
+		r := d * math.Pi / 180
+		sin += math.Sin(r)
+		cos += math.Cos(r)
+	}
+	mean := math.Atan2(sin, cos) * 180 / math.Pi
+	if mean < 0 {
+		mean += 360
+	}
+	// Round away float noise so that due north comes out as 0, not 359.99...
+	mean = math.Round(mean*1e9) / 1e9
+	if mean >= 360 {
+		mean -= 360
+	}
+	return mean
+}
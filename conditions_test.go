@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProvidersReportHumidity(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider func(c *http.Client) conditionsProvider
+		body     string
+		want     float64
+	}{
+		{
+			"openWeatherMap",
+			func(c *http.Client) conditionsProvider { return openWeatherMap{client: c} },
+			`{"main":{"temp":290,"humidity":72}}`,
+			72,
+		},
+		{
+			"weatherUnderground",
+			func(c *http.Client) conditionsProvider { return weatherUnderground{client: c} },
+			`{"current_observation":{"temp_c":17,"relative_humidity":"65%"}}`,
+			65,
+		},
+		{
+			"forecastIo",
+			func(c *http.Client) conditionsProvider {
+				return forecastIo{client: c, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+			},
+			`{"currently":{"temperature":59,"humidity":0.83}}`,
+			83,
+		},
+	}
+
+	for _, tt := range tests {
+		var urls []string
+		c, err := tt.provider(recordingClient(&urls, tt.body)).conditions(context.Background(), "london")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if c.HumidityPercent == nil || math.Abs(*c.HumidityPercent-tt.want) > 1e-9 {
+			t.Errorf("%s: got humidity %v, want %v", tt.name, c.HumidityPercent, tt.want)
+		}
+	}
+}
+
+func TestProvidersWithoutHumidity(t *testing.T) {
+	var urls []string
+	c, err := openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}.conditions(context.Background(), "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HumidityPercent != nil {
+		t.Errorf("got humidity %v, want none", *c.HumidityPercent)
+	}
+}
+
+// testHumidWeatherProvider reports a fixed temperature and humidity.
+type testHumidWeatherProvider struct {
+	kelvin, humidity float64
+}
+
+func (t testHumidWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return FromKelvin(t.kelvin), nil
+}
+
+func (t testHumidWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	h := t.humidity
+	return Conditions{TempKelvin: t.kelvin, HumidityPercent: &h}, nil
+}
+
+func TestAverageHumidity(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testHumidWeatherProvider{290, 60},
+			testConstantWeatherProvider(280),
+			NewCachingWeatherProvider(testHumidWeatherProvider{285, 80}, time.Minute, 0),
+			testFailingWeatherProvider{errors.New("down")},
+		},
+	}
+
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := averageHumidity(readings); h == nil || *h != 70 {
+		t.Errorf("got %v, want 70", h)
+	}
+	if temp := w.aggregate(readings); temp != 285 {
+		t.Errorf("got temperature %v, want 285", temp)
+	}
+}
+
+func TestAverageHumidityNone(t *testing.T) {
+	readings := []ProviderReading{{Conditions: Conditions{TempKelvin: 290}}}
+	if h := averageHumidity(readings); h != nil {
+		t.Errorf("got %v, want nil", *h)
+	}
+}
+
+func TestCircularMean(t *testing.T) {
+	tests := []struct {
+		degs []float64
+		want float64
+	}{
+		{[]float64{350, 10}, 0},
+		{[]float64{90, 180}, 135},
+		{[]float64{340, 20, 0}, 0},
+		{[]float64{270}, 270},
+		{[]float64{300, 320}, 310},
+	}
+
+	for _, tt := range tests {
+		if got := circularMean(tt.degs); math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("circularMean(%v) = %v, want %v", tt.degs, got, tt.want)
+		}
+	}
+}
+
+func TestProvidersReportWind(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    func(c *http.Client) conditionsProvider
+		body        string
+		wantSpeed   float64
+		wantBearing float64
+	}{
+		{
+			"openWeatherMap",
+			func(c *http.Client) conditionsProvider { return openWeatherMap{client: c} },
+			`{"main":{"temp":290},"wind":{"speed":4.1,"deg":220}}`,
+			4.1, 220,
+		},
+		{
+			"weatherUnderground",
+			func(c *http.Client) conditionsProvider { return weatherUnderground{client: c} },
+			`{"current_observation":{"temp_c":17,"wind_kph":18,"wind_degrees":90}}`,
+			5, 90,
+		},
+		{
+			"forecastIo",
+			func(c *http.Client) conditionsProvider {
+				return forecastIo{client: c, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+			},
+			`{"currently":{"temperature":59,"windSpeed":10,"windBearing":315}}`,
+			4.4704, 315,
+		},
+	}
+
+	for _, tt := range tests {
+		var urls []string
+		c, err := tt.provider(recordingClient(&urls, tt.body)).conditions(context.Background(), "london")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if c.WindSpeedMetersPerSec == nil || math.Abs(*c.WindSpeedMetersPerSec-tt.wantSpeed) > 1e-9 {
+			t.Errorf("%s: got wind speed %v, want %v", tt.name, c.WindSpeedMetersPerSec, tt.wantSpeed)
+		}
+		if c.WindDirectionDegrees == nil || *c.WindDirectionDegrees != tt.wantBearing {
+			t.Errorf("%s: got wind direction %v, want %v", tt.name, c.WindDirectionDegrees, tt.wantBearing)
+		}
+	}
+}
+
+func TestAverageWind(t *testing.T) {
+	speed := func(v float64) *float64 { return &v }
+	readings := []ProviderReading{
+		{Conditions: Conditions{WindSpeedMetersPerSec: speed(4), WindDirectionDegrees: speed(350)}},
+		{Conditions: Conditions{WindSpeedMetersPerSec: speed(6), WindDirectionDegrees: speed(10)}},
+		{Conditions: Conditions{}},
+	}
+
+	if ws := averageWindSpeed(readings); ws == nil || *ws != 5 {
+		t.Errorf("got wind speed %v, want 5", ws)
+	}
+	if wd := averageWindDirection(readings); wd == nil || *wd != 0 {
+		t.Errorf("got wind direction %v, want 0", wd)
+	}
+}
+
+func TestProvidersReportFeelsLike(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider func(c *http.Client) conditionsProvider
+		body     string
+		want     float64
+	}{
+		{
+			"openWeatherMap",
+			func(c *http.Client) conditionsProvider { return openWeatherMap{client: c} },
+			`{"main":{"temp":290,"feels_like":289.5}}`,
+			289.5,
+		},
+		{
+			"forecastIo",
+			func(c *http.Client) conditionsProvider {
+				return forecastIo{client: c, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+			},
+			`{"currently":{"temperature":59,"apparentTemperature":50}}`,
+			283.15,
+		},
+	}
+
+	for _, tt := range tests {
+		var urls []string
+		c, err := tt.provider(recordingClient(&urls, tt.body)).conditions(context.Background(), "london")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if c.ApparentTempKelvin == nil || math.Abs(*c.ApparentTempKelvin-tt.want) > 1e-9 {
+			t.Errorf("%s: got feels like %v, want %v", tt.name, c.ApparentTempKelvin, tt.want)
+		}
+	}
+}
+
+func TestApparentTemperature(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name                string
+		celsius             float64
+		humidity, windSpeed *float64
+		want, tolerance     float64 // in °C
+	}{
+		// Environment Canada's wind chill chart gives -18 for -10°C at 20 km/h.
+		{"wind chill", -10, nil, f(20 / 3.6), -17.9, 0.05},
+		// The NWS heat index chart gives 106°F for 90°F at 70% humidity.
+		{"heat index", (90 - 32) / 1.8, f(70), nil, (106 - 32) / 1.8, 0.5},
+		{"mild", 18, f(70), f(5), 18, 0},
+		{"calm cold", 0, nil, f(1), 0, 0},
+	}
+
+	for _, tt := range tests {
+		got := apparentTemperature(tt.celsius+273.15, tt.humidity, tt.windSpeed) - 273.15
+		if math.Abs(got-tt.want) > tt.tolerance+1e-9 {
+			t.Errorf("%s: got %.2f°C, want %.2f°C", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAverageFeelsLike(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	readings := []ProviderReading{
+		{Conditions: Conditions{TempKelvin: 290, ApparentTempKelvin: f(288)}},
+		{Conditions: Conditions{TempKelvin: 292}}, // estimated as 292
+		{Err: errors.New("wunderground: 500")},
+	}
+
+	if fl := averageFeelsLike(readings); fl == nil || *fl != 290 {
+		t.Errorf("got feels like %v, want 290", fl)
+	}
+	if fl := averageFeelsLike(readings[2:]); fl != nil {
+		t.Errorf("got feels like %v with no readings, want nil", *fl)
+	}
+}
+
+// testConditionsWeatherProvider reports fixed conditions.
+type testConditionsWeatherProvider Conditions
+
+func (t testConditionsWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return FromKelvin(t.TempKelvin), nil
+}
+
+func (t testConditionsWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	return Conditions(t), nil
+}
+
+func TestAverageUVIndex(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	readings := []ProviderReading{
+		{Conditions: Conditions{TempKelvin: 290, UVIndex: f(2)}},
+		{Conditions: Conditions{TempKelvin: 291}},
+		{Conditions: Conditions{TempKelvin: 292, UVIndex: f(5)}},
+		{Err: errors.New("wunderground: 500")},
+	}
+
+	if uvi := averageUVIndex(readings); uvi == nil || *uvi != 3.5 {
+		t.Errorf("got UV index %v, want 3.5", uvi)
+	}
+	if uvi := averageUVIndex(readings[1:2]); uvi != nil {
+		t.Errorf("got UV index %v with none reported, want nil", *uvi)
+	}
+}
+
+func TestAveragePressure(t *testing.T) {
+	p := func(v float64) *float64 { return &v }
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testConditionsWeatherProvider{TempKelvin: 290, PressureHPa: p(1010)},
+			testConditionsWeatherProvider{TempKelvin: 290, PressureHPa: p(1016)},
+			testConstantWeatherProvider(290),
+			testFailingWeatherProvider{errors.New("down")},
+		},
+	}
+
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := averagePressure(readings); got == nil || *got != 1013 {
+		t.Errorf("got pressure %v, want 1013", got)
+	}
+	if got := averagePressure(readings[2:]); got != nil {
+		t.Errorf("got pressure %v with none reported, want nil", *got)
+	}
+}
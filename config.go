@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+)
+
+// Config holds everything needed to wire up and run the server.
+//
+// Settings are taken, in decreasing order of precedence, from command-line
+// flags, environment variables (API keys, ADMIN_TOKEN, AUTH_KEYS, HOST and
+// PORT), the JSON file named by the -config flag, and the defaults in
+// defaultConfig.
+type Config struct {
+	OpenWeatherMapAPIKey string   `json:"openweathermapApiKey"`
+	WundergroundAPIKey   string   `json:"wundergroundApiKey"`
+	ForecastIoAPIKey     string   `json:"forecastioApiKey"`
+	AccuWeatherAPIKey    string   `json:"accuweatherApiKey"`
+	MetOfficeAPIKey      string   `json:"metofficeApiKey"`
+	GoogleGeocodeAPIKey  string   `json:"googleGeocodeApiKey"`
+	AdminToken           string   `json:"adminToken"`
+	AuthKeys             string   `json:"authKeys"`
+	Listen               string   `json:"listen"`
+	GRPCListen           string   `json:"grpcListen"`
+	TLSCert              string   `json:"tlsCert"`
+	TLSKey               string   `json:"tlsKey"`
+	CORSOrigins          string   `json:"corsOrigins"`
+	ClientTimeout        duration `json:"clientTimeout"`
+	ReadHeaderTimeout    duration `json:"readHeaderTimeout"`
+	ReadTimeout          duration `json:"readTimeout"`
+	WriteTimeout         duration `json:"writeTimeout"`
+	IdleTimeout          duration `json:"idleTimeout"`
+	ProviderTimeouts     string   `json:"providerTimeouts"`
+	SlowThreshold        duration `json:"slowThreshold"`
+	Timeout              duration `json:"timeout"`
+	MaxTimeout           duration `json:"maxTimeout"`
+	SoftDeadline         duration `json:"softDeadline"`
+	StreamInterval       duration `json:"streamInterval"`
+	Strict               bool     `json:"strict"`
+	Demo                 bool     `json:"demo"`
+	Debug                bool     `json:"debug"`
+	Aggregation          string   `json:"aggregation"`
+	Concurrency          int      `json:"concurrency"`
+	MinProviders         int      `json:"minProviders"`
+	OutlierK             float64  `json:"outlierK"`
+	MinKelvin            float64  `json:"minKelvin"`
+	MaxKelvin            float64  `json:"maxKelvin"`
+	SmoothingAlpha       float64  `json:"smoothingAlpha"`
+	SmoothingWindow      duration `json:"smoothingWindow"`
+	RecencyHalfLife      duration `json:"recencyHalfLife"`
+	CacheTTL             duration `json:"cacheTTL"`
+	CacheHardTTL         duration `json:"cacheHardTTL"`
+	PrewarmCities        string   `json:"prewarmCities"`
+	PrewarmInterval      duration `json:"prewarmInterval"`
+	NegativeCacheTTL     duration `json:"negativeCacheTTL"`
+	Retries              int      `json:"retries"`
+	RetryDelay           duration `json:"retryDelay"`
+	RetryBudget          float64  `json:"retryBudget"`
+	RetryBudgetBurst     int      `json:"retryBudgetBurst"`
+	BreakerThreshold     int      `json:"breakerThreshold"`
+	BreakerCooldown      duration `json:"breakerCooldown"`
+	Geocoder             string   `json:"geocoder"`
+	GeocodeCacheTTL      duration `json:"geocodeCacheTTL"`
+	ReadyCity            string   `json:"readyCity"`
+	ReadyTimeout         duration `json:"readyTimeout"`
+	UserAgent            string   `json:"userAgent"`
+	RateLimitRPS         float64  `json:"rateLimitRps"`
+	RateLimitBurst       int      `json:"rateLimitBurst"`
+	TrustedProxies       string   `json:"trustedProxies"`
+	Proxy                string   `json:"proxy"`
+	CAFile               string   `json:"caFile"`
+	MaxIdleConnsPerHost  int      `json:"maxIdleConnsPerHost"`
+	DisableKeepAlives    bool     `json:"disableKeepAlives"`
+
+	// The providers to ask, which can only be given in the config file.
+	// Without any, buildProviders picks the usual ones.
+	Providers []ProviderConfig `json:"providers"`
+
+	// A one-off lookup to print instead of starting the server. These
+	// can only be given as flags.
+	City   string `json:"-"`
+	Units  string `json:"-"`
+	Format string `json:"-"`
+
+	// Print the version and exit.
+	Version bool `json:"-"`
+}
+
+// duration is a time.Duration that is written as a string like "10s" in
+// config files.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"10s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		WundergroundAPIKey: "0123456789abcdef",
+		ForecastIoAPIKey:   "0123456789abcdef",
+		Listen:             ":8080",
+		ClientTimeout:      duration{10 * time.Second},
+		Timeout:            duration{10 * time.Second},
+		MaxTimeout:         duration{25 * time.Second},
+		ReadHeaderTimeout:  duration{5 * time.Second},
+		ReadTimeout:        duration{10 * time.Second},
+		WriteTimeout:       duration{30 * time.Second},
+		IdleTimeout:        duration{2 * time.Minute},
+		Aggregation:        "mean",
+		Geocoder:           "google",
+		SlowThreshold:      duration{3 * time.Second},
+		SmoothingWindow:    duration{defaultSmoothingWindow},
+		RetryDelay:         duration{100 * time.Millisecond},
+		RetryBudgetBurst:   10,
+		BreakerCooldown:    duration{30 * time.Second},
+		ReadyTimeout:       duration{2 * time.Second},
+		StreamInterval:     duration{60 * time.Second},
+		NegativeCacheTTL:   duration{30 * time.Second},
+		Units:              unitKelvin,
+		Format:             "json",
+		UserAgent:          defaultUserAgent,
+		RateLimitBurst:     10,
+		MinProviders:       1,
+	}
+}
+
+// loadConfig builds the configuration from the process's flags, environment
+// and config file.
+func loadConfig() (Config, error) {
+	return loadConfigFrom(os.Args[1:], os.Getenv, flag.ExitOnError)
+}
+
+func loadConfigFrom(args []string, getenv func(string) string, onError flag.ErrorHandling) (Config, error) {
+	cfg := defaultConfig()
+
+	// Parse once to find the config file, then again on top of the file and
+	// environment so only flags that were actually given override them.
+	probe := cfg
+	fs, configPath := newFlagSet(&probe, onError)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configPath != "" {
+		b, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return Config{}, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+
+	if v := getenv("OPENWEATHERMAP_API_KEY"); v != "" {
+		cfg.OpenWeatherMapAPIKey = v
+	}
+	if v := getenv("WUNDERGROUND_API_KEY"); v != "" {
+		cfg.WundergroundAPIKey = v
+	}
+	if v := getenv("FORECASTIO_API_KEY"); v != "" {
+		cfg.ForecastIoAPIKey = v
+	}
+	if v := getenv("ACCUWEATHER_API_KEY"); v != "" {
+		cfg.AccuWeatherAPIKey = v
+	}
+	if v := getenv("METOFFICE_API_KEY"); v != "" {
+		cfg.MetOfficeAPIKey = v
+	}
+	if v := getenv("GOOGLE_GEOCODE_API_KEY"); v != "" {
+		cfg.GoogleGeocodeAPIKey = v
+	}
+	if v := getenv("ADMIN_TOKEN"); v != "" {
+		cfg.AdminToken = v
+	}
+	if v := getenv("AUTH_KEYS"); v != "" {
+		cfg.AuthKeys = v
+	}
+	cfg.Listen = resolveListen(cfg.Listen, getenv("HOST"), getenv("PORT"))
+
+	fs, _ = newFlagSet(&cfg, onError)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return Config{}, errors.New("serving TLS needs both -tls.cert and -tls.key")
+	}
+
+	return cfg, nil
+}
+
+// resolveListen overrides the host and/or port of the listen address when
+// they are given, keeping the rest of addr as it is.
+func resolveListen(addr, host, port string) string {
+	if host == "" && port == "" {
+		return addr
+	}
+	h, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		h, p = addr, ""
+	}
+	if host != "" {
+		h = host
+	}
+	if port != "" {
+		p = port
+	}
+	return net.JoinHostPort(h, p)
+}
+
+// newFlagSet returns a flag set that writes into cfg, using its current
+// values as the defaults.
+func newFlagSet(cfg *Config, onError flag.ErrorHandling) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(os.Args[0], onError)
+	configPath := fs.String("config", "", "path to a JSON config file")
+	fs.BoolVar(&cfg.Version, "version", cfg.Version, "print the version and exit")
+	fs.StringVar(&cfg.City, "city", cfg.City, "look up the weather in this city, print it and exit, instead of starting the server")
+	fs.StringVar(&cfg.Units, "units", cfg.Units, "units for -city: kelvin, celsius or fahrenheit")
+	fs.StringVar(&cfg.Format, "format", cfg.Format, "how to print -city's weather: json or text")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "address to listen on (or HOST and PORT)")
+	fs.StringVar(&cfg.TLSCert, "tls.cert", cfg.TLSCert, "PEM certificate file to serve HTTPS with, along with -tls.key")
+	fs.StringVar(&cfg.TLSKey, "tls.key", cfg.TLSKey, "PEM private key file for -tls.cert")
+	fs.StringVar(&cfg.CORSOrigins, "cors.origins", cfg.CORSOrigins, "comma-separated origins that browser pages may call the API from, or * for any (empty disables CORS)")
+	fs.StringVar(&cfg.GRPCListen, "grpc.listen", cfg.GRPCListen, "address to serve the gRPC Weather service on (empty disables it)")
+	fs.StringVar(&cfg.OpenWeatherMapAPIKey, "openweathermap.api.key", cfg.OpenWeatherMapAPIKey, "openweathermap.org API key (or OPENWEATHERMAP_API_KEY)")
+	fs.StringVar(&cfg.WundergroundAPIKey, "wunderground.api.key", cfg.WundergroundAPIKey, "wunderground.com API key (or WUNDERGROUND_API_KEY)")
+	fs.StringVar(&cfg.ForecastIoAPIKey, "forecastio.api.key", cfg.ForecastIoAPIKey, "forecast.io API key (or FORECASTIO_API_KEY)")
+	fs.StringVar(&cfg.AccuWeatherAPIKey, "accuweather.api.key", cfg.AccuWeatherAPIKey, "AccuWeather API key, enables AccuWeather when set (or ACCUWEATHER_API_KEY)")
+	fs.StringVar(&cfg.MetOfficeAPIKey, "metoffice.api.key", cfg.MetOfficeAPIKey, "Met Office DataPoint API key, enables the Met Office when set (or METOFFICE_API_KEY)")
+	fs.StringVar(&cfg.GoogleGeocodeAPIKey, "google.geocode.api.key", cfg.GoogleGeocodeAPIKey, "Google Geocoding API key, without which -geocoder google falls back to Nominatim (or GOOGLE_GEOCODE_API_KEY)")
+	fs.StringVar(&cfg.AdminToken, "admin.token", cfg.AdminToken, "shared secret for the /providers/<name>/enable and /disable endpoints, which are off without one (or ADMIN_TOKEN)")
+	fs.StringVar(&cfg.AuthKeys, "auth.keys", cfg.AuthKeys, "comma-separated API keys, one of which requests for the weather must carry in the X-API-Key header, leaving the API open if empty (or AUTH_KEYS)")
+	fs.DurationVar(&cfg.ClientTimeout.Duration, "client.timeout", cfg.ClientTimeout.Duration, "timeout for each upstream HTTP request")
+	fs.StringVar(&cfg.ProviderTimeouts, "provider.timeouts", cfg.ProviderTimeouts, "per-provider lookup timeouts, like forecastIo=8s,openWeatherMap=2s; each request is still cut off at -client.timeout, so a longer one needs that raised too")
+	fs.DurationVar(&cfg.SlowThreshold.Duration, "provider.slow.threshold", cfg.SlowThreshold.Duration, "log a warning for any provider lookup that takes longer than this (0 disables)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout.Duration, "server.read.header.timeout", cfg.ReadHeaderTimeout.Duration, "how long clients have to send request headers")
+	fs.DurationVar(&cfg.ReadTimeout.Duration, "server.read.timeout", cfg.ReadTimeout.Duration, "how long clients have to send a whole request")
+	fs.DurationVar(&cfg.WriteTimeout.Duration, "server.write.timeout", cfg.WriteTimeout.Duration, "how long a response may take to write, except for streams (should exceed -timeout)")
+	fs.DurationVar(&cfg.IdleTimeout.Duration, "server.idle.timeout", cfg.IdleTimeout.Duration, "how long to keep an idle client connection open")
+	fs.DurationVar(&cfg.Timeout.Duration, "timeout", cfg.Timeout.Duration, "maximum time to wait on providers for a single request")
+	fs.DurationVar(&cfg.MaxTimeout.Duration, "timeout.max", cfg.MaxTimeout.Duration, "longest -timeout clients may ask for with an X-Timeout-Ms header (should be under -server.write.timeout)")
+	fs.DurationVar(&cfg.SoftDeadline.Duration, "soft.deadline", cfg.SoftDeadline.Duration, "answer with the readings so far once this long has passed (0 waits for every provider)")
+	fs.DurationVar(&cfg.StreamInterval.Duration, "stream.interval", cfg.StreamInterval.Duration, "how often /weather/stream/<city> and /weather/sse/<city> send an update")
+	fs.BoolVar(&cfg.Strict, "strict", cfg.Strict, "fail the request if any provider fails, instead of averaging the rest")
+	fs.BoolVar(&cfg.Demo, "demo", cfg.Demo, "serve canned temperatures for a few cities instead of calling any APIs")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "serve /weather/debug/<city>, listing the URLs each provider would fetch with their API keys redacted")
+	fs.StringVar(&cfg.Aggregation, "aggregation", cfg.Aggregation, "how to combine provider readings: mean, median, mode or closest-median")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "maximum number of providers queried at once per request (0 for no limit)")
+	fs.IntVar(&cfg.MinProviders, "min.providers", cfg.MinProviders, "fail a lookup that fewer than this many providers answered")
+	fs.Float64Var(&cfg.OutlierK, "outlier.k", cfg.OutlierK, "drop readings more than this many standard deviations from the mean of all of them; a lone outlier among three readings is never more than 1.15 away, so needs a lower k (0 disables)")
+	fs.Float64Var(&cfg.MinKelvin, "min.kelvin", cfg.MinKelvin, "drop readings colder than this many Kelvin, such as 180 (0 disables)")
+	fs.Float64Var(&cfg.MaxKelvin, "max.kelvin", cfg.MaxKelvin, "drop readings hotter than this many Kelvin, such as 340 (0 disables)")
+	fs.Float64Var(&cfg.SmoothingAlpha, "smoothing.alpha", cfg.SmoothingAlpha, "report a moving average of each provider's readings, moving this fraction of the way to each new one (0 disables)")
+	fs.DurationVar(&cfg.SmoothingWindow.Duration, "smoothing.window", cfg.SmoothingWindow.Duration, "how long a city's moving average lasts without a new reading before starting afresh")
+	fs.DurationVar(&cfg.RecencyHalfLife.Duration, "recency.half.life", cfg.RecencyHalfLife.Duration, "halve the weight of a reading for each time this long has passed since it was observed (0 ignores age)")
+	fs.DurationVar(&cfg.CacheTTL.Duration, "cache.ttl", cfg.CacheTTL.Duration, "how long to cache each provider's readings (0 disables caching)")
+	fs.DurationVar(&cfg.CacheHardTTL.Duration, "cache.hard.ttl", cfg.CacheHardTTL.Duration, "how long to keep answering with a reading past -cache.ttl while refreshing it in the background (0 disables)")
+	fs.StringVar(&cfg.PrewarmCities, "prewarm.cities", cfg.PrewarmCities, "comma-separated cities to keep in the cache, refreshing them in the background (needs -cache.ttl)")
+	fs.DurationVar(&cfg.PrewarmInterval.Duration, "prewarm.interval", cfg.PrewarmInterval.Duration, "how often to refresh -prewarm.cities (0 for half the cache TTL)")
+	fs.DurationVar(&cfg.NegativeCacheTTL.Duration, "cache.negative.ttl", cfg.NegativeCacheTTL.Duration, "how long to remember that a city wasn't found (0 disables)")
+	fs.IntVar(&cfg.Retries, "retries", cfg.Retries, "how many times to retry a provider after a transient failure")
+	fs.DurationVar(&cfg.RetryDelay.Duration, "retry.delay", cfg.RetryDelay.Duration, "delay before the first retry, doubled for each one after")
+	fs.Float64Var(&cfg.RetryBudget, "retry.budget", cfg.RetryBudget, "retries a second allowed across all providers, beyond which failures aren't retried (0 for no limit)")
+	fs.IntVar(&cfg.RetryBudgetBurst, "retry.budget.burst", cfg.RetryBudgetBurst, "retries allowed at once under -retry.budget")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker.threshold", cfg.BreakerThreshold, "consecutive failures before a provider is skipped (0 disables the circuit breaker)")
+	fs.DurationVar(&cfg.BreakerCooldown.Duration, "breaker.cooldown", cfg.BreakerCooldown.Duration, "how long to skip a provider once its circuit breaker opens")
+	fs.StringVar(&cfg.Geocoder, "geocoder", cfg.Geocoder, "geocoder used by forecast.io: google or nominatim")
+	fs.DurationVar(&cfg.GeocodeCacheTTL.Duration, "geocode.cache.ttl", cfg.GeocodeCacheTTL.Duration, "how long to cache geocoded locations (0 caches them forever)")
+	fs.StringVar(&cfg.ReadyCity, "ready.city", cfg.ReadyCity, "city to look up when checking readiness (empty skips the upstream check)")
+	fs.DurationVar(&cfg.ReadyTimeout.Duration, "ready.timeout", cfg.ReadyTimeout.Duration, "how long the readiness check waits on providers")
+	fs.Float64Var(&cfg.RateLimitRPS, "ratelimit.rps", cfg.RateLimitRPS, "requests a second allowed from each client IP (0 disables rate limiting)")
+	fs.IntVar(&cfg.RateLimitBurst, "ratelimit.burst", cfg.RateLimitBurst, "requests a client IP may make at once before being rate limited")
+	fs.StringVar(&cfg.TrustedProxies, "trusted.proxies", cfg.TrustedProxies, "comma-separated addresses or CIDR ranges of proxies whose X-Forwarded-For header is believed when rate limiting")
+	fs.StringVar(&cfg.UserAgent, "user.agent", cfg.UserAgent, "User-Agent header sent to upstream APIs")
+	fs.StringVar(&cfg.Proxy, "proxy", cfg.Proxy, "proxy URL for upstream requests (defaults to HTTP_PROXY and HTTPS_PROXY)")
+	fs.StringVar(&cfg.CAFile, "ca.file", cfg.CAFile, "PEM file of CA certificates to trust instead of the system's")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "max.idle.conns.per.host", cfg.MaxIdleConnsPerHost, "idle connections kept per upstream host (0 for Go's default)")
+	fs.BoolVar(&cfg.DisableKeepAlives, "disable.keepalives", cfg.DisableKeepAlives, "use a new connection for every upstream request")
+	return fs, configPath
+}
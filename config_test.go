@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfigFrom(nil, func(string) string { return "" }, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("got %+v, want defaults %+v", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(`{
+		"wundergroundApiKey": "file-wu",
+		"forecastioApiKey": "file-fio",
+		"listen": "127.0.0.1:9090",
+		"clientTimeout": "3s",
+		"providers": [{"type": "forecastio", "geocoder": "nominatim"}]
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"WUNDERGROUND_API_KEY": "env-wu",
+		"FORECASTIO_API_KEY":   "env-fio",
+	}
+	args := []string{"-config", path, "-forecastio.api.key", "flag-fio"}
+
+	cfg, err := loadConfigFrom(args, func(k string) string { return env[k] }, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ForecastIoAPIKey != "flag-fio" {
+		t.Errorf("flag should beat env: got %q", cfg.ForecastIoAPIKey)
+	}
+	if cfg.WundergroundAPIKey != "env-wu" {
+		t.Errorf("env should beat file: got %q", cfg.WundergroundAPIKey)
+	}
+	if cfg.Listen != "127.0.0.1:9090" {
+		t.Errorf("file should beat defaults: got %q", cfg.Listen)
+	}
+	if cfg.ClientTimeout.Duration != 3*time.Second {
+		t.Errorf("got client timeout %v, want 3s", cfg.ClientTimeout)
+	}
+	if cfg.Timeout.Duration != 10*time.Second {
+		t.Errorf("got timeout %v, want default 10s", cfg.Timeout)
+	}
+	if want := []ProviderConfig{{Type: "forecastio", Geocoder: "nominatim"}}; !reflect.DeepEqual(cfg.Providers, want) {
+		t.Errorf("got providers %+v, want %+v", cfg.Providers, want)
+	}
+}
+
+func TestLoadConfigBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"timeout": 10}`), 0600)
+
+	_, err = loadConfigFrom([]string{"-config", path}, func(string) string { return "" }, flag.ContinueOnError)
+	if err == nil {
+		t.Error("expected an error for a numeric duration")
+	}
+}
+
+func TestResolveListen(t *testing.T) {
+	tests := []struct {
+		addr, host, port string
+		want             string
+	}{
+		{":8080", "", "", ":8080"},
+		{":8080", "", "9000", ":9000"},
+		{":8080", "127.0.0.1", "", "127.0.0.1:8080"},
+		{":8080", "::1", "9000", "[::1]:9000"},
+		{"localhost:8080", "", "9000", "localhost:9000"},
+	}
+
+	for _, tt := range tests {
+		if got := resolveListen(tt.addr, tt.host, tt.port); got != tt.want {
+			t.Errorf("resolveListen(%q, %q, %q) = %q, want %q", tt.addr, tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigListen(t *testing.T) {
+	env := map[string]string{"PORT": "9000"}
+	getenv := func(k string) string { return env[k] }
+
+	cfg, err := loadConfigFrom(nil, getenv, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9000" {
+		t.Errorf("got %q, want :9000 from PORT", cfg.Listen)
+	}
+
+	cfg, err = loadConfigFrom([]string{"-listen", "127.0.0.1:8081"}, getenv, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "127.0.0.1:8081" {
+		t.Errorf("got %q, want the -listen flag to win", cfg.Listen)
+	}
+}
+
+func TestLoadConfigTLSNeedsCertAndKey(t *testing.T) {
+	getenv := func(string) string { return "" }
+
+	for _, args := range [][]string{{"-tls.cert", "cert.pem"}, {"-tls.key", "key.pem"}} {
+		if _, err := loadConfigFrom(args, getenv, flag.ContinueOnError); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+
+	cfg, err := loadConfigFrom([]string{"-tls.cert", "cert.pem", "-tls.key", "key.pem"}, getenv, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLSCert != "cert.pem" || cfg.TLSKey != "key.pem" {
+		t.Errorf("got cert %q and key %q", cfg.TLSCert, cfg.TLSKey)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	called := false
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), []string{"https://app.example.com"})
+
+	req := httptest.NewRequest("OPTIONS", "/weather/london", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if called {
+		t.Error("preflight request was passed on to the handler")
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("got %s %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}), []string{"https://app.example.com", "https://other.example.com"})
+
+	for origin, want := range map[string]string{
+		"https://app.example.com":  "https://app.example.com",
+		"https://evil.example.com": "",
+	} {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Body.String() != "ok" {
+			t.Errorf("%s: got body %q", origin, rec.Body)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", origin, got, want)
+		}
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), nil)
+
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	for header := range rec.Header() {
+		t.Errorf("unexpected header %s", header)
+	}
+}
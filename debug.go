@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// urlBuilder is implemented by providers that can say which URL they would
+// fetch to look up city, without fetching it.
+type urlBuilder interface {
+	buildURL(ctx context.Context, city string) string
+
+	// secret returns the API key that buildURL puts in the URL, if any.
+	secret() string
+}
+
+// redactURL replaces secret in u, however it was escaped, so that the URL
+// can be shown.
+func redactURL(u, secret string) string {
+	if secret == "" {
+		return u
+	}
+	for _, s := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+		u = strings.ReplaceAll(u, s, "REDACTED")
+	}
+	return u
+}
+
+// debugHandler serves /weather/debug/<city>, listing the URLs the providers
+// in mw would fetch for city, with their API keys redacted. It makes no
+// requests itself, so it only shows the first request of providers that
+// need several, with placeholders for what those would fill in.
+type debugHandler struct {
+	mw multiWeatherProvider
+}
+
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, ok := cityFromPath(r.URL.Path, "/weather/debug/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if city == "" {
+		http.Error(w, "missing city, expected /weather/debug/<city>", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if cc := r.URL.Query().Get("country"); cc != "" {
+		country, err := parseCountry(cc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = withCountry(ctx, country)
+	}
+	if r.URL.Query().Get("lat") != "" || r.URL.Query().Get("lng") != "" {
+		l, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lng"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = withCoordinates(ctx, l)
+	}
+
+	type providerURL struct {
+		Name string `json:"name"`
+		URL  string `json:"url,omitempty"`
+		Note string `json:"note,omitempty"`
+	}
+	resp := struct {
+		City      string        `json:"city"`
+		Providers []providerURL `json:"providers"`
+	}{City: city, Providers: []providerURL{}}
+
+	for _, p := range h.mw.providers {
+		pu := providerURL{Name: providerName(p)}
+		if b, ok := p.(urlBuilder); ok {
+			pu.URL = redactURL(b.buildURL(ctx, city), b.secret())
+		} else {
+			pu.Note = "doesn't make a request that can be shown"
+		}
+		resp.Providers = append(resp.Providers, pu)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(resp)
+}
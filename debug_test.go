@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandlerRedactsKeys(t *testing.T) {
+	// A key with characters that are escaped differently in paths and
+	// query strings.
+	const key = "s3cr+t key"
+
+	var urls []string
+	client := recordingClient(&urls, "{}")
+	gc := testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}
+	mw := multiWeatherProvider{providers: []weatherProvider{
+		openWeatherMap{client: client, apiKey: key, geoCode: gc},
+		weatherUnderground{client: client, apiKey: key},
+		NewForecastIo(key, gc, client),
+		accuWeather{apiKey: key, client: client},
+		NewMetOffice(key, gc, client),
+		testConstantWeatherProvider(290),
+	}}
+
+	rec := httptest.NewRecorder()
+	debugHandler{mw: mw}.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/debug/london?country=gb", nil))
+	if rec.Code != 200 {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(urls) != 0 {
+		t.Errorf("made requests to %v, want none", urls)
+	}
+
+	body := rec.Body.String()
+	if strings.Contains(body, "s3cr") {
+		t.Errorf("API key leaked: %s", body)
+	}
+
+	var resp struct {
+		City      string
+		Providers []struct{ Name, URL, Note string }
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+	if resp.City != "london" || len(resp.Providers) != 6 {
+		t.Fatalf("got %+v", resp)
+	}
+	for _, p := range resp.Providers[:5] {
+		if !strings.Contains(p.URL, "REDACTED") {
+			t.Errorf("%s: got URL %q, want the key redacted", p.Name, p.URL)
+		}
+		if !strings.Contains(p.URL, "london") && !strings.Contains(p.URL, "{") {
+			t.Errorf("%s: got URL %q, want the city or a placeholder in it", p.Name, p.URL)
+		}
+	}
+	if p := resp.Providers[5]; p.URL != "" || p.Note == "" {
+		t.Errorf("got %+v for a provider without URLs, want a note", p)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		u, secret, want string
+	}{
+		{"http://x/a?appid=k", "", "http://x/a?appid=k"},
+		{"http://x/api/a%2Fb/q", "a/b", "http://x/api/REDACTED/q"},
+		{"http://x/?key=a+b", "a b", "http://x/?key=REDACTED"},
+	}
+	for _, tt := range tests {
+		if got := redactURL(tt.u, tt.secret); got != tt.want {
+			t.Errorf("redactURL(%q, %q) = %q, want %q", tt.u, tt.secret, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseFormats are the formats a weather response can be encoded in, by
+// name, with their content types.
+var responseFormats = map[string]string{
+	"json": "application/json; charset=utf-8",
+	"xml":  "application/xml; charset=utf-8",
+	"text": "text/plain; charset=utf-8",
+}
+
+// mediaTypeFormats maps media types a client may accept to the format
+// served for them.
+var mediaTypeFormats = map[string]string{
+	"application/json": "json",
+	"application/xml":  "xml",
+	"text/xml":         "xml",
+	"text/plain":       "text",
+	"text/*":           "text",
+	"application/*":    "json",
+	"*/*":              "json",
+}
+
+// responseFormat picks the format to answer r in: the one named by its
+// ?format= parameter, or else the one its Accept header prefers, defaulting
+// to JSON. A wildcard that lets in JSON ranks it with the best type the
+// client asked for that can't be served, so that browsers, which rank HTML
+// first and XML above */*, still get JSON. It returns an error if r accepts
+// none of them.
+func responseFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := responseFormats[f]; !ok {
+			return "", fmt.Errorf("unknown format %q, expected json, xml or text", f)
+		}
+		return f, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return "json", nil
+	}
+
+	best := make(map[string]float64) // the highest q each format is accepted with
+	refused := make(map[string]bool) // formats named with q=0
+	var wildcardQ, unservedQ float64
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(v, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, _ := strings.Cut(strings.TrimSpace(p), "="); k == "q" {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		format, ok := mediaTypeFormats[mediaType]
+		wildcard := strings.HasSuffix(mediaType, "/*")
+		switch {
+		case !ok:
+			unservedQ = math.Max(unservedQ, q)
+			continue
+		case q <= 0:
+			if !wildcard {
+				refused[format] = true
+			}
+			continue
+		case wildcard && format == "json":
+			wildcardQ = math.Max(wildcardQ, q)
+		}
+		best[format] = math.Max(best[format], q)
+	}
+	if wildcardQ > 0 {
+		best["json"] = math.Max(best["json"], unservedQ)
+	}
+
+	// JSON, the default, wins ties.
+	choice, bestQ := "", 0.0
+	for _, f := range []string{"json", "xml", "text"} {
+		if q := best[f]; q > bestQ && !refused[f] {
+			choice, bestQ = f, q
+		}
+	}
+	if choice == "" {
+		return "", fmt.Errorf("can't answer with %s, only application/json, application/xml or text/plain", accept)
+	}
+	return choice, nil
+}
+
+// encodeResponse writes resp in the format r asks for, or a 406 if r
+// accepts none of them. The text format is just the temperature.
+func encodeResponse(w http.ResponseWriter, r *http.Request, resp WeatherResponse) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", responseFormats[format])
+	switch format {
+	case "xml":
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).EncodeElement(resp, xml.StartElement{Name: xml.Name{Local: "weather"}})
+	case "text":
+		fmt.Fprintln(w, resp.Temp)
+	default:
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseFormat(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		want          string // "" for an error
+	}{
+		{"", "", "json"},
+		{"", "application/json", "json"},
+		{"", "application/xml", "xml"},
+		{"", "text/xml", "xml"},
+		{"", "text/plain", "text"},
+		{"", "*/*", "json"},
+		{"", "text/html, text/plain;q=0.5, application/json;q=0.9", "json"},
+		{"", "application/json;q=0, text/*", "text"},
+		{"", "text/html", ""},
+		{"", "application/json;q=0", ""},
+		{"", "application/json;q=0, */*", ""},
+		{"", "application/xml, application/json;q=0.5", "xml"},
+		{"", "text/plain, */*;q=0.1", "text"},
+		{"", "application/xml, */*;q=0.1", "xml"},
+		// Firefox and Chrome rank XML above anything else we serve.
+		{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "json"},
+		{"", "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7", "json"},
+		{"?format=xml", "application/json", "xml"},
+		{"?format=text", "", "text"},
+		{"?format=yaml", "", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/weather/london"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		got, err := responseFormat(r)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q, Accept %q: got %q, want an error", tt.query, tt.accept, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q, Accept %q: got %q, %v, want %q", tt.query, tt.accept, got, err, tt.want)
+		}
+	}
+}
+
+func TestWeatherHandlerFormats(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{openWeatherMapStub{}}},
+		timeout: time.Second,
+	}
+	get := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/weather/london?units=celsius", nil)
+		r.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("application/json")
+	var resp WeatherResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Temp != 16.95 {
+		t.Errorf("JSON: got %s, %v", rec.Body, err)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("JSON: got Content-Type %q", got)
+	}
+
+	rec = get("application/xml")
+	var x struct {
+		XMLName xml.Name `xml:"weather"`
+		City    string   `xml:"city"`
+		Temp    float64  `xml:"temp"`
+		Unit    string   `xml:"unit"`
+		Sources []string `xml:"sources>source"`
+	}
+	if err := xml.Unmarshal(rec.Body.Bytes(), &x); err != nil {
+		t.Fatalf("XML: %v: %s", err, rec.Body)
+	}
+	if x.City != "london" || x.Temp != 16.95 || x.Unit != unitCelsius || len(x.Sources) != 1 || x.Sources[0] != "openWeatherMap" {
+		t.Errorf("XML: got %+v", x)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/xml; charset=utf-8" {
+		t.Errorf("XML: got Content-Type %q", got)
+	}
+
+	rec = get("text/plain")
+	if rec.Body.String() != "16.95\n" {
+		t.Errorf("text: got %q, want 16.95", rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("text: got Content-Type %q", got)
+	}
+
+	if rec = get("image/png"); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("got status %d for image/png, want %d", rec.Code, http.StatusNotAcceptable)
+	}
+}
+
+func TestProviderReadingMarshalXML(t *testing.T) {
+	b, err := xml.Marshal(WeatherResponse{Providers: []ProviderReading{
+		{Name: "openWeatherMap", Conditions: Conditions{TempKelvin: 290}},
+		{Name: "forecastIo", Err: errors.New("boom")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<provider name="openWeatherMap"><tempKelvin>290</tempKelvin></provider>`,
+		`<provider name="forecastIo"><error>boom</error></provider>`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("got %s, want it to contain %s", b, want)
+		}
+	}
+}
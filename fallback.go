@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// fallbackWeatherProvider asks each of its providers in turn, returning the
+// first answer it gets. Unlike multiWeatherProvider it never averages, so
+// providers should be listed in order of preference.
+type fallbackWeatherProvider []weatherProvider
+
+func (f fallbackWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := f.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (f fallbackWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	var failures []error
+	for _, p := range f {
+		c, err := conditionsOf(ctx, p, city)
+		if err == nil {
+			return c, nil
+		}
+		failures = append(failures, &ProviderError{Provider: providerName(p), Err: err})
+
+		// No point trying the rest if the caller has gone away.
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(failures) == 0 {
+		return Conditions{}, errors.New("no weather providers configured")
+	}
+	return Conditions{}, fmt.Errorf("all weather providers failed: %w", errors.Join(failures...))
+}
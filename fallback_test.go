@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFallbackWeatherProvider(t *testing.T) {
+	second := &testCountingWeatherProvider{}
+	third := &testCountingWeatherProvider{}
+	f := fallbackWeatherProvider{
+		testFailingWeatherProvider{errors.New("openweathermap: unexpected status 401")},
+		second,
+		third,
+	}
+
+	k, err := f.temperature(context.Background(), "london")
+	if err != nil || k != 290 {
+		t.Fatalf("got %v, %v; want 290 from the second provider", k, err)
+	}
+	if second.calls != 1 || third.calls != 0 {
+		t.Errorf("got %d and %d calls, want 1 and 0", second.calls, third.calls)
+	}
+}
+
+func TestFallbackWeatherProviderAllFail(t *testing.T) {
+	f := fallbackWeatherProvider{
+		testFailingWeatherProvider{errors.New("openweathermap: unexpected status 401")},
+		testFailingWeatherProvider{errors.New("wunderground: unexpected status 500")},
+	}
+
+	_, err := f.temperature(context.Background(), "london")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, msg := range []string{"status 401", "status 500"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q does not mention %q", err, msg)
+		}
+	}
+	var pe *ProviderError
+	if !errors.As(err, &pe) || pe.Provider != "main.testFailingWeatherProvider" {
+		t.Errorf("got %v, want a ProviderError naming the provider", err)
+	}
+}
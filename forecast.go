@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DailyForecast is the expected temperature range for one day.
+type DailyForecast struct {
+	Date      string  `json:"date"` // YYYY-MM-DD, local to the city
+	MinKelvin float64 `json:"minK"`
+	MaxKelvin float64 `json:"maxK"`
+}
+
+// forecastProvider is implemented by providers that can look ahead.
+type forecastProvider interface {
+	forecast(ctx context.Context, city string, days int) ([]DailyForecast, error)
+}
+
+// forecast averages the daily forecasts of the providers that offer them,
+// aligning them by date, and returns at most days entries in date order.
+// Like temperatures it only fails if every forecasting provider does.
+func (w multiWeatherProvider) forecast(ctx context.Context, city string, days int) ([]DailyForecast, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		days []DailyForecast
+		err  error
+	}
+	results := make(chan result, len(w.providers))
+
+	n := 0
+	for _, provider := range w.providers {
+		fp, ok := provider.(forecastProvider)
+		if !ok || w.switches.disabled(providerName(provider)) {
+			continue
+		}
+		n++
+		go func(fp forecastProvider) {
+			f, err := fp.forecast(ctx, city, days)
+			results <- result{f, err}
+		}(fp)
+	}
+	if n == 0 {
+		return nil, errors.New("no enabled provider offers forecasts")
+	}
+
+	type sums struct {
+		min, max float64
+		n        int
+	}
+	byDate := make(map[string]*sums)
+	var failures []error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			if w.strict {
+				return nil, r.err
+			}
+			failures = append(failures, r.err)
+			continue
+		}
+		for _, d := range r.days {
+			s, ok := byDate[d.Date]
+			if !ok {
+				s = &sums{}
+				byDate[d.Date] = s
+			}
+			s.min += d.MinKelvin
+			s.max += d.MaxKelvin
+			s.n++
+		}
+	}
+	if len(failures) == n {
+		return nil, fmt.Errorf("all forecast providers failed: %w", errors.Join(failures...))
+	}
+
+	forecasts := make([]DailyForecast, 0, len(byDate))
+	for date, s := range byDate {
+		forecasts = append(forecasts, DailyForecast{
+			Date:      date,
+			MinKelvin: s.min / float64(s.n),
+			MaxKelvin: s.max / float64(s.n),
+		})
+	}
+	sort.Slice(forecasts, func(i, j int) bool { return forecasts[i].Date < forecasts[j].Date })
+	if len(forecasts) > days {
+		forecasts = forecasts[:days]
+	}
+	return forecasts, nil
+}
+
+func (w openWeatherMap) forecast(ctx context.Context, city string, days int) ([]DailyForecast, error) {
+	u := orDefault(w.baseURL, defaultOpenWeatherMapURL) + "/data/2.5/forecast/daily?" + openWeatherMapQuery(city, countryFrom(ctx)) + "&cnt=" + strconv.Itoa(days)
+	if w.apiKey != "" {
+		u += "&appid=" + url.QueryEscape(w.apiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("openweathermap", resp); err != nil {
+		return nil, err
+	}
+
+	var d struct {
+		City struct {
+			Timezone int64 `json:"timezone"` // offset from UTC in seconds
+		} `json:"city"`
+		List []struct {
+			Dt   int64 `json:"dt"`
+			Temp struct {
+				Min float64 `json:"min"`
+				Max float64 `json:"max"`
+			} `json:"temp"`
+		} `json:"list"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, malformedResponse("openweathermap", err)
+	}
+
+	var forecasts []DailyForecast
+	for _, day := range d.List {
+		forecasts = append(forecasts, DailyForecast{
+			Date:      localDate(day.Dt, d.City.Timezone),
+			MinKelvin: day.Temp.Min,
+			MaxKelvin: day.Temp.Max,
+		})
+	}
+	return forecasts, nil
+}
+
+func (f forecastIo) forecast(ctx context.Context, city string, days int) ([]DailyForecast, error) {
+	l, err := locate(ctx, "forecastio", f.geoCode, city)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", f.buildURL(withCoordinates(ctx, l), city), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("forecastio", resp); err != nil {
+		return nil, err
+	}
+
+	var d struct {
+		Offset float64 `json:"offset"` // hours from UTC
+		Daily  struct {
+			Data []struct {
+				Time           int64   `json:"time"`
+				TemperatureMin float64 `json:"temperatureMin"`
+				TemperatureMax float64 `json:"temperatureMax"`
+			} `json:"data"`
+		} `json:"daily"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, malformedResponse("forecastio", err)
+	}
+
+	var forecasts []DailyForecast
+	for _, day := range d.Daily.Data {
+		forecasts = append(forecasts, DailyForecast{
+			Date:      localDate(day.Time, int64(d.Offset*3600)),
+			MinKelvin: FromFahrenheit(day.TemperatureMin).Kelvin(),
+			MaxKelvin: FromFahrenheit(day.TemperatureMax).Kelvin(),
+		})
+	}
+	if len(forecasts) > days {
+		forecasts = forecasts[:days]
+	}
+	return forecasts, nil
+}
+
+// localDate returns the date at unix time t in a zone offset seconds from UTC.
+func localDate(t, offset int64) string {
+	return time.Unix(t+offset, 0).UTC().Format("2006-01-02")
+}
+
+// maxForecastDays is the furthest ahead any provider will look.
+const maxForecastDays = 16
+
+// forecastHandler serves /forecast/<city>?days=N.
+type forecastHandler struct {
+	mw      multiWeatherProvider
+	timeout time.Duration
+}
+
+func (h forecastHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, ok := cityFromPath(r.URL.Path, "/forecast/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if city == "" {
+		http.Error(w, "missing city, expected /forecast/<city>", http.StatusBadRequest)
+		return
+	}
+
+	days := 5
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 1 || days > maxForecastDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxForecastDays), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	forecasts, err := h.mw.forecast(ctx, city, days)
+	if err != nil {
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(forecasts)
+}
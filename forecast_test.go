@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testForecastProvider returns a fixed forecast.
+type testForecastProvider struct {
+	days []DailyForecast
+	err  error
+}
+
+func (t testForecastProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return 290, nil
+}
+
+func (t testForecastProvider) forecast(ctx context.Context, city string, days int) ([]DailyForecast, error) {
+	return t.days, t.err
+}
+
+func TestMultiForecastAlignsByDate(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testForecastProvider{days: []DailyForecast{
+				{"2026-10-15", 280, 290},
+				{"2026-10-16", 282, 292},
+			}},
+			testForecastProvider{days: []DailyForecast{
+				{"2026-10-16", 284, 294},
+				{"2026-10-17", 285, 295},
+			}},
+			testConstantWeatherProvider(300),
+			testForecastProvider{err: errors.New("down")},
+		},
+	}
+
+	got, err := w.forecast(context.Background(), "london", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []DailyForecast{
+		{"2026-10-15", 280, 290},
+		{"2026-10-16", 283, 293},
+		{"2026-10-17", 285, 295},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("day %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if got, _ := w.forecast(context.Background(), "london", 2); len(got) != 2 {
+		t.Errorf("got %d days, want 2", len(got))
+	}
+}
+
+func TestMultiForecastWithoutForecastProviders(t *testing.T) {
+	w := multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(300)}}
+	if _, err := w.forecast(context.Background(), "london", 5); err == nil {
+		t.Error("expected an error when no provider offers forecasts")
+	}
+}
+
+// testDownForecastProvider fails, under a name of its own.
+type testDownForecastProvider struct {
+	testForecastProvider
+}
+
+func TestMultiForecastSkipsDisabledProviders(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testForecastProvider{days: []DailyForecast{{"2026-10-15", 280, 290}}},
+			testDownForecastProvider{testForecastProvider{err: errors.New("down")}},
+		},
+		strict:   true,
+		switches: &providerSwitches{off: map[string]bool{"main.testDownForecastProvider": true}},
+	}
+
+	got, err := w.forecast(context.Background(), "london", 5)
+	if err != nil {
+		t.Fatalf("disabled provider was asked: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("got %v, want one day", got)
+	}
+}
+
+func TestOpenWeatherMapForecast(t *testing.T) {
+	var urls []string
+	p := openWeatherMap{apiKey: "key", client: recordingClient(&urls, `{
+		"city": {"name": "London", "timezone": 3600},
+		"list": [
+			{"dt": 1792062000, "temp": {"day": 288, "min": 283.5, "max": 290.2}},
+			{"dt": 1792148400, "temp": {"day": 287, "min": 282.1, "max": 289.9}}
+		]
+	}`)}
+
+	got, err := p.forecast(context.Background(), "london", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[0] != (DailyForecast{"2026-10-15", 283.5, 290.2}) || got[1].Date != "2026-10-16" {
+		t.Errorf("got %+v", got)
+	}
+	if want := "http://api.openweathermap.org/data/2.5/forecast/daily?q=london&cnt=2&appid=key"; urls[0] != want {
+		t.Errorf("got URL %s, want %s", urls[0], want)
+	}
+}
+
+func TestForecastIoForecast(t *testing.T) {
+	var urls []string
+	f := forecastIo{
+		client:  recordingClient(&urls, `{"offset": -5, "daily": {"data": [{"time": 1792040400, "temperatureMin": 32, "temperatureMax": 50}]}}`),
+		geoCode: testGeoCode{l: location{Lat: 40.7, Lng: -74}},
+	}
+
+	got, err := f.forecast(context.Background(), "new york", 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].Date != "2026-10-15" || got[0].MinKelvin != 273.15 || math.Abs(got[0].MaxKelvin-283.15) > 1e-9 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestForecastIoForecastRejectsZeroLocation(t *testing.T) {
+	var urls []string
+	f := forecastIo{
+		client:  recordingClient(&urls, `{"daily": {"data": []}}`),
+		geoCode: testGeoCode{l: location{}},
+	}
+
+	if _, err := f.forecast(context.Background(), "xyzzy", 5); !errors.Is(err, errCityNotFound) {
+		t.Errorf("got %v, want %v", err, errCityNotFound)
+	}
+	if len(urls) != 0 {
+		t.Errorf("queried %v for a zero location", urls)
+	}
+}
+
+func TestForecastHandler(t *testing.T) {
+	h := forecastHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			testForecastProvider{days: []DailyForecast{{"2026-10-15", 280, 290}}},
+		}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/forecast/london?days=3", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var got []DailyForecast
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Date != "2026-10-15" {
+		t.Errorf("got %+v", got)
+	}
+
+	for _, path := range []string{"/forecast/", "/forecast/london?days=0", "/forecast/london?days=abc"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", path, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/forecast/london/extra", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a deeper path, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcServer serves the Weather service in weather.proto. It implements just
+// enough of gRPC over unencrypted HTTP/2 for unary calls, and encodes the two
+// messages by hand, so it needs nothing beyond the standard library.
+type grpcServer struct {
+	mw      multiWeatherProvider
+	timeout time.Duration
+
+	// keys, if set, are the API keys accepted in the x-api-key or
+	// authorization metadata, as withAPIKeys accepts them over HTTP.
+	keys []string
+
+	// limiter, if set, limits the rate of calls from each client.
+	limiter *rateLimiter
+}
+
+const getTemperatureMethod = "/weather.Weather/GetTemperature"
+
+// gRPC status codes, from google.golang.org/grpc/codes.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcDeadlineExceeded  = 4
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+// newGRPCServer returns an HTTP server for s that accepts HTTP/2 without TLS,
+// as gRPC clients expect of a plaintext endpoint.
+func newGRPCServer(addr string, s grpcServer) *http.Server {
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+	return &http.Server{Addr: addr, Handler: s, Protocols: &p}
+}
+
+func (s grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	if len(s.keys) > 0 && !validAPIKey(grpcAPIKey(r), s.keys) {
+		writeGRPCStatus(w, grpcUnauthenticated, "missing or invalid API key")
+		return
+	}
+	if s.limiter != nil {
+		if ok, _ := s.limiter.allow(clientIP(r, s.limiter.trusted)); !ok {
+			writeGRPCStatus(w, grpcResourceExhausted, "rate limit exceeded")
+			return
+		}
+	}
+
+	if r.URL.Path != getTemperatureMethod {
+		writeGRPCStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	var req temperatureRequest
+	if err := req.unmarshal(msg); err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	resp, code, err := s.getTemperature(r.Context(), req)
+	if err != nil {
+		writeGRPCStatus(w, code, err.Error())
+		return
+	}
+
+	writeGRPCMessage(w, resp.marshal())
+	writeGRPCStatus(w, grpcOK, "")
+}
+
+// grpcAPIKey returns the API key sent with r, in x-api-key metadata or as
+// a bearer token.
+func grpcAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return auth[len("Bearer "):]
+	}
+	return ""
+}
+
+// getTemperature does the work of GetTemperature, returning the gRPC status
+// code to fail with along with any error.
+func (s grpcServer) getTemperature(ctx context.Context, req temperatureRequest) (temperatureResponse, int, error) {
+	begin := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	city := normalizeCity(req.city)
+	if city == "" {
+		return temperatureResponse{}, grpcInvalidArgument, errors.New("missing city")
+	}
+	unit := req.unit
+	if unit == "" {
+		unit = unitKelvin
+	}
+	if _, err := convertFromKelvin(0, unit); err != nil {
+		return temperatureResponse{}, grpcInvalidArgument, err
+	}
+
+	k, err := s.mw.temperature(ctx, city)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return temperatureResponse{}, grpcDeadlineExceeded, err
+		}
+		switch statusForError(err) {
+		case http.StatusGatewayTimeout:
+			return temperatureResponse{}, grpcDeadlineExceeded, err
+		case http.StatusNotFound:
+			return temperatureResponse{}, grpcNotFound, err
+		case http.StatusTooManyRequests:
+			return temperatureResponse{}, grpcResourceExhausted, err
+		}
+		return temperatureResponse{}, grpcUnavailable, err
+	}
+	temp, _ := k.In(unit)
+
+	return temperatureResponse{
+		temp:   temp,
+		unit:   unit,
+		tookMs: time.Since(begin).Milliseconds(),
+	}, grpcOK, nil
+}
+
+// readGRPCMessage reads a single length-prefixed message from r.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > 1<<20 {
+		return nil, fmt.Errorf("message of %d bytes is too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("reading message: %v", err)
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes msg to w as a single uncompressed message.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// writeGRPCStatus ends the call with the given status, sent as trailers.
+func writeGRPCStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+type temperatureRequest struct {
+	city, unit string
+}
+
+func (m *temperatureRequest) unmarshal(b []byte) error {
+	return unmarshalProto(b, func(field int, wireType int, v []byte, _ uint64) {
+		if wireType != protoBytes {
+			return
+		}
+		switch field {
+		case 1:
+			m.city = string(v)
+		case 2:
+			m.unit = string(v)
+		}
+	})
+}
+
+type temperatureResponse struct {
+	temp   float64
+	unit   string
+	tookMs int64
+}
+
+func (m temperatureResponse) marshal() []byte {
+	var b []byte
+	if m.temp != 0 {
+		b = binary.AppendUvarint(b, 1<<3|protoFixed64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(m.temp))
+	}
+	if m.unit != "" {
+		b = binary.AppendUvarint(b, 2<<3|protoBytes)
+		b = binary.AppendUvarint(b, uint64(len(m.unit)))
+		b = append(b, m.unit...)
+	}
+	if m.tookMs != 0 {
+		b = binary.AppendUvarint(b, 3<<3|protoVarint)
+		b = binary.AppendUvarint(b, uint64(m.tookMs))
+	}
+	return b
+}
+
+// Protocol buffer wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// unmarshalProto calls fn with each field in the protocol buffer message b.
+// Length-delimited fields are passed in v, and the rest in n.
+func unmarshalProto(b []byte, fn func(field, wireType int, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		if k <= 0 {
+			return errors.New("malformed message")
+		}
+		b = b[k:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var v []byte
+		var n uint64
+		switch wireType {
+		case protoVarint:
+			n, k = binary.Uvarint(b)
+			if k <= 0 {
+				return errors.New("malformed message")
+			}
+			b = b[k:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errors.New("malformed message")
+			}
+			n, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errors.New("malformed message")
+			}
+			n, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			l, k := binary.Uvarint(b)
+			if k <= 0 || uint64(len(b)-k) < l {
+				return errors.New("malformed message")
+			}
+			v, b = b[k:k+int(l)], b[k+int(l):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		fn(field, wireType, v, n)
+	}
+	return nil
+}
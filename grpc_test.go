@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// callGRPC makes a unary call to srv over unencrypted HTTP/2 and returns the
+// response message and the grpc-status trailer.
+func callGRPC(t *testing.T, srv *httptest.Server, method string, msg []byte) ([]byte, string) {
+	t.Helper()
+	return callGRPCWithMetadata(t, srv, method, msg, nil)
+}
+
+// callGRPCWithMetadata is callGRPC, sending md along with the call.
+func callGRPCWithMetadata(t *testing.T, srv *httptest.Server, method string, msg []byte, md http.Header) ([]byte, string) {
+	t.Helper()
+
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+	c := &http.Client{Transport: &http.Transport{Protocols: &p}}
+
+	var body bytes.Buffer
+	writeGRPCMessage(&body, msg)
+	req, _ := http.NewRequest("POST", srv.URL+method, &body)
+	for k, v := range md {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s, want HTTP/2", resp.Proto)
+	}
+	if len(b) == 0 {
+		return nil, resp.Trailer.Get("Grpc-Status")
+	}
+	out, err := readGRPCMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out, resp.Trailer.Get("Grpc-Status")
+}
+
+func newTestGRPCServer(s grpcServer) *httptest.Server {
+	srv := httptest.NewUnstartedServer(s)
+	srv.Config = newGRPCServer("", s)
+	srv.Start()
+	return srv
+}
+
+// marshalTemperatureRequest encodes req as protoc-generated code would.
+func marshalTemperatureRequest(city, unit string) []byte {
+	var b []byte
+	b = append(b, 1<<3|protoBytes, byte(len(city)))
+	b = append(b, city...)
+	b = append(b, 2<<3|protoBytes, byte(len(unit)))
+	return append(b, unit...)
+}
+
+func TestGRPCGetTemperature(t *testing.T) {
+	srv := newTestGRPCServer(grpcServer{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testFastWeatherProvider{}}},
+		timeout: time.Second,
+	})
+	defer srv.Close()
+
+	msg, status := callGRPC(t, srv, getTemperatureMethod, marshalTemperatureRequest("london", "celsius"))
+	if status != "0" {
+		t.Fatalf("got grpc-status %q, want 0", status)
+	}
+
+	var temp float64
+	var unit string
+	err := unmarshalProto(msg, func(field, wireType int, v []byte, n uint64) {
+		switch field {
+		case 1:
+			temp = math.Float64frombits(n)
+		case 2:
+			unit = string(v)
+		}
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(temp-16.85) > 1e-9 || unit != "celsius" {
+		t.Errorf("got %v %s, want 16.85 celsius", temp, unit)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	srv := newTestGRPCServer(grpcServer{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testFastWeatherProvider{}}},
+		timeout: time.Second,
+	})
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method string
+		msg    []byte
+		want   string
+	}{
+		{getTemperatureMethod, marshalTemperatureRequest("", "kelvin"), "3"},
+		{getTemperatureMethod, marshalTemperatureRequest("london", "rankine"), "3"},
+		{"/weather.Weather/GetForecast", nil, "12"},
+	} {
+		if _, status := callGRPC(t, srv, tt.method, tt.msg); status != tt.want {
+			t.Errorf("%s: got grpc-status %q, want %s", tt.method, status, tt.want)
+		}
+	}
+}
+
+func TestGRPCAPIKeys(t *testing.T) {
+	srv := newTestGRPCServer(grpcServer{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testFastWeatherProvider{}}},
+		timeout: time.Second,
+		keys:    []string{"k1", "k2"},
+	})
+	defer srv.Close()
+
+	msg := marshalTemperatureRequest("london", "kelvin")
+	for _, tt := range []struct {
+		md   http.Header
+		want string
+	}{
+		{nil, "16"},
+		{http.Header{"X-Api-Key": {"nope"}}, "16"},
+		{http.Header{"Authorization": {"k1"}}, "16"},
+		{http.Header{"X-Api-Key": {"k1"}}, "0"},
+		{http.Header{"Authorization": {"Bearer k2"}}, "0"},
+	} {
+		if _, status := callGRPCWithMetadata(t, srv, getTemperatureMethod, msg, tt.md); status != tt.want {
+			t.Errorf("%v: got grpc-status %q, want %s", tt.md, status, tt.want)
+		}
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	srv := newTestGRPCServer(grpcServer{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testFastWeatherProvider{}}},
+		timeout: time.Second,
+		limiter: newRateLimiter(1, 1),
+	})
+	defer srv.Close()
+
+	msg := marshalTemperatureRequest("london", "kelvin")
+	if _, status := callGRPC(t, srv, getTemperatureMethod, msg); status != "0" {
+		t.Fatalf("got grpc-status %q, want 0", status)
+	}
+	if _, status := callGRPC(t, srv, getTemperatureMethod, msg); status != "8" {
+		t.Errorf("got grpc-status %q over the rate, want 8", status)
+	}
+}
+
+func TestTemperatureResponseMarshal(t *testing.T) {
+	b := temperatureResponse{temp: 1.5, unit: "kelvin", tookMs: 300}.marshal()
+
+	want := []byte{1<<3 | protoFixed64}
+	want = binary.LittleEndian.AppendUint64(want, math.Float64bits(1.5))
+	want = append(want, 2<<3|protoBytes, 6, 'k', 'e', 'l', 'v', 'i', 'n')
+	want = append(want, 3<<3|protoVarint, 0xac, 0x02)
+	if !bytes.Equal(b, want) {
+		t.Errorf("got % x, want % x", b, want)
+	}
+}
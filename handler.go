@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WeatherResponse is the body of a successful /weather/<city> response.
+// Temperatures are in Unit, and the optional fields are left out when no
+// provider reported them or they weren't asked for.
+type WeatherResponse struct {
+	City string  `json:"city" xml:"city"`
+	Temp float64 `json:"temp" xml:"temp"`
+	Unit string  `json:"unit" xml:"unit"`
+	Took string  `json:"took" xml:"took"`
+
+	// Sources names the providers whose readings went into Temp.
+	Sources []string `json:"sources" xml:"sources>source"`
+
+	// Display is Temp formatted for the ?locale=, such as "72°F".
+	Display string `json:"display,omitempty" xml:"display,omitempty"`
+
+	FeelsLike     *float64 `json:"feels_like,omitempty" xml:"feels_like"`
+	Humidity      *float64 `json:"humidity,omitempty" xml:"humidity"`           // percent
+	WindSpeed     *float64 `json:"windSpeed,omitempty" xml:"windSpeed"`         // m/s
+	WindDirection *float64 `json:"windDirection,omitempty" xml:"windDirection"` // degrees
+	Pressure      *float64 `json:"pressure,omitempty" xml:"pressure"`           // hPa
+
+	// Set with ?uv=true or ?detail=true.
+	UVIndex *float64 `json:"uvIndex,omitempty" xml:"uvIndex"`
+
+	// Set with ?stats=true.
+	Min    *float64 `json:"min,omitempty" xml:"min"`
+	Max    *float64 `json:"max,omitempty" xml:"max"`
+	StdDev *float64 `json:"stddev,omitempty" xml:"stddev"`
+	Count  *int     `json:"count,omitempty" xml:"count"`
+
+	// Set with ?detail=true.
+	Providers []ProviderReading `json:"providers,omitempty" xml:"providers>provider"`
+	Location  *location         `json:"location,omitempty" xml:"location"`
+
+	// Chosen names the provider whose reading is Temp, for aggregations
+	// that pick one rather than combine them. Set with ?detail=true.
+	Chosen string `json:"chosen,omitempty" xml:"chosen,omitempty"`
+
+	kelvin float64 // Temp before conversion and rounding
+}
+
+// roundedPtr returns a pointer to v rounded to places decimal places.
+func roundedPtr(v float64, places int) *float64 {
+	r := roundTo(v, places)
+	return &r
+}
+
+// weatherHandler serves /weather/<city> and /weather?city=<city>, answering
+// with the aggregate temperature from mw.
+type weatherHandler struct {
+	mw      multiWeatherProvider
+	timeout time.Duration
+
+	// maxTimeout caps the timeout clients can ask for with X-Timeout-Ms.
+	// Without it, they can only ask for less than timeout.
+	maxTimeout time.Duration
+
+	// reverse, if set, names the city for coordinate-only queries so that
+	// providers that need a city name can take part.
+	reverse reverseGeoCode
+
+	clock clock // times requests; defaults to the system clock
+}
+
+// requestTimeout returns how long to wait on providers for r: the number of
+// milliseconds in its X-Timeout-Ms header if it has one, or def. Clients
+// can't ask for longer than max, or def if there is no max.
+func requestTimeout(r *http.Request, def, max time.Duration) (time.Duration, error) {
+	v := r.Header.Get("X-Timeout-Ms")
+	if v == "" {
+		return def, nil
+	}
+	if max <= 0 {
+		max = def
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("X-Timeout-Ms must be a positive number of milliseconds, got %q", v)
+	}
+	if ms > max.Milliseconds() {
+		return 0, fmt.Errorf("X-Timeout-Ms must be at most %d", max.Milliseconds())
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// cityFromPath returns the city named by a path like prefix+"<city>",
+// which may be empty. It reports false for paths with anything after the
+// city, other than a trailing slash.
+func cityFromPath(path, prefix string) (string, bool) {
+	if path+"/" == prefix {
+		return "", true
+	}
+	rest := strings.TrimRight(strings.TrimPrefix(path, prefix), "/")
+	if strings.Contains(rest, "/") {
+		return "", false
+	}
+	return normalizeCity(rest), true
+}
+
+func (h weatherHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := nowOn(h.clock)
+	city, ok := cityFromPath(r.URL.Path, "/weather/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// The city can also be given as ?city=, or ?q=, which take precedence,
+	// for names that don't sit well in a path.
+	if c := orDefault(r.URL.Query().Get("city"), r.URL.Query().Get("q")); c != "" {
+		city = normalizeCity(c)
+	}
+
+	timeout, err := requestTimeout(r, h.timeout, h.maxTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if cc := r.URL.Query().Get("country"); cc != "" {
+		country, err := parseCountry(cc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = withCountry(ctx, country)
+	}
+
+	// Explicit coordinates are used by the providers that can take them,
+	// instead of geocoding the city. Providers that only know about city
+	// names still use the city, looked up from the coordinates if it wasn't
+	// given, or are skipped if there isn't one.
+	if r.URL.Query().Get("lat") != "" || r.URL.Query().Get("lng") != "" {
+		l, err := parseLocation(r.URL.Query().Get("lat"), r.URL.Query().Get("lng"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx = withCoordinates(ctx, l)
+
+		if city == "" && h.reverse != nil {
+			if name, err := h.reverse.findCityName(ctx, l); err != nil {
+				logf(ctx, "reverse geocoding %v,%v: %v", l.Lat, l.Lng, err)
+			} else {
+				city = normalizeCity(name)
+			}
+		}
+	} else if city == "" {
+		http.Error(w, "missing city, expected /weather/<city>, ?city= or ?lat=&lng=", http.StatusBadRequest)
+		return
+	}
+
+	// A locale picks the unit, unless one is asked for, and adds a
+	// formatted temperature to the response.
+	locale := r.URL.Query().Get("locale")
+	unit := r.URL.Query().Get("units")
+	if unit == "" && locale != "" {
+		unit = localeUnit(locale)
+	}
+	if unit == "" {
+		unit = unitKelvin
+	}
+	if _, err := convertFromKelvin(0, unit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	precision := defaultPrecision
+	if v := r.URL.Query().Get("precision"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 || p > maxPrecision {
+			http.Error(w, fmt.Sprintf("precision must be a number of decimal places from 0 to %d", maxPrecision), http.StatusBadRequest)
+			return
+		}
+		precision = p
+	}
+
+	// Check the response can be encoded before asking any providers.
+	if _, err := responseFormat(r); err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	resp, readings, err := h.mw.lookup(ctx, city, unit, precision)
+	if err != nil {
+		if code := statusForError(err); code == http.StatusGatewayTimeout {
+			writeTimeout(w, err, readings)
+		} else {
+			http.Error(w, err.Error(), code)
+		}
+		return
+	}
+	resp.Took = since(h.clock, begin).String()
+	if locale != "" {
+		resp.Display = formatTemperature(resp.kelvin, locale)
+	}
+
+	// Let clients tell when the answer rests on only some of the providers.
+	used, asked := len(resp.Sources), providersAsked(readings)
+	w.Header().Set("X-Providers-Used", strconv.Itoa(used)+"/"+strconv.Itoa(asked))
+	w.Header().Set("X-Degraded", strconv.FormatBool(used < asked))
+
+	if stats, _ := strconv.ParseBool(r.URL.Query().Get("stats")); stats {
+		var temps []float64
+		for _, k := range reported(readings, func(c Conditions) *float64 { return &c.TempKelvin }) {
+			t, _ := convertFromKelvin(k, unit)
+			temps = append(temps, t)
+		}
+		s := spreadOf(temps)
+		resp.Min, resp.Max, resp.StdDev = roundedPtr(s.min, precision), roundedPtr(s.max, precision), roundedPtr(s.stddev, precision)
+		resp.Count = &s.count
+	}
+	detail, _ := strconv.ParseBool(r.URL.Query().Get("detail"))
+	if uv, _ := strconv.ParseBool(r.URL.Query().Get("uv")); uv || detail {
+		if uvi := averageUVIndex(readings); uvi != nil {
+			resp.UVIndex = roundedPtr(*uvi, precision)
+		}
+	}
+	if detail {
+		resp.Providers = readings
+		if _, ok := h.mw.aggregator.(ClosestToMedianAggregator); ok {
+			resp.Chosen = chosenProvider(readings, resp.Sources, resp.kelvin)
+		}
+		for _, reading := range readings {
+			if reading.Location != nil {
+				resp.Location = reading.Location
+				break
+			}
+		}
+	}
+
+	encodeResponse(w, r, resp)
+}
+
+// lookup asks w for the weather in city and puts together the response to
+// it, with temperatures in unit rounded to precision decimal places. It
+// returns the readings the response was made from too.
+func (w multiWeatherProvider) lookup(ctx context.Context, city, unit string, precision int) (WeatherResponse, []ProviderReading, error) {
+	readings, err := w.temperatures(ctx, city)
+	if err != nil {
+		return WeatherResponse{}, readings, err
+	}
+	kelvin, sources := w.combine(readings)
+	temp, err := convertFromKelvin(kelvin, unit)
+	if err != nil {
+		return WeatherResponse{}, readings, err
+	}
+
+	resp := WeatherResponse{
+		City:    city,
+		Temp:    roundTo(temp, precision),
+		Unit:    unit,
+		Sources: sources,
+		kelvin:  kelvin,
+	}
+	if fl := averageFeelsLike(readings); fl != nil {
+		t, _ := convertFromKelvin(*fl, unit)
+		resp.FeelsLike = roundedPtr(t, precision)
+	}
+	if h := averageHumidity(readings); h != nil {
+		resp.Humidity = roundedPtr(*h, precision)
+	}
+	if ws := averageWindSpeed(readings); ws != nil {
+		resp.WindSpeed = roundedPtr(*ws, precision)
+	}
+	if wd := averageWindDirection(readings); wd != nil {
+		resp.WindDirection = roundedPtr(*wd, precision)
+	}
+	if p := averagePressure(readings); p != nil {
+		resp.Pressure = roundedPtr(*p, precision)
+	}
+	return resp, readings, nil
+}
+
+// chosenProvider returns the name of the provider among sources whose
+// reading in readings is kelvin.
+func chosenProvider(readings []ProviderReading, sources []string, kelvin float64) string {
+	for _, r := range readings {
+		if r.Err != nil || r.TempKelvin != kelvin {
+			continue
+		}
+		for _, s := range sources {
+			if s == r.Name {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// providersAsked counts the providers behind readings that were asked for
+// one, leaving out those taken out of rotation or unable to answer the query.
+func providersAsked(readings []ProviderReading) int {
+	n := 0
+	for _, r := range readings {
+		if !errors.Is(r.Err, errProviderDisabled) && !errors.Is(r.Err, errCityRequired) {
+			n++
+		}
+	}
+	return n
+}
+
+// statusForError picks the HTTP status to answer with when a lookup fails
+// with err. When several providers failed for different reasons, a timeout
+// or an upstream failure takes precedence over the city not being found,
+// which takes precedence over providers being disabled.
+func statusForError(err error) int {
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errSoftDeadline):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errUpstreamRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errUpstreamUnavailable), errors.Is(err, errImplausibleReading), errors.As(err, &ne):
+		return http.StatusBadGateway
+	case errors.Is(err, errCityNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errProviderDisabled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// timeoutResponse is the body of a 504 response, naming the providers that
+// were still being waited on.
+type timeoutResponse struct {
+	Error        string   `json:"error"`
+	Unresponsive []string `json:"unresponsive,omitempty"`
+}
+
+// writeTimeout answers with a 504 for err, listing the providers in
+// readings that didn't reply in time.
+func writeTimeout(w http.ResponseWriter, err error, readings []ProviderReading) {
+	resp := timeoutResponse{Error: err.Error()}
+	for _, r := range readings {
+		if errors.Is(r.Err, errSoftDeadline) || errors.Is(r.Err, context.DeadlineExceeded) {
+			resp.Unresponsive = append(resp.Unresponsive, r.Name)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with an ID, taken from its X-Request-ID
+// header or generated, so that log lines can be tied back to it. The ID is
+// stored in the request's context and echoed in the response.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of the request ctx belongs to, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a client-supplied ID is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logf logs a message, tagged with the request ID from ctx if there is one.
+func logf(ctx context.Context, format string, args ...interface{}) {
+	if id := requestID(ctx); id != "" {
+		format += " request_id=%s"
+		args = append(args, id)
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestIDRoundTrips(t *testing.T) {
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := requestID(r.Context()); got != "abc-123" {
+			t.Errorf("got request ID %q in context, want abc-123", got)
+		}
+	}))
+
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-ID"); got != "abc-123" {
+		t.Errorf("got X-Request-ID %q, want abc-123", got)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	for _, incoming := range []string{"", "bad id\nwith newline"} {
+		var inContext string
+		h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inContext = requestID(r.Context())
+		}))
+
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-ID", incoming)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		got := rec.Header().Get("X-Request-ID")
+		if got == "" || got == incoming || got != inContext {
+			t.Errorf("incoming %q: got header %q and context %q", incoming, got, inContext)
+		}
+	}
+}
+
+func TestProviderLogsIncludeRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	var urls []string
+	p := openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "abc-123")
+	if _, err := p.temperature(ctx, "london"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "request_id=abc-123") {
+		t.Errorf("log line %q does not include the request ID", buf.String())
+	}
+}
+
+func TestWeatherHandler(t *testing.T) {
+	h := withRequestID(weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout: time.Second,
+	})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london?units=celsius", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("X-Request-ID") == "" {
+		t.Error("missing X-Request-ID header")
+	}
+	if !strings.Contains(rec.Body.String(), `"unit":"celsius"`) {
+		t.Errorf("unexpected body %s", rec.Body)
+	}
+}
+
+func TestWeatherHandlerPaths(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout: time.Second,
+	}
+
+	tests := []struct {
+		path     string
+		want     int
+		wantCity string
+	}{
+		{"/weather/london", http.StatusOK, "london"},
+		{"/weather/london/", http.StatusOK, "london"},
+		{"/weather/new%20york", http.StatusOK, "new york"},
+		{"/weather/", http.StatusBadRequest, ""},
+		{"/weather", http.StatusBadRequest, ""},
+		{"/weather//", http.StatusBadRequest, ""},
+		{"/weather/london/today", http.StatusNotFound, ""},
+		{"/weather//london", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.path, rec.Code, tt.want, rec.Body)
+			continue
+		}
+		if tt.wantCity != "" && !strings.Contains(rec.Body.String(), `"city":"`+tt.wantCity+`"`) {
+			t.Errorf("%s: got %s, want city %q", tt.path, rec.Body, tt.wantCity)
+		}
+	}
+}
+
+func TestWeatherHandlerCityQuery(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout: time.Second,
+	}
+
+	tests := []struct {
+		target   string
+		want     int
+		wantCity string
+	}{
+		{"/weather?city=" + url.QueryEscape("Saint-Denis/Reunion"), http.StatusOK, "saint-denis/reunion"},
+		{"/weather/?city=tokyo", http.StatusOK, "tokyo"},
+		{"/weather/london?city=paris", http.StatusOK, "paris"},
+		{"/weather?city=", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d: %s", tt.target, rec.Code, tt.want, rec.Body)
+			continue
+		}
+		if tt.wantCity != "" && !strings.Contains(rec.Body.String(), `"city":"`+tt.wantCity+`"`) {
+			t.Errorf("%s: got %s, want city %q", tt.target, rec.Body, tt.wantCity)
+		}
+	}
+}
+
+func TestWeatherHandlerDegraded(t *testing.T) {
+	tests := []struct {
+		providers    []weatherProvider
+		wantUsed     string
+		wantDegraded string
+	}{
+		{[]weatherProvider{testConstantWeatherProvider(290), testConstantWeatherProvider(292)}, "2/2", "false"},
+		{[]weatherProvider{
+			testConstantWeatherProvider(290),
+			testFailingWeatherProvider{errors.New("openweathermap: unexpected status 500")},
+			testConstantWeatherProvider(292),
+		}, "2/3", "true"},
+	}
+
+	for _, tt := range tests {
+		h := weatherHandler{mw: multiWeatherProvider{providers: tt.providers}, timeout: time.Second}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Providers-Used"); got != tt.wantUsed {
+			t.Errorf("got X-Providers-Used %q, want %q", got, tt.wantUsed)
+		}
+		if got := rec.Header().Get("X-Degraded"); got != tt.wantDegraded {
+			t.Errorf("with %s used, got X-Degraded %q, want %q", tt.wantUsed, got, tt.wantDegraded)
+		}
+	}
+}
+
+func TestWeatherHandlerLocale(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(295.37)}},
+		timeout: time.Second,
+	}
+
+	tests := []struct {
+		query       string
+		wantUnit    string
+		wantDisplay string
+	}{
+		{"?locale=en-US", unitFahrenheit, "72°F"},
+		{"?locale=en-GB", unitCelsius, "22°C"},
+		{"?locale=xx", unitCelsius, "22°C"},
+		// An explicit unit wins for temp, but display follows the locale.
+		{"?locale=en-US&units=kelvin", unitKelvin, "72°F"},
+		{"", unitKelvin, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london"+tt.query, nil))
+
+		var resp WeatherResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v: %s", tt.query, err, rec.Body)
+		}
+		if resp.Unit != tt.wantUnit || resp.Display != tt.wantDisplay {
+			t.Errorf("%s: got unit %q, display %q, want %q, %q", tt.query, resp.Unit, resp.Display, tt.wantUnit, tt.wantDisplay)
+		}
+	}
+}
+
+func TestWeatherHandlerTimeoutHeader(t *testing.T) {
+	h := weatherHandler{
+		mw:         multiWeatherProvider{providers: []weatherProvider{testSleepyWeatherProvider{d: 50 * time.Millisecond}}},
+		timeout:    10 * time.Millisecond,
+		maxTimeout: time.Second,
+	}
+
+	tests := []struct {
+		header string
+		want   int
+	}{
+		// The default is too short for the provider, the override isn't.
+		{"", http.StatusGatewayTimeout},
+		{"500", http.StatusOK},
+		{"1000", http.StatusOK},
+		{"1001", http.StatusBadRequest},
+		{"5s", http.StatusBadRequest},
+		{"-1", http.StatusBadRequest},
+		{"0", http.StatusBadRequest},
+		{"99999999999999999999", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Timeout-Ms", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("X-Timeout-Ms %q: got status %d, want %d: %s", tt.header, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
+
+func TestRequestTimeoutWithoutMax(t *testing.T) {
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("X-Timeout-Ms", "2000")
+	if _, err := requestTimeout(req, time.Second, 0); err == nil {
+		t.Error("expected an error asking for longer than the default with no maximum")
+	}
+	req.Header.Set("X-Timeout-Ms", "500")
+	if d, err := requestTimeout(req, time.Second, 0); err != nil || d != 500*time.Millisecond {
+		t.Errorf("got %v, %v, want 500ms", d, err)
+	}
+}
+
+func TestWeatherHandlerResponseShape(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testHumidWeatherProvider{290, 60}}},
+		timeout: time.Second,
+	}
+
+	for _, tt := range []struct {
+		query string
+		keys  map[string]string // key to JSON type
+	}{
+		{"", map[string]string{
+			"city": "string", "temp": "number", "unit": "string", "took": "string", "sources": "array",
+			"feels_like": "number", "humidity": "number",
+		}},
+		{"?stats=true&detail=true", map[string]string{
+			"city": "string", "temp": "number", "unit": "string", "took": "string", "sources": "array",
+			"feels_like": "number", "humidity": "number",
+			"min": "number", "max": "number", "stddev": "number", "count": "number",
+			"providers": "array",
+		}},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london"+tt.query, nil))
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%q: %v: %s", tt.query, err, rec.Body)
+		}
+		for key, typ := range tt.keys {
+			if got := jsonType(body[key]); got != typ {
+				t.Errorf("%q: %s is %s, want %s", tt.query, key, got, typ)
+			}
+		}
+		for key := range body {
+			if _, ok := tt.keys[key]; !ok {
+				t.Errorf("%q: unexpected key %s", tt.query, key)
+			}
+		}
+	}
+}
+
+func TestWeatherHandlerSources(t *testing.T) {
+	h := weatherHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			openWeatherMapStub{},
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+			testConstantWeatherProvider(290),
+		}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+
+	var resp WeatherResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %s: %v", rec.Body, err)
+	}
+	want := []string{"openWeatherMap", "main.testConstantWeatherProvider"}
+	if strings.Join(resp.Sources, ",") != strings.Join(want, ",") {
+		t.Errorf("got sources %q, want %q", resp.Sources, want)
+	}
+}
+
+// jsonType names the JSON type of a value decoded into an interface{}.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "missing"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// testSlowClockWeatherProvider takes d on clock to answer.
+type testSlowClockWeatherProvider struct {
+	clock *fakeClock
+	d     time.Duration
+}
+
+func (p testSlowClockWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	p.clock.Advance(p.d)
+	return 290, nil
+}
+
+func TestWeatherHandlerTook(t *testing.T) {
+	clock := newFakeClock()
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testSlowClockWeatherProvider{clock, 1500 * time.Millisecond}}},
+		timeout: time.Second,
+		clock:   clock,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+
+	var resp WeatherResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if resp.Took != "1.5s" {
+		t.Errorf("got took %q, want 1.5s", resp.Took)
+	}
+}
+
+func TestWeatherHandlerUnknownCity(t *testing.T) {
+	var urls []string
+	gc := googleGeoCode{client: recordingClient(&urls, `{"results":[],"status":"ZERO_RESULTS"}`)}
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{forecastIo{geoCode: gc}}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/atlantis", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{statusError{provider: "test", code: http.StatusNotFound}, http.StatusNotFound},
+		{fmt.Errorf("nominatim: %w: atlantis", errCityNotFound), http.StatusNotFound},
+		{statusError{provider: "test", code: http.StatusTooManyRequests}, http.StatusTooManyRequests},
+		{statusError{provider: "test", code: http.StatusServiceUnavailable}, http.StatusBadGateway},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, http.StatusBadGateway},
+		{fmt.Errorf("lookup: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{fmt.Errorf("all weather providers failed: %w", errors.Join(errSoftDeadline)), http.StatusGatewayTimeout},
+		{errors.Join(statusError{provider: "a", code: http.StatusNotFound}, statusError{provider: "b", code: http.StatusBadGateway}), http.StatusBadGateway},
+		{fmt.Errorf("forecastIo: %w", errCircuitOpen), http.StatusBadGateway},
+		{fmt.Errorf("test: %w: 1000.00 K", errImplausibleReading), http.StatusBadGateway},
+		{errors.Join(errProviderDisabled, errProviderDisabled), http.StatusServiceUnavailable},
+		{errors.Join(errProviderDisabled, statusError{provider: "b", code: http.StatusNotFound}), http.StatusNotFound},
+		{statusError{provider: "test", code: http.StatusUnauthorized}, http.StatusInternalServerError},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if got := statusForError(tt.err); got != tt.want {
+			t.Errorf("statusForError(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestWeatherHandlerSoftDeadlineWithNoReadings(t *testing.T) {
+	h := weatherHandler{
+		mw: multiWeatherProvider{
+			providers: []weatherProvider{
+				testSleepyWeatherProvider{d: time.Minute},
+				testSleepyWeatherProvider{d: time.Minute},
+			},
+			softDeadline: 10 * time.Millisecond,
+		},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusGatewayTimeout, rec.Body)
+	}
+	var resp timeoutResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if resp.Error == "" || len(resp.Unresponsive) != 2 || resp.Unresponsive[0] != "main.testSleepyWeatherProvider" {
+		t.Errorf("got %+v, want both providers named", resp)
+	}
+}
+
+type testReverseGeoCode struct {
+	name  string
+	calls *int
+}
+
+func (g testReverseGeoCode) findCityName(ctx context.Context, l location) (string, error) {
+	*g.calls++
+	return g.name, nil
+}
+
+func TestWeatherHandlerReverseGeocodes(t *testing.T) {
+	var urls []string
+	var calls int
+	h := weatherHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)},
+			weatherUnderground{client: recordingClient(&urls, `{"current_observation":{"temp_c":17}}`)},
+		}},
+		timeout: time.Second,
+		reverse: testReverseGeoCode{name: "London", calls: &calls},
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/?lat=51.5&lng=-0.12", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	if calls != 1 {
+		t.Errorf("reverse geocoded %d times, want once", calls)
+	}
+	if len(urls) != 2 {
+		t.Fatalf("got %d provider requests, want 2", len(urls))
+	}
+	for _, u := range urls {
+		if !strings.Contains(u, "london") {
+			t.Errorf("request %s does not use the reverse geocoded city", u)
+		}
+	}
+}
+
+func TestWeatherHandlerStats(t *testing.T) {
+	h := weatherHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			testConstantWeatherProvider(283.15),
+			testConstantWeatherProvider(293.15),
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+		}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london?units=fahrenheit&stats=true", nil))
+
+	var resp struct {
+		Min, Max, StdDev float64
+		Count            int
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %s: %v", rec.Body, err)
+	}
+	if math.Abs(resp.Min-50) > 1e-9 || math.Abs(resp.Max-68) > 1e-9 || math.Abs(resp.StdDev-9) > 1e-9 || resp.Count != 2 {
+		t.Errorf("got %+v, want min 50, max 68, stddev 9, count 2", resp)
+	}
+}
+
+func TestWeatherHandlerUVIndex(t *testing.T) {
+	uvi := 4.0
+	h := weatherHandler{
+		mw: multiWeatherProvider{providers: []weatherProvider{
+			testConditionsWeatherProvider{TempKelvin: 290, UVIndex: &uvi},
+			testConstantWeatherProvider(290),
+		}},
+		timeout: time.Second,
+	}
+
+	for query, want := range map[string]*float64{"": nil, "?uv=true": &uvi, "?detail=true": &uvi} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london"+query, nil))
+
+		var resp WeatherResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: bad response %s: %v", query, rec.Body, err)
+		}
+		if (resp.UVIndex == nil) != (want == nil) || (want != nil && *resp.UVIndex != *want) {
+			t.Errorf("%q: got UV index %v, want %v", query, resp.UVIndex, want)
+		}
+	}
+}
+
+func TestWeatherHandlerChosenProvider(t *testing.T) {
+	h := weatherHandler{
+		mw: multiWeatherProvider{
+			providers: []weatherProvider{
+				testConstantWeatherProvider(280),
+				openWeatherMapStub{},
+				testConditionsWeatherProvider{TempKelvin: 300},
+			},
+			aggregator: ClosestToMedianAggregator{},
+		},
+		timeout: time.Second,
+	}
+
+	for query, want := range map[string]string{"": "", "?detail=true": "openWeatherMap"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london"+query, nil))
+
+		var resp WeatherResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%q: bad response %s: %v", query, rec.Body, err)
+		}
+		if resp.Temp != 290.1 || resp.Chosen != want {
+			t.Errorf("%q: got %v from %q, want 290.1 from %q", query, resp.Temp, resp.Chosen, want)
+		}
+	}
+}
+
+func TestWeatherHandlerPrecision(t *testing.T) {
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290.123456)}},
+		timeout: time.Second,
+	}
+
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantTemp   float64
+	}{
+		{"", http.StatusOK, 290.12},
+		{"?precision=0", http.StatusOK, 290},
+		{"?precision=4", http.StatusOK, 290.1235},
+		{"?precision=7", http.StatusBadRequest, 0},
+		{"?precision=-1", http.StatusBadRequest, 0},
+		{"?precision=two", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london"+tt.query, nil))
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%q: got status %d, want %d", tt.query, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var resp struct{ Temp float64 }
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("bad response %s: %v", rec.Body, err)
+		}
+		if resp.Temp != tt.wantTemp {
+			t.Errorf("%q: got temp %v, want %v", tt.query, resp.Temp, tt.wantTemp)
+		}
+	}
+}
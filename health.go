@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// healthHandler answers liveness probes without touching any provider.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyHandler answers readiness probes. When city is set it asks every
+// provider for the temperature there, within timeout, and reports ready if at
+// least one of them answered. Without a city it always reports ready.
+func readyHandler(mw multiWeatherProvider, city string, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type providerStatus struct {
+			Name      string `json:"name"`
+			Reachable bool   `json:"reachable"`
+			Error     string `json:"error,omitempty"`
+		}
+		resp := struct {
+			Ready     bool             `json:"ready"`
+			Providers []providerStatus `json:"providers,omitempty"`
+		}{Ready: true}
+
+		if city != "" {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			// Check every provider even if some fail, whatever mode mw is in.
+			check := mw
+			check.strict = false
+			readings, err := check.temperatures(ctx, city)
+			resp.Ready = err == nil
+			for _, reading := range readings {
+				s := providerStatus{Name: reading.Name, Reachable: reading.Err == nil}
+				if reading.Err != nil {
+					s.Error = reading.Err.Error()
+				}
+				resp.Providers = append(resp.Providers, s)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !resp.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// providersHandler lists the configured providers. A provider is healthy
+// unless its last call failed or its circuit breaker is open, as recorded
+// in m.
+func providersHandler(providers []weatherProvider, m *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		type providerStatus struct {
+			Name          string   `json:"name"`
+			Healthy       bool     `json:"healthy"`
+			LastError     *string  `json:"lastError"`
+			LastLatencyMs *float64 `json:"lastLatencyMs"`
+		}
+		resp := make([]providerStatus, 0, len(providers))
+
+		for _, p := range providers {
+			s := providerStatus{Name: providerName(p), Healthy: true}
+			if call, ok := m.lastCall(s.Name); ok {
+				ms := float64(call.latency) / float64(time.Millisecond)
+				s.LastLatencyMs = &ms
+				if call.err != nil {
+					msg := call.err.Error()
+					s.LastError = &msg
+					s.Healthy = false
+				}
+			}
+			if state, ok := m.breakerState(s.Name); ok && state == circuitOpen {
+				s.Healthy = false
+			}
+			resp = append(resp, s)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
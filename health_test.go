@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200", rec.Code)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		city       string
+		providers  []weatherProvider
+		wantStatus int
+		wantReach  []bool
+	}{
+		{
+			name:       "no upstream check",
+			providers:  []weatherProvider{testFailingWeatherProvider{errors.New("down")}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "some reachable",
+			city:       "london",
+			providers:  []weatherProvider{testFailingWeatherProvider{errors.New("down")}, openWeatherMapStub{}},
+			wantStatus: http.StatusOK,
+			wantReach:  []bool{false, true},
+		},
+		{
+			name:       "none reachable",
+			city:       "london",
+			providers:  []weatherProvider{testFailingWeatherProvider{errors.New("down")}},
+			wantStatus: http.StatusServiceUnavailable,
+			wantReach:  []bool{false},
+		},
+	}
+
+	for _, tt := range tests {
+		mw := multiWeatherProvider{providers: tt.providers, strict: true}
+		rec := httptest.NewRecorder()
+		readyHandler(mw, tt.city, time.Second).ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+
+		var body struct {
+			Providers []struct {
+				Reachable bool `json:"reachable"`
+			} `json:"providers"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(body.Providers) != len(tt.wantReach) {
+			t.Errorf("%s: got %d providers, want %d", tt.name, len(body.Providers), len(tt.wantReach))
+			continue
+		}
+		for i, want := range tt.wantReach {
+			if body.Providers[i].Reachable != want {
+				t.Errorf("%s: provider %d reachable = %v, want %v", tt.name, i, body.Providers[i].Reachable, want)
+			}
+		}
+	}
+}
+
+func TestProvidersHandler(t *testing.T) {
+	m := newMetrics()
+	ok := instrumentedWeatherProvider{provider: openWeatherMapStub{}, metrics: m}
+	failing := instrumentedWeatherProvider{provider: namedFailingProvider{}, metrics: m}
+	breaker := NewCircuitBreakerProvider(testFailingWeatherProvider{errors.New("down")}, 1, time.Minute)
+	m.registerBreaker(breaker)
+	idle := testSlowWeatherProvider{}
+
+	ok.temperature(context.Background(), "london")
+	failing.temperature(context.Background(), "london")
+	breaker.temperature(context.Background(), "london")
+
+	rec := httptest.NewRecorder()
+	providersHandler([]weatherProvider{ok, failing, breaker, idle}, m).ServeHTTP(rec, httptest.NewRequest("GET", "/providers", nil))
+
+	var resp []struct {
+		Name          string
+		Healthy       bool
+		LastError     *string
+		LastLatencyMs *float64
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %s: %v", rec.Body, err)
+	}
+	if len(resp) != 4 {
+		t.Fatalf("got %d providers, want 4", len(resp))
+	}
+
+	want := []struct {
+		name      string
+		healthy   bool
+		lastError bool
+		called    bool
+	}{
+		{"openWeatherMap", true, false, true},
+		{"forecastIo", false, true, true},
+		{"main.testFailingWeatherProvider", false, false, false},
+		{"main.testSlowWeatherProvider", true, false, false},
+	}
+	for i, w := range want {
+		got := resp[i]
+		if got.Name != w.name || got.Healthy != w.healthy || (got.LastError != nil) != w.lastError || (got.LastLatencyMs != nil) != w.called {
+			t.Errorf("provider %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
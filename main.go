@@ -1,252 +1,1299 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"flag"
-	"io/ioutil"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-func NewProviderClient() *http.Client {
-	return &http.Client{
-		Timeout: 10 * time.Second,
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Version {
+		fmt.Println(buildVersion())
+		return
 	}
-}
 
-func main() {
-	wundergroundAPIKey := flag.String("wunderground.api.key", "0123456789abcdef", "wunderground.com API key")
-	forecastIoAPIKey := flag.String("forecastio.api.key", "0123456789abcdef", "forecast.io API key")
-	flag.Parse()
+	agg, err := aggregatorByName(cfg.Aggregation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.StreamInterval.Duration <= 0 {
+		log.Fatalf("stream interval must be positive, got %v", cfg.StreamInterval.Duration)
+	}
+
+	clientOpts, err := clientOptions(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Every provider and geocoder shares one client, and so one pool of
+	// connections. Clients are safe for concurrent use and none of them
+	// change it.
+	client := NewProviderClient(cfg.ClientTimeout.Duration, cfg.UserAgent, clientOpts...)
+
+	if cfg.OpenWeatherMapAPIKey == "" && !cfg.Demo {
+		log.Print("warning: no OpenWeatherMap API key set, its requests will be rejected")
+	}
+
+	gc, rgc, err := newGeoCode(cfg, cfg.Geocoder, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gc = NewCachingGeoCode(gc, cfg.GeocodeCacheTTL.Duration, cfg.NegativeCacheTTL.Duration)
+
+	providers, err := buildProviders(cfg, client, gc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Demo {
+		log.Print("demo mode: serving canned temperatures without calling any APIs")
+		providers = []weatherProvider{demoTemperatures}
+	}
 
-	mw := multiWeatherProvider{
-		openWeatherMap{client: NewProviderClient()},
-		weatherUnderground{client: NewProviderClient(), apiKey: *wundergroundAPIKey},
-		forecastIo{apiKey: *forecastIoAPIKey, geoCode: &googleGeoCode{}, client: NewProviderClient()},
+	// Forecasts and air quality go straight to the providers that offer
+	// them, since the wrappers below only deal in current conditions.
+	switches := &providerSwitches{}
+	forecasts := multiWeatherProvider{
+		providers: append([]weatherProvider(nil), providers...),
+		strict:    cfg.Strict,
+		switches:  switches,
 	}
 
-	http.HandleFunc("/weather/", func(w http.ResponseWriter, r *http.Request) {
-		begin := time.Now()
-		city := strings.SplitN(r.URL.Path, "/", 3)[2]
+	timeouts, err := parseProviderTimeouts(cfg.ProviderTimeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Innermost, so that each retry gets the full timeout again.
+	for i, p := range providers {
+		if d, ok := timeouts[providerName(p)]; ok {
+			if d > cfg.ClientTimeout.Duration {
+				log.Printf("warning: requests by %s are still cut off at -client.timeout %v, within its timeout of %v", providerName(p), cfg.ClientTimeout.Duration, d)
+			}
+			providers[i] = NewTimeoutWeatherProvider(p, d)
+			delete(timeouts, providerName(p))
+		}
+	}
+	for name := range timeouts {
+		log.Printf("warning: timeout given for unknown provider %q", name)
+	}
 
-		temp, err := mw.temperature(city)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	m := newMetrics()
+	for i, p := range providers {
+		providers[i] = instrumentedWeatherProvider{provider: p, metrics: m}
+	}
+	if cfg.SlowThreshold.Duration > 0 {
+		for i, p := range providers {
+			providers[i] = NewSlowLoggingWeatherProvider(p, cfg.SlowThreshold.Duration)
+		}
+	}
+	if cfg.Retries > 0 {
+		var budget *retryBudget
+		if cfg.RetryBudget > 0 {
+			budget = newRetryBudget(cfg.RetryBudget, cfg.RetryBudgetBurst)
 		}
+		for i, p := range providers {
+			r := NewRetryingWeatherProvider(p, cfg.Retries, cfg.RetryDelay.Duration)
+			r.budget = budget
+			providers[i] = r
+		}
+	}
+	if cfg.BreakerThreshold > 0 {
+		for i, p := range providers {
+			b := NewCircuitBreakerProvider(p, cfg.BreakerThreshold, cfg.BreakerCooldown.Duration)
+			m.registerBreaker(b)
+			providers[i] = b
+		}
+	}
+	if cfg.SmoothingAlpha != 0 {
+		// Smoothed below the cache, so each upstream reading is blended in
+		// once rather than on every cache hit.
+		for i, p := range providers {
+			s, err := NewSmoothingWeatherProvider(p, cfg.SmoothingAlpha)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.window = cfg.SmoothingWindow.Duration
+			providers[i] = s
+		}
+	}
+	if cfg.CacheHardTTL.Duration > 0 && cfg.CacheHardTTL.Duration <= cfg.CacheTTL.Duration {
+		log.Print("warning: -cache.hard.ttl is no longer than -cache.ttl, so stale readings won't be served")
+	}
+	var caches []*cachingWeatherProvider
+	for i, p := range providers {
+		// The cache collapses concurrent lookups itself.
+		if cfg.CacheTTL.Duration > 0 {
+			c := NewCachingWeatherProvider(p, cfg.CacheTTL.Duration, cfg.NegativeCacheTTL.Duration)
+			c.hardTTL = cfg.CacheHardTTL.Duration
+			caches = append(caches, c)
+			providers[i] = c
+		} else {
+			providers[i] = NewSingleFlightWeatherProvider(p)
+		}
+	}
 
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"city": city,
-			"temp": temp,
-			"took": time.Since(begin).String(),
-		})
-	})
+	// Tracing is on when an OTLP endpoint is set in the environment.
+	var tr *tracer
+	if exp := otlpExporterFromEnv(os.Getenv, client); exp != nil {
+		log.Printf("exporting traces to %s", exp.url)
+		go exp.run(5 * time.Second)
+		tr = &tracer{exporter: exp}
+		for i, p := range providers {
+			providers[i] = tracedWeatherProvider{provider: p, tracer: tr}
+		}
+	}
+
+	mw, err := NewMultiWeatherProvider(providers,
+		WithStrict(cfg.Strict),
+		WithAggregator(agg),
+		WithConcurrency(cfg.Concurrency),
+		WithOutlierRejection(cfg.OutlierK),
+		WithMinProviders(cfg.MinProviders),
+		WithValidator(temperatureRange(cfg.MinKelvin, cfg.MaxKelvin)),
+		WithRecencyHalfLife(cfg.RecencyHalfLife.Duration),
+		WithSoftDeadline(cfg.SoftDeadline.Duration),
+		WithSwitches(switches),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.City != "" {
+		if err := runQuery(mw, cfg.City, cfg.Units, cfg.Format, cfg.Timeout.Duration, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	http.Handle("/metrics", m)
+	http.HandleFunc("/health", healthHandler)
+	http.Handle("/ready", readyHandler(mw, cfg.ReadyCity, cfg.ReadyTimeout.Duration))
+	http.Handle("/providers", providersHandler(providers, m))
+	http.Handle("/providers/", providerAdminHandler{mw: mw, token: cfg.AdminToken})
+	var weather http.Handler = weatherHandler{mw: mw, timeout: cfg.Timeout.Duration, maxTimeout: cfg.MaxTimeout.Duration, reverse: rgc}
+	var forecast http.Handler = forecastHandler{mw: forecasts, timeout: cfg.Timeout.Duration}
+	var compare http.Handler = compareHandler{mw: mw, timeout: cfg.Timeout.Duration}
+	var air http.Handler = airHandler{mw: forecasts, timeout: cfg.Timeout.Duration}
+	streams := streamHandler{mw: mw, timeout: cfg.Timeout.Duration, interval: cfg.StreamInterval.Duration}
+	var stream, sse http.Handler = streams, sseHandler{streams}
+	if keys := splitList(cfg.AuthKeys); len(keys) > 0 {
+		weather, forecast, compare, air = withAPIKeys(weather, keys), withAPIKeys(forecast, keys), withAPIKeys(compare, keys), withAPIKeys(air, keys)
+		stream, sse = withAPIKeys(stream, keys), withAPIKeys(sse, keys)
+	}
+	gs := grpcServer{mw: mw, timeout: cfg.Timeout.Duration, keys: splitList(cfg.AuthKeys)}
+	if cfg.RateLimitRPS > 0 {
+		l := newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+		if l.trusted, err = parseTrustedProxies(cfg.TrustedProxies); err != nil {
+			log.Fatal(err)
+		}
+		weather, forecast, compare, air = l.limit(weather), l.limit(forecast), l.limit(compare), l.limit(air)
+		stream, sse = l.limit(stream), l.limit(sse)
+		gs.limiter = l
+	}
+	weather = m.instrument(withRequestID(tr.handler("GET /weather/", weather)))
+	http.Handle("/weather", weather)
+	http.Handle("/weather/", weather)
+	http.Handle("/weather/compare/", withRequestID(tr.handler("GET /weather/compare/", compare)))
+	// Streams last as long as the client stays, so they are left out of the
+	// request latency histogram, and the tracer's wrapper can't be hijacked
+	// or flushed.
+	http.Handle("/weather/stream/", withRequestID(stream))
+	http.Handle("/weather/sse/", withRequestID(sse))
+	http.Handle("/forecast/", withRequestID(tr.handler("GET /forecast/", forecast)))
+	http.Handle("/air/", withRequestID(tr.handler("GET /air/", air)))
+	if cfg.Debug {
+		var debug http.Handler = debugHandler{mw: forecasts}
+		if keys := splitList(cfg.AuthKeys); len(keys) > 0 {
+			debug = withAPIKeys(debug, keys)
+		}
+		http.Handle("/weather/debug/", withRequestID(debug))
+	}
+
+	if cfg.GRPCListen != "" {
+		go func() {
+			log.Printf("serving gRPC on %s", cfg.GRPCListen)
+			log.Fatal(newGRPCServer(cfg.GRPCListen, gs).ListenAndServe())
+		}()
+	}
+
+	// Background work stops, and the server finishes the requests in
+	// flight, on SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cities := splitList(cfg.PrewarmCities); len(cities) > 0 {
+		if len(caches) == 0 {
+			log.Print("warning: prewarming needs a cache, set -cache.ttl")
+		} else {
+			interval := cfg.PrewarmInterval.Duration
+			if interval <= 0 {
+				interval = cfg.CacheTTL.Duration / 2
+			}
+			go prewarmer{caches: caches, cities: cities, interval: interval, timeout: cfg.Timeout.Duration}.run(ctx)
+		}
+	}
 
-	http.ListenAndServe(":8080", nil)
+	server := newServer(cfg, withGzip(withCORS(http.DefaultServeMux, splitList(cfg.CORSOrigins)), gzipMinSize))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		log.Print("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout.Duration)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("shutting down: %v", err)
+		}
+	}()
+
+	if cfg.TLSCert != "" {
+		// HTTP/2 is negotiated automatically over TLS.
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		log.Printf("listening on %s with TLS", cfg.Listen)
+		err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		log.Printf("listening on %s", cfg.Listen)
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// newServer returns a server for h on cfg's listen address, with timeouts
+// so that slow or idle clients can't hold connections open indefinitely.
+func newServer(cfg Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+	}
 }
 
 type weatherProvider interface {
-	temperature(city string) (float64, error) // in Kelvin, naturally
+	temperature(ctx context.Context, city string) (Temperature, error) // in Kelvin, naturally
+}
+
+// namedProvider is implemented by providers that can label themselves in
+// per-provider output.
+type namedProvider interface {
+	name() string
 }
 
-type multiWeatherProvider []weatherProvider
+// providerName returns p's name, falling back to its Go type.
+func providerName(p weatherProvider) string {
+	if n, ok := p.(namedProvider); ok {
+		return n.name()
+	}
+	return fmt.Sprintf("%T", p)
+}
 
-func (w multiWeatherProvider) temperature(city string) (float64, error) {
-	// Make a channel for temperatures, and a channel for errors.
-	// Each provider will push a value into only one.
-	temps := make(chan float64, len(w))
-	errs := make(chan error, len(w))
+// multiWeatherProvider averages the temperatures reported by several providers.
+// By default it is best-effort: failing providers are left out of the average,
+// and an error is only returned if every provider fails. In strict mode the
+// first failure fails the whole lookup. Readings are combined with the
+// aggregator, which defaults to the mean. If concurrency is positive, at most
+// that many providers are queried at once.
+//
+// weights, if set, holds a weight for each provider, used by aggregators that
+// support them. Every provider counts equally otherwise.
+//
+// If outlierK is positive, readings more than outlierK standard deviations
+// from the mean are left out before aggregating.
+//
+// If minProviders is more than 1, a lookup that fewer providers answered
+// fails rather than trusting so few readings.
+type multiWeatherProvider struct {
+	providers    []weatherProvider
+	weights      []float64
+	outlierK     float64
+	strict       bool
+	aggregator   Aggregator
+	concurrency  int
+	minProviders int
+
+	// softDeadline, if set, is how long to wait for providers before
+	// giving up on the slow ones and going with the readings so far.
+	softDeadline time.Duration
+
+	// switches, if set, lets providers be taken out of rotation while
+	// running. It is shared by copies of the multiWeatherProvider.
+	switches *providerSwitches
+
+	// validate, if set, checks each reading's temperature in Kelvin.
+	// Readings it returns an error for are treated as failures.
+	validate func(kelvin float64) error
+
+	// recencyHalfLife, if set, halves a reading's weight for each half-life
+	// that has passed since it was observed, going by clock. Readings that
+	// don't say when they were observed keep their full weight.
+	recencyHalfLife time.Duration
+	clock           clock
+}
+
+// NewWeightedMultiWeatherProvider returns a multiWeatherProvider that gives
+// each provider the weight at the same index in weights.
+func NewWeightedMultiWeatherProvider(providers []weatherProvider, weights []float64) (multiWeatherProvider, error) {
+	if len(providers) != len(weights) {
+		return multiWeatherProvider{}, fmt.Errorf("got %d weights for %d providers", len(weights), len(providers))
+	}
+	for i, wt := range weights {
+		if wt < 0 || math.IsNaN(wt) || math.IsInf(wt, 0) {
+			return multiWeatherProvider{}, fmt.Errorf("invalid weight %v for %s", wt, providerName(providers[i]))
+		}
+	}
+	return multiWeatherProvider{providers: providers, weights: weights}, nil
+}
+
+func (w multiWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	readings, err := w.temperatures(ctx, city)
+	if err != nil {
+		return 0, err
+	}
+	return FromKelvin(w.aggregate(readings)), nil
+}
+
+// aggregate combines the successful readings into a single temperature using
+// the configured aggregator. The readings must be in provider order, as
+// returned by temperatures, for weights to line up.
+func (w multiWeatherProvider) aggregate(readings []ProviderReading) float64 {
+	k, _ := w.combine(readings)
+	return k
+}
+
+// combine is aggregate, but also returns the names of the providers whose
+// readings went into the result, leaving out failures and outliers.
+func (w multiWeatherProvider) combine(readings []ProviderReading) (kelvin float64, sources []string) {
+	var ok []int
+	for i, r := range readings {
+		if r.Err == nil {
+			ok = append(ok, i)
+		}
+	}
+
+	if w.outlierK > 0 {
+		temps := make([]float64, len(ok))
+		for j, i := range ok {
+			temps[j] = readings[i].TempKelvin
+		}
+		var kept []int
+		for j, keep := range outliers(temps, w.outlierK) {
+			if keep {
+				kept = append(kept, ok[j])
+			} else {
+				log.Printf("dropping outlier from %s: %.2f", readings[ok[j]].Name, readings[ok[j]].TempKelvin)
+			}
+		}
+		ok = kept
+	}
+
+	now := nowOn(w.clock)
+	var temps, weights []float64
+	for _, i := range ok {
+		temps = append(temps, readings[i].TempKelvin)
+		if w.weights != nil || w.recencyHalfLife > 0 {
+			wt := 1.0
+			if w.weights != nil {
+				wt = w.weights[i]
+			}
+			weights = append(weights, wt*recencyWeight(readings[i].ObservedAt, now, w.recencyHalfLife))
+		}
+		sources = append(sources, readings[i].Name)
+	}
+
+	agg := w.aggregator
+	if agg == nil {
+		agg = MeanAggregator{}
+	}
+	if wa, ok := agg.(WeightedAggregator); ok && weights != nil {
+		return wa.AggregateWeighted(temps, weights), sources
+	}
+	return agg.Aggregate(temps), sources
+}
+
+// ProviderReading is the outcome of asking a single provider for the current
+// conditions.
+type ProviderReading struct {
+	Name string
+	Conditions
+	Err error
+
+	// Location is where the provider looked, for providers that geocode.
+	Location *location
+}
+
+func (r ProviderReading) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Name            string     `json:"name"`
+		TempKelvin      *float64   `json:"tempKelvin"`
+		HumidityPercent *float64   `json:"humidityPercent,omitempty"`
+		WindSpeed       *float64   `json:"windSpeedMetersPerSec,omitempty"`
+		WindDirection   *float64   `json:"windDirectionDegrees,omitempty"`
+		ApparentTemp    *float64   `json:"apparentTempKelvin,omitempty"`
+		UVIndex         *float64   `json:"uvIndex,omitempty"`
+		PressureHPa     *float64   `json:"pressureHPa,omitempty"`
+		ObservedAt      *time.Time `json:"observedAt,omitempty"`
+		Error           *string    `json:"error"`
+		Location        *location  `json:"location,omitempty"`
+	}{Name: r.Name, Location: r.Location}
+	if r.Err != nil {
+		msg := r.Err.Error()
+		v.Error = &msg
+	} else {
+		v.TempKelvin = &r.TempKelvin
+		v.HumidityPercent = r.HumidityPercent
+		v.WindSpeed = r.WindSpeedMetersPerSec
+		v.WindDirection = r.WindDirectionDegrees
+		v.ApparentTemp = r.ApparentTempKelvin
+		v.UVIndex = r.UVIndex
+		v.PressureHPa = r.PressureHPa
+		if !r.ObservedAt.IsZero() {
+			v.ObservedAt = &r.ObservedAt
+		}
+	}
+	return json.Marshal(v)
+}
+
+// MarshalXML encodes r like MarshalJSON does, for XML responses.
+func (r ProviderReading) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	v := struct {
+		Name            string     `xml:"name,attr"`
+		TempKelvin      *float64   `xml:"tempKelvin"`
+		HumidityPercent *float64   `xml:"humidityPercent"`
+		WindSpeed       *float64   `xml:"windSpeedMetersPerSec"`
+		WindDirection   *float64   `xml:"windDirectionDegrees"`
+		ApparentTemp    *float64   `xml:"apparentTempKelvin"`
+		UVIndex         *float64   `xml:"uvIndex"`
+		PressureHPa     *float64   `xml:"pressureHPa"`
+		ObservedAt      *time.Time `xml:"observedAt"`
+		Error           string     `xml:"error,omitempty"`
+		Location        *location  `xml:"location"`
+	}{Name: r.Name, Location: r.Location}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	} else {
+		v.TempKelvin = &r.TempKelvin
+		v.HumidityPercent = r.HumidityPercent
+		v.WindSpeed = r.WindSpeedMetersPerSec
+		v.WindDirection = r.WindDirectionDegrees
+		v.ApparentTemp = r.ApparentTempKelvin
+		v.UVIndex = r.UVIndex
+		v.PressureHPa = r.PressureHPa
+		if !r.ObservedAt.IsZero() {
+			v.ObservedAt = &r.ObservedAt
+		}
+	}
+	return e.EncodeElement(v, start)
+}
+
+// temperatures asks every provider for the temperature in city, and returns
+// one reading per provider in the order they were configured. An error is
+// returned if every provider failed, along with the readings, or in strict
+// mode if any of them did. Providers that miss the soft deadline count as
+// failed with errSoftDeadline.
+func (w multiWeatherProvider) temperatures(ctx context.Context, city string) ([]ProviderReading, error) {
+	// Cancel any providers still in flight once we have what we need.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i int
+		ProviderReading
+	}
+	results := make(chan result, len(w.providers))
+
+	var sem chan struct{}
+	if w.concurrency > 0 {
+		sem = make(chan struct{}, w.concurrency)
+	}
 
 	// For each provider, spawn a goroutine with an anonymous function.
 	// That function will invoke the temperature method, and forward the response.
-	for _, provider := range w {
-		go func(p weatherProvider) {
-			k, err := p.temperature(city)
-			if err != nil {
-				errs <- err
-				return
+	for i, provider := range w.providers {
+		if w.switches.disabled(providerName(provider)) {
+			results <- result{i, ProviderReading{Name: providerName(provider), Err: errProviderDisabled}}
+			continue
+		}
+		go func(i int, p weatherProvider) {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					results <- result{i, ProviderReading{Name: providerName(p), Err: ctx.Err()}}
+					return
+				}
 			}
-			temps <- k
-		}(provider)
+
+			var l *location
+			c, err := conditionsOf(withLocationRecorder(ctx, &l), p, city)
+			results <- result{i, ProviderReading{Name: providerName(p), Conditions: c, Err: err, Location: l}}
+		}(i, provider)
 	}
 
-	sum := 0.0
+	var deadline <-chan time.Time
+	if w.softDeadline > 0 {
+		t := time.NewTimer(w.softDeadline)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	readings := make([]ProviderReading, len(w.providers))
+	received := make([]bool, len(w.providers))
+	var failures []error
+	skipped := 0
 
-	// Collect a temperature or an error from each provider.
-	for i := 0; i < len(w); i++ {
+	// Collect a reading from each provider. Once the deadline passes, stop
+	// waiting and take stand-ins for the providers still outstanding.
+	for range w.providers {
+		var r result
 		select {
-		case temp := <-temps:
-			sum += temp
-		case err := <-errs:
-			return 0, err
+		case r = <-results:
+		case <-deadline:
+			late := make(chan result, len(w.providers))
+			var names []string
+			for i, p := range w.providers {
+				if !received[i] {
+					late <- result{i, ProviderReading{Name: providerName(p), Err: errSoftDeadline}}
+					names = append(names, providerName(p))
+				}
+			}
+			logf(ctx, "no reply before the soft deadline from %s", strings.Join(names, ", "))
+			results, deadline = late, nil
+			r = <-results
+		}
+		received[r.i] = true
+		if r.Err == nil && w.validate != nil {
+			if err := w.validate(r.TempKelvin); err != nil {
+				logf(ctx, "dropping reading from %s: %v", r.Name, err)
+				r.Err = err
+			}
+		} else if errors.Is(r.Err, errImplausibleReading) {
+			// The provider caught it itself, before converting it.
+			logf(ctx, "dropping reading from %s: %v", r.Name, r.Err)
+		}
+		readings[r.i] = r.ProviderReading
+		switch {
+		case r.Err == nil:
+		case errors.Is(r.Err, errCityRequired), errors.Is(r.Err, errProviderDisabled):
+			skipped++
+		case w.strict:
+			return nil, &ProviderError{Provider: r.Name, Err: r.Err}
+		default:
+			failures = append(failures, &ProviderError{Provider: r.Name, Err: r.Err})
 		}
 	}
 
-	// Return the average, same as before.
-	return sum / float64(len(w)), nil
+	if len(failures)+skipped == len(w.providers) {
+		if len(failures) == 0 {
+			return readings, errors.New("no weather providers available for this query")
+		}
+		if allNotFound(failures) {
+			return readings, fmt.Errorf("%w: %s", errCityNotFound, city)
+		}
+		return readings, fmt.Errorf("all weather providers failed: %w", errors.Join(failures...))
+	}
+	if answered := len(w.providers) - len(failures) - skipped; answered < w.minProviders {
+		err := fmt.Errorf("%w: %d answered, %d needed", errTooFewReadings, answered, w.minProviders)
+		if len(failures) > 0 {
+			err = fmt.Errorf("%w: %w", err, errors.Join(failures...))
+		}
+		return readings, err
+	}
+
+	return readings, nil
+}
+
+// allNotFound reports whether every one of errs says the city wasn't found.
+func allNotFound(errs []error) bool {
+	for _, err := range errs {
+		if !isNotFound(err) {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
+
+// malformedResponse describes a response body from provider that couldn't be
+// decoded, such as an empty body or an HTML error page.
+func malformedResponse(provider string, err error) error {
+	return fmt.Errorf("%s: malformed response: %w", provider, err)
+}
+
+// statusError is returned when an upstream API answers with a non-2xx status.
+type statusError struct {
+	provider string
+	code     int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.provider, e.code)
+}
+
+// Unwrap returns the sentinel error the status code stands for, if any.
+func (e statusError) Unwrap() error {
+	switch {
+	case e.code == http.StatusNotFound:
+		return errCityNotFound
+	case e.code == http.StatusTooManyRequests:
+		return errUpstreamRateLimited
+	case e.code >= 500:
+		return errUpstreamUnavailable
+	}
+	return nil
+}
+
+// ProviderError records which provider a failure came from, so callers can
+// pick it out of a combined error with errors.As.
+type ProviderError struct {
+	Provider string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	// Most providers already name themselves in their errors.
+	msg := e.Err.Error()
+	if before, _, ok := strings.Cut(msg, ": "); ok && strings.EqualFold(before, e.Provider) {
+		return msg
+	}
+	return e.Provider + ": " + msg
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// checkStatus returns a statusError unless resp has a 2xx status code.
+func checkStatus(provider string, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError{provider: provider, code: resp.StatusCode}
+	}
+	return nil
 }
 
 type openWeatherMap struct {
-	client *http.Client
+	apiKey  string
+	client  *http.Client
+	baseURL string  // defaults to defaultOpenWeatherMapURL
+	geoCode geoCode // locates cities for air quality, which needs coordinates
+}
+
+const defaultOpenWeatherMapURL = "http://api.openweathermap.org"
+
+// buildURL returns the URL to look up the current conditions in city.
+func (w openWeatherMap) buildURL(ctx context.Context, city string) string {
+	u := orDefault(w.baseURL, defaultOpenWeatherMapURL) + "/data/2.5/weather?" + openWeatherMapQuery(city, countryFrom(ctx))
+	if w.apiKey != "" {
+		u += "&appid=" + url.QueryEscape(w.apiKey)
+	}
+	return u
+}
+
+func (w openWeatherMap) secret() string {
+	return w.apiKey
 }
 
-func (w openWeatherMap) temperature(city string) (float64, error) {
-	resp, err := w.client.Get("http://api.openweathermap.org/data/2.5/weather?q=" + city)
+func (w openWeatherMap) name() string {
+	return "openWeatherMap"
+}
+
+func (w openWeatherMap) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := w.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (w openWeatherMap) conditions(ctx context.Context, city string) (Conditions, error) {
+	if city == "" {
+		return Conditions{}, errCityRequired
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", w.buildURL(ctx, city), nil)
 	if err != nil {
-		return 0, err
+		return Conditions{}, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return Conditions{}, err
 	}
 
 	defer resp.Body.Close()
 
+	if err := checkStatus("openweathermap", resp); err != nil {
+		return Conditions{}, err
+	}
+
 	var d struct {
+		Dt   int64 `json:"dt"` // Unix time of the observation
 		Main struct {
-			Kelvin float64 `json:"temp"`
+			Kelvin    *float64 `json:"temp"`
+			FeelsLike *float64 `json:"feels_like"`
+			Humidity  *float64 `json:"humidity"`
+			Pressure  *float64 `json:"pressure"` // hPa
 		} `json:"main"`
+		Wind struct {
+			Speed *float64 `json:"speed"` // m/s
+			Deg   *float64 `json:"deg"`
+		} `json:"wind"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+		return Conditions{}, malformedResponse("openweathermap", err)
+	}
+	if d.Main.Kelvin == nil {
+		return Conditions{}, errors.New("openweathermap: response has no temperature")
+	}
+	if _, err := rawTemperature("openweathermap", *d.Main.Kelvin, unitKelvin); err != nil {
+		return Conditions{}, err
 	}
 
-	log.Printf("openWeatherMap: %s: %.2f", city, d.Main.Kelvin)
-	return d.Main.Kelvin, nil
+	logf(ctx, "openWeatherMap: %s: %.2f", city, *d.Main.Kelvin)
+	return Conditions{
+		TempKelvin:            *d.Main.Kelvin,
+		HumidityPercent:       d.Main.Humidity,
+		WindSpeedMetersPerSec: d.Wind.Speed,
+		WindDirectionDegrees:  d.Wind.Deg,
+		ApparentTempKelvin:    d.Main.FeelsLike,
+		PressureHPa:           d.Main.Pressure,
+		ObservedAt:            unixTime(d.Dt),
+	}, nil
 }
 
 type weatherUnderground struct {
-	apiKey string
-	client *http.Client
+	apiKey  string
+	client  *http.Client
+	baseURL string // defaults to defaultWeatherUndergroundURL
+}
+
+const defaultWeatherUndergroundURL = "http://api.wunderground.com"
+
+// buildURL returns the URL to look up the current conditions in city.
+func (w weatherUnderground) buildURL(ctx context.Context, city string) string {
+	return orDefault(w.baseURL, defaultWeatherUndergroundURL) + "/api/" + w.apiKey + "/conditions/q/" + url.PathEscape(city) + ".json"
+}
+
+func (w weatherUnderground) secret() string {
+	return w.apiKey
 }
 
-func (w weatherUnderground) temperature(city string) (float64, error) {
-	resp, err := w.client.Get("http://api.wunderground.com/api/" + w.apiKey + "/conditions/q/" + city + ".json")
+func (w weatherUnderground) name() string {
+	return "weatherUnderground"
+}
+
+func (w weatherUnderground) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := w.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (w weatherUnderground) conditions(ctx context.Context, city string) (Conditions, error) {
+	if city == "" {
+		return Conditions{}, errCityRequired
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", w.buildURL(ctx, city), nil)
 	if err != nil {
-		return 0, err
+		return Conditions{}, err
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return Conditions{}, err
 	}
 
 	defer resp.Body.Close()
 
+	if err := checkStatus("wunderground", resp); err != nil {
+		return Conditions{}, err
+	}
+
 	var d struct {
 		Observation struct {
-			Celsius float64 `json:"temp_c"`
+			Celsius  *float64 `json:"temp_c"`
+			Humidity string   `json:"relative_humidity"` // like "65%"
+			Pressure string   `json:"pressure_mb"`
+			Epoch    string   `json:"observation_epoch"` // Unix time
+			WindKph  *float64 `json:"wind_kph"`
+			WindDeg  *float64 `json:"wind_degrees"`
 		} `json:"current_observation"`
 	}
 
 	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+		return Conditions{}, malformedResponse("wunderground", err)
+	}
+	if d.Observation.Celsius == nil {
+		return Conditions{}, errors.New("wunderground: response has no temperature")
+	}
+
+	t, err := rawTemperature("wunderground", *d.Observation.Celsius, unitCelsius)
+	if err != nil {
+		return Conditions{}, err
+	}
+	c := Conditions{TempKelvin: t.Kelvin()}
+	if h, err := strconv.ParseFloat(strings.TrimSuffix(d.Observation.Humidity, "%"), 64); err == nil {
+		c.HumidityPercent = &h
+	}
+	if d.Observation.WindKph != nil {
+		ms := *d.Observation.WindKph / 3.6
+		c.WindSpeedMetersPerSec = &ms
+	}
+	c.WindDirectionDegrees = d.Observation.WindDeg
+	if p, err := strconv.ParseFloat(d.Observation.Pressure, 64); err == nil {
+		c.PressureHPa = &p
+	}
+	if t, err := strconv.ParseInt(d.Observation.Epoch, 10, 64); err == nil {
+		c.ObservedAt = unixTime(t)
 	}
 
-	kelvin := d.Observation.Celsius + 273.15
-	log.Printf("weatherUnderground: %s: %.2f", city, kelvin)
-	return kelvin, nil
+	logf(ctx, "weatherUnderground: %s: %.2f", city, c.TempKelvin)
+	return c, nil
 }
 
 type forecastIo struct {
 	apiKey string
 	geoCode
-	client *http.Client
+	client  *http.Client
+	baseURL string // defaults to defaultForecastIoURL
 }
 
+const defaultForecastIoURL = "https://api.forecast.io"
+
 func NewForecastIo(apiKey string, gc geoCode, c *http.Client) *forecastIo {
 	return &forecastIo{apiKey: apiKey, geoCode: gc, client: c}
 }
 
-func (f forecastIo) temperature(city string) (float64, error) {
+// buildURL returns the URL to look up the current conditions at the
+// coordinates in ctx. Without any, the city has to be geocoded first, and
+// the URL has placeholders for them.
+func (f forecastIo) buildURL(ctx context.Context, city string) string {
+	coords := "{lat},{lng}"
+	if l, ok := coordinatesFrom(ctx); ok {
+		coords = strconv.FormatFloat(l.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(l.Lng, 'f', -1, 64)
+	}
+	return orDefault(f.baseURL, defaultForecastIoURL) + "/forecast/" + f.apiKey + "/" + coords
+}
+
+func (f forecastIo) secret() string {
+	return f.apiKey
+}
 
-	l, err := f.geoCode.findCityLocation(city)
+func (f forecastIo) name() string {
+	return "forecastIo"
+}
+
+func (f forecastIo) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := f.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (f forecastIo) conditions(ctx context.Context, city string) (Conditions, error) {
+	l, err := locate(ctx, "forecastio", f.geoCode, city)
 	if err != nil {
-		return 0, err
+		return Conditions{}, err
 	}
+	recordLocation(ctx, l)
 
-	lookupUrl := "https://api.forecast.io/forecast/" + f.apiKey + "/" + strconv.FormatFloat(l.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(l.Lng, 'f', -1, 64)
+	req, err := http.NewRequestWithContext(ctx, "GET", f.buildURL(withCoordinates(ctx, l), city), nil)
+	if err != nil {
+		return Conditions{}, err
+	}
 
-	resp, err := f.client.Get(lookupUrl)
+	resp, err := f.client.Do(req)
 	if err != nil {
-		return 0, err
+		return Conditions{}, err
 	}
 	defer resp.Body.Close()
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
+	if err := checkStatus("forecastio", resp); err != nil {
+		return Conditions{}, err
 	}
 
-	var rawmap map[string]*json.RawMessage
-	err = json.Unmarshal(b, &rawmap)
+	var d struct {
+		Currently struct {
+			Time                int64    `json:"time"`        // Unix time
+			Temperature         *float64 `json:"temperature"` // °F
+			ApparentTemperature *float64 `json:"apparentTemperature"`
+			Humidity            *float64 `json:"humidity"`  // as a fraction
+			WindSpeed           *float64 `json:"windSpeed"` // mph
+			WindBearing         *float64 `json:"windBearing"`
+			UVIndex             *float64 `json:"uvIndex"`
+			Pressure            *float64 `json:"pressure"` // hPa
+		} `json:"currently"`
+		Flags struct {
+			Units string `json:"units"`
+		} `json:"flags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return Conditions{}, malformedResponse("forecastio", err)
+	}
+	cur := d.Currently
+	if cur.Temperature == nil {
+		return Conditions{}, errors.New("forecastio: response has no current temperature")
+	}
+	// Everything below assumes US units, the default.
+	if u := d.Flags.Units; u != "" && u != "us" {
+		return Conditions{}, fmt.Errorf("forecastio: response is in %q units, expected us", u)
+	}
+	t, err := rawTemperature("forecastio", *cur.Temperature, unitFahrenheit)
 	if err != nil {
-		return 0, err
+		return Conditions{}, err
+	}
+
+	c := Conditions{
+		TempKelvin:           t.Kelvin(),
+		WindDirectionDegrees: cur.WindBearing,
+		UVIndex:              cur.UVIndex,
+		PressureHPa:          cur.Pressure,
+		ObservedAt:           unixTime(cur.Time),
+	}
+	if cur.Humidity != nil {
+		h := *cur.Humidity * 100
+		c.HumidityPercent = &h
+	}
+	if cur.WindSpeed != nil {
+		ms := *cur.WindSpeed * 0.44704
+		c.WindSpeedMetersPerSec = &ms
+	}
+	if cur.ApparentTemperature != nil {
+		k := FromFahrenheit(*cur.ApparentTemperature).Kelvin()
+		c.ApparentTempKelvin = &k
 	}
 
-	var current map[string]*json.RawMessage
-	err = json.Unmarshal(*rawmap["currently"], &current)
+	logf(ctx, "forecastIo: %s: %.2f", city, c.TempKelvin)
+
+	return c, nil
+
+}
+
+type location struct {
+	Lat float64 `json:"lat" xml:"lat"`
+	Lng float64 `json:"lng" xml:"lng"`
+}
+
+// valid reports whether l is a place on Earth, and not 0,0. Geocoders
+// sometimes answer with 0,0, out in the Gulf of Guinea, for places they
+// couldn't find.
+func (l location) valid() bool {
+	if l.Lat == 0 && l.Lng == 0 {
+		return false
+	}
+	return l.Lat >= -90 && l.Lat <= 90 && l.Lng >= -180 && l.Lng <= 180
+}
+
+// locate returns the coordinates in ctx, or else where gc geocodes city to,
+// for providers that only take coordinates. Coordinates the user gave are
+// taken as they are, even 0,0, but a geocoded 0,0 is taken to mean the city
+// wasn't found.
+func locate(ctx context.Context, provider string, gc geoCode, city string) (location, error) {
+	if l, ok := coordinatesFrom(ctx); ok {
+		return l, nil
+	}
+	l, err := gc.findCityLocation(ctx, city, countryFrom(ctx))
 	if err != nil {
-		return 0, err
+		return location{}, err
 	}
+	if !l.valid() {
+		return location{}, fmt.Errorf("%s: %w: %s geocoded to %v,%v", provider, errCityNotFound, city, l.Lat, l.Lng)
+	}
+	return l, nil
+}
+
+// errCityRequired is returned by providers that can only look up the weather
+// by city name when they are given coordinates alone.
+var errCityRequired = errors.New("provider needs a city name")
+
+// Errors returned, wrapped, by providers and geocoders, saying why a lookup
+// failed so that it can be reported to the client with the right status.
+var (
+	// errCityNotFound means the city asked about isn't known.
+	errCityNotFound = errors.New("city not found")
+
+	// errUpstreamRateLimited means an upstream API is refusing requests
+	// because we've made too many.
+	errUpstreamRateLimited = errors.New("rate limited by upstream")
+
+	// errUpstreamUnavailable means an upstream API failed or couldn't be
+	// reached.
+	errUpstreamUnavailable = errors.New("upstream unavailable")
+)
 
-	var temp float64
-	json.Unmarshal(*current["temperature"], &temp)
-	tempInKelvin := ((temp - 32) / 1.8) + 273.15
+// errTooFewReadings is returned when fewer providers answered than a
+// multiWeatherProvider's minProviders.
+var errTooFewReadings = errors.New("too few weather providers answered")
 
-	log.Printf("forecastIo: %s: %.2f", city, tempInKelvin)
+// errSoftDeadline stands in for the reading of a provider that didn't reply
+// before the soft deadline.
+var errSoftDeadline = errors.New("no reply before the soft deadline")
 
-	return tempInKelvin, nil
+type countryKey struct{}
 
+// withCountry returns a context asking providers and geocoders to only
+// consider cities in country, an ISO 3166 alpha-2 code.
+func withCountry(ctx context.Context, country string) context.Context {
+	return context.WithValue(ctx, countryKey{}, country)
 }
 
-type location struct {
-	Lat float64 `json: "lat"`
-	Lng float64 `json: "lng"`
+// countryFrom returns the country stored in ctx by withCountry, or "".
+func countryFrom(ctx context.Context) string {
+	cc, _ := ctx.Value(countryKey{}).(string)
+	return cc
+}
+
+// parseCountry validates and normalizes an ISO 3166 alpha-2 country code.
+func parseCountry(cc string) (string, error) {
+	if len(cc) != 2 || !isLetter(cc[0]) || !isLetter(cc[1]) {
+		return "", fmt.Errorf("invalid country %q, expected a two-letter ISO 3166 code", cc)
+	}
+	return strings.ToUpper(cc), nil
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// withCountryCode qualifies city with a country code, as "city,CC", for
+// APIs that accept that form.
+func withCountryCode(city, country string) string {
+	return city + prefix(",", country)
+}
+
+// isZipCode reports whether s looks like a five digit US ZIP code rather
+// than a city name.
+func isZipCode(s string) bool {
+	if len(s) != 5 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// zipCountry returns the country to look up a ZIP code in: country if one
+// was given, since other countries have five digit postcodes too, and
+// otherwise the US.
+func zipCountry(country string) string {
+	return orDefault(country, "US")
 }
 
+// openWeatherMapQuery returns the query parameter OpenWeatherMap's APIs take
+// for city: a ZIP code as zip=ZIP,CC, otherwise a name as q=city,CC.
+func openWeatherMapQuery(city, country string) string {
+	if isZipCode(city) {
+		return "zip=" + url.QueryEscape(city+","+strings.ToLower(zipCountry(country)))
+	}
+	// OpenWeatherMap wants the parts of a qualified name without spaces, as
+	// in "london,ontario,canada".
+	return "q=" + url.QueryEscape(strings.ReplaceAll(withCountryCode(city, country), ", ", ","))
+}
+
+// normalizeCity puts a city name in a canonical form, trimmed, lower case and
+// with runs of whitespace inside it collapsed to single spaces, so that
+// "New  York " and "new york" are looked up, cached and logged the same.
+// Names qualified with a region or country, like "London, Ontario, Canada",
+// keep their commas, each followed by a single space.
+// It is not escaped; callers still need to do that when building URLs.
+func normalizeCity(city string) string {
+	var parts []string
+	for _, part := range strings.Split(city, ",") {
+		if part = strings.Join(strings.Fields(part), " "); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.ToLower(strings.Join(parts, ", "))
+}
+
+// orDefault returns s, or def if s is empty.
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// prefix returns p+s, or "" if s is empty.
+func prefix(p, s string) string {
+	if s == "" {
+		return ""
+	}
+	return p + s
+}
+
+type coordinatesKey struct{}
+
+// withCoordinates returns a context asking providers that support it to look
+// up the weather at l rather than geocoding the city name.
+func withCoordinates(ctx context.Context, l location) context.Context {
+	return context.WithValue(ctx, coordinatesKey{}, l)
+}
+
+// coordinatesFrom returns the coordinates stored in ctx by withCoordinates.
+func coordinatesFrom(ctx context.Context) (location, bool) {
+	l, ok := ctx.Value(coordinatesKey{}).(location)
+	return l, ok
+}
+
+// parseLocation parses and range-checks a latitude and longitude.
+func parseLocation(lat, lng string) (location, error) {
+	var l location
+	var err error
+	if l.Lat, err = strconv.ParseFloat(lat, 64); err != nil || l.Lat < -90 || l.Lat > 90 {
+		return location{}, fmt.Errorf("invalid latitude %q", lat)
+	}
+	if l.Lng, err = strconv.ParseFloat(lng, 64); err != nil || l.Lng < -180 || l.Lng > 180 {
+		return location{}, fmt.Errorf("invalid longitude %q", lng)
+	}
+	return l, nil
+}
+
+type locationRecorderKey struct{}
+
+// withLocationRecorder returns a context that lets a provider report the
+// location it geocoded city to, by storing it in *l.
+func withLocationRecorder(ctx context.Context, l **location) context.Context {
+	return context.WithValue(ctx, locationRecorderKey{}, l)
+}
+
+// recordLocation reports l to the recorder in ctx, if there is one.
+func recordLocation(ctx context.Context, l location) {
+	if p, ok := ctx.Value(locationRecorderKey{}).(**location); ok {
+		*p = &l
+	}
+}
+
+// geoCode finds where a city is. If country is not empty it is an ISO 3166
+// alpha-2 code that the city must be in.
 type geoCode interface {
-	findCityLocation(city string) (location, error)
+	findCityLocation(ctx context.Context, city, country string) (location, error)
 }
 
-type googleGeoCode struct{}
+// reverseGeoCode finds the city at a location, so that providers that only
+// take city names can answer coordinate queries.
+type reverseGeoCode interface {
+	findCityName(ctx context.Context, l location) (string, error)
+}
 
-func (g googleGeoCode) findCityLocation(city string) (location, error) {
+type googleGeoCode struct {
+	apiKey  string
+	client  *http.Client
+	baseURL string // defaults to defaultGoogleGeoCodeURL
+}
 
-	resp, err := http.Get("https://maps.googleapis.com/maps/api/geocode/json?address=" + city + "&components=country")
-	defer resp.Body.Close()
+const defaultGoogleGeoCodeURL = "https://maps.googleapis.com"
 
-	b, err := ioutil.ReadAll(resp.Body)
+func (g googleGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	q := url.Values{"address": {city}}
+	switch {
+	case isZipCode(city):
+		q.Set("components", "postal_code:"+city+"|country:"+zipCountry(country))
+	case country != "":
+		q.Set("components", "country:"+country)
+	}
+	req, err := g.newRequest(ctx, q)
 	if err != nil {
 		return location{}, err
 	}
 
-	var rawmap map[string]*json.RawMessage
-	err = json.Unmarshal(b, &rawmap)
+	resp, err := g.client.Do(req)
 	if err != nil {
 		return location{}, err
 	}
+	defer resp.Body.Close()
 
-	var results []*json.RawMessage
-	err = json.Unmarshal(*rawmap["results"], &results)
-	if err != nil {
+	if err := checkStatus("google geocode", resp); err != nil {
 		return location{}, err
 	}
 
-	var result map[string]*json.RawMessage
-	err = json.Unmarshal(*results[0], &result)
-	if err != nil {
-		return location{}, err
+	var d struct {
+		Results []*struct {
+			Geometry *struct {
+				Location *location `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return location{}, malformedResponse("google geocode", err)
+	}
+	if len(d.Results) == 0 || d.Results[0] == nil {
+		return location{}, fmt.Errorf("google geocode: %w: %s", errCityNotFound, city)
 	}
+	geo := d.Results[0].Geometry
+	if geo == nil || geo.Location == nil {
+		return location{}, malformedResponse("google geocode", errors.New("result has no location"))
+	}
+	return *geo.Location, nil
+}
+
+// newRequest returns a request to the geocoding API with the query q, and
+// the API key if there is one.
+func (g googleGeoCode) newRequest(ctx context.Context, q url.Values) (*http.Request, error) {
+	if g.apiKey != "" {
+		q.Set("key", g.apiKey)
+	}
+	return http.NewRequestWithContext(ctx, "GET", orDefault(g.baseURL, defaultGoogleGeoCodeURL)+"/maps/api/geocode/json?"+q.Encode(), nil)
+}
 
-	var geometry map[string]*json.RawMessage
-	err = json.Unmarshal(*result["geometry"], &geometry)
+// findCityName returns the name of the locality at l.
+func (g googleGeoCode) findCityName(ctx context.Context, l location) (string, error) {
+	req, err := g.newRequest(ctx, url.Values{
+		"result_type": {"locality"},
+		"latlng":      {strconv.FormatFloat(l.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(l.Lng, 'f', -1, 64)},
+	})
 	if err != nil {
-		return location{}, err
+		return "", err
 	}
 
-	var l location
-	err = json.Unmarshal(*geometry["location"], &l)
+	resp, err := g.client.Do(req)
 	if err != nil {
-		return location{}, err
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("google geocode", resp); err != nil {
+		return "", err
 	}
 
-	return l, nil
+	var d struct {
+		Results []struct {
+			AddressComponents []struct {
+				LongName string   `json:"long_name"`
+				Types    []string `json:"types"`
+			} `json:"address_components"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return "", err
+	}
 
+	for _, r := range d.Results {
+		for _, c := range r.AddressComponents {
+			for _, t := range c.Types {
+				if t == "locality" {
+					return c.LongName, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("google geocode: no city at %v,%v", l.Lat, l.Lng)
 }
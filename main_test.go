@@ -1,31 +1,1250 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testFastWeatherProvider struct {
 }
 
-func (t testFastWeatherProvider) temperature(city string) (float64, error) {
+func (t testFastWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
 	return 290, nil
 }
 
 type testSlowWeatherProvider struct {
 }
 
-func (t testSlowWeatherProvider) temperature(city string) (float64, error) {
+func (t testSlowWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
 	return 280, nil
 }
 
+type testFailingWeatherProvider struct {
+	err error
+}
+
+func (t testFailingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return 0, t.err
+}
+
 func TestMultiTemperature(t *testing.T) {
 	w := multiWeatherProvider{
-		testSlowWeatherProvider{},
-		testFastWeatherProvider{},
+		providers: []weatherProvider{
+			testSlowWeatherProvider{},
+			testFastWeatherProvider{},
+		},
 	}
 
-	avgTemp, err := w.temperature("new york")
+	avgTemp, err := w.temperature(context.Background(), "new york")
 	if err != nil || 285 != avgTemp {
 		t.Fail()
 	}
 }
+
+func TestMultiTemperatureBestEffort(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testSlowWeatherProvider{},
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+			testFastWeatherProvider{},
+		},
+	}
+
+	avgTemp, err := w.temperature(context.Background(), "new york")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if avgTemp != 285 {
+		t.Errorf("got %v, want 285", avgTemp)
+	}
+}
+
+func TestMultiTemperatureStrict(t *testing.T) {
+	failure := errors.New("wunderground: 500")
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testSlowWeatherProvider{},
+			testFailingWeatherProvider{failure},
+			testFastWeatherProvider{},
+		},
+		strict: true,
+	}
+
+	if _, err := w.temperature(context.Background(), "new york"); !errors.Is(err, failure) {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+}
+
+func TestMultiTemperatureAllFailed(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testFailingWeatherProvider{errors.New("openweathermap: 401")},
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+		},
+	}
+
+	_, err := w.temperature(context.Background(), "new york")
+	if err == nil {
+		t.Fatal("expected an error when every provider fails")
+	}
+	for _, msg := range []string{"openweathermap: 401", "wunderground: 500"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q does not mention %q", err, msg)
+		}
+	}
+}
+
+type testBlockingWeatherProvider struct {
+	cancelled chan struct{}
+}
+
+func (t testBlockingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	<-ctx.Done()
+	close(t.cancelled)
+	return 0, ctx.Err()
+}
+
+func TestMultiTemperatureCancelsRemainingProviders(t *testing.T) {
+	blocking := testBlockingWeatherProvider{cancelled: make(chan struct{})}
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			blocking,
+			testFailingWeatherProvider{errors.New("wunderground: 500")},
+		},
+		strict: true,
+	}
+
+	if _, err := w.temperature(context.Background(), "new york"); err == nil {
+		t.Fatal("expected an error in strict mode")
+	}
+
+	select {
+	case <-blocking.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("blocking provider was not cancelled")
+	}
+}
+
+// testSleepyWeatherProvider replies after d, unless cancelled first.
+type testSleepyWeatherProvider struct {
+	d time.Duration
+}
+
+func (t testSleepyWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	select {
+	case <-time.After(t.d):
+		return 300, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestMultiTemperatureSoftDeadline(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testFastWeatherProvider{},
+			testSleepyWeatherProvider{d: time.Minute},
+		},
+		softDeadline: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("took %v, want about the soft deadline", took)
+	}
+	if !errors.Is(readings[1].Err, errSoftDeadline) {
+		t.Errorf("got %v for the slow provider, want %v", readings[1].Err, errSoftDeadline)
+	}
+	if temp := w.aggregate(readings); temp != 290 {
+		t.Errorf("got %v, want 290", temp)
+	}
+}
+
+func TestMultiTemperatureSoftDeadlineNoReadings(t *testing.T) {
+	w := multiWeatherProvider{
+		providers:    []weatherProvider{testSleepyWeatherProvider{d: time.Minute}},
+		softDeadline: 10 * time.Millisecond,
+	}
+
+	_, err := w.temperature(context.Background(), "london")
+	if !errors.Is(err, errSoftDeadline) {
+		t.Errorf("got %v, want %v", err, errSoftDeadline)
+	}
+}
+
+func TestMultiTemperatureMinProviders(t *testing.T) {
+	failure := errors.New("wunderground: 500")
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testFailingWeatherProvider{failure},
+			testFastWeatherProvider{},
+			testFailingWeatherProvider{errors.New("openweathermap: 401")},
+		},
+		minProviders: 2,
+	}
+
+	_, err := w.temperature(context.Background(), "london")
+	if !errors.Is(err, errTooFewReadings) || !errors.Is(err, failure) {
+		t.Errorf("got %v, want %v wrapping the failures", err, errTooFewReadings)
+	}
+
+	w.minProviders = 1
+	if temp, err := w.temperature(context.Background(), "london"); err != nil || temp != 290 {
+		t.Errorf("got %v, %v with one provider needed, want 290", temp, err)
+	}
+}
+
+func TestMultiTemperatureProviderErrors(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			openWeatherMap{apiKey: "key", baseURL: "http://owm.test", client: cannedClient(t, map[string]cannedResponse{
+				"http://owm.test/data/2.5/weather?q=london&appid=key": {status: http.StatusUnauthorized},
+			})},
+			weatherUnderground{apiKey: "key", baseURL: "http://wu.test", client: cannedClient(t, map[string]cannedResponse{
+				"http://wu.test/api/key/conditions/q/london.json": {status: http.StatusInternalServerError},
+			})},
+		},
+	}
+
+	_, err := w.temperature(context.Background(), "london")
+	var pe *ProviderError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got %v, want a ProviderError", err)
+	}
+
+	// Every provider's failure is in there, each under its own name.
+	joined, ok := errors.Unwrap(err).(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("got %v, want the failures joined", err)
+	}
+	got := map[string]bool{}
+	for _, e := range joined.Unwrap() {
+		if errors.As(e, &pe) {
+			got[pe.Provider] = true
+		}
+	}
+	if len(got) != 2 || !got["openWeatherMap"] || !got["weatherUnderground"] {
+		t.Errorf("got failures from %v, want openWeatherMap and weatherUnderground", got)
+	}
+
+	w.strict = true
+	if _, err := w.temperature(context.Background(), "london"); !errors.As(err, &pe) || pe.Provider == "" {
+		t.Errorf("got %v in strict mode, want a ProviderError", err)
+	}
+}
+
+func TestProviderErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  ProviderError
+		want string
+	}{
+		{ProviderError{"forecastIo", errors.New("no such host")}, "forecastIo: no such host"},
+		{ProviderError{"openWeatherMap", statusError{"openweathermap", 401}}, "openweathermap: unexpected status 401"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestMultiTemperatures(t *testing.T) {
+	failure := errors.New("wunderground: 500")
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			testSlowWeatherProvider{},
+			testFailingWeatherProvider{failure},
+			openWeatherMapStub{},
+		},
+	}
+
+	readings, err := w.temperatures(context.Background(), "new york")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(readings) != 3 {
+		t.Fatalf("got %d readings, want 3", len(readings))
+	}
+	if readings[0].TempKelvin != 280 || readings[0].Err != nil {
+		t.Errorf("unexpected first reading: %+v", readings[0])
+	}
+	if readings[1].Err != failure {
+		t.Errorf("got error %v, want %v", readings[1].Err, failure)
+	}
+	if readings[2].Name != "openWeatherMap" {
+		t.Errorf("got name %q, want openWeatherMap", readings[2].Name)
+	}
+}
+
+type openWeatherMapStub struct{}
+
+func (openWeatherMapStub) name() string { return "openWeatherMap" }
+
+func (openWeatherMapStub) temperature(ctx context.Context, city string) (Temperature, error) {
+	return 290.1, nil
+}
+
+func TestProviderReadingJSON(t *testing.T) {
+	tests := []struct {
+		reading ProviderReading
+		want    string
+	}{
+		{ProviderReading{Name: "openWeatherMap", Conditions: Conditions{TempKelvin: 290.1}}, `{"name":"openWeatherMap","tempKelvin":290.1,"error":null}`},
+		{ProviderReading{Name: "forecastIo", Err: errors.New("boom")}, `{"name":"forecastIo","tempKelvin":null,"error":"boom"}`},
+	}
+
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.reading)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("got %s, want %s", b, tt.want)
+		}
+	}
+}
+
+// roundTripFunc lets tests intercept the requests a provider makes.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// recordingMu guards the slices written by recordingClient, which may be
+// shared by clients used concurrently.
+var recordingMu sync.Mutex
+
+// recordingClient returns a client that records the URL of every request
+// and answers it with body.
+func recordingClient(urls *[]string, body string) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		recordingMu.Lock()
+		*urls = append(*urls, r.URL.String())
+		recordingMu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Header:     make(http.Header),
+		}, nil
+	})}
+}
+
+func TestProvidersEscapeCity(t *testing.T) {
+	tests := []struct {
+		provider func(c *http.Client) weatherProvider
+		want     string
+	}{
+		{
+			func(c *http.Client) weatherProvider { return openWeatherMap{client: c} },
+			"http://api.openweathermap.org/data/2.5/weather?q=new+york+%26+co",
+		},
+		{
+			func(c *http.Client) weatherProvider { return weatherUnderground{client: c, apiKey: "key"} },
+			"http://api.wunderground.com/api/key/conditions/q/new%20york%20&%20co.json",
+		},
+	}
+
+	for _, tt := range tests {
+		var urls []string
+		p := tt.provider(recordingClient(&urls, `{"main":{"temp":290},"current_observation":{"temp_c":17}}`))
+		if _, err := p.temperature(context.Background(), "new york & co"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(urls) != 1 || urls[0] != tt.want {
+			t.Errorf("got %v, want [%s]", urls, tt.want)
+		}
+	}
+}
+
+// serverClient returns a client that sends every request to srv, whatever
+// host the provider asked for.
+func serverClient(srv *httptest.Server) *http.Client {
+	target, _ := url.Parse(srv.URL)
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme = target.Scheme
+		r.URL.Host = target.Host
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+}
+
+// cannedResponse is what cannedClient answers a request for one URL with.
+type cannedResponse struct {
+	status int // defaults to 200
+	body   string
+}
+
+// cannedClient returns a client that answers each request with the response
+// for its URL, without touching the network. Requests for any other URL fail
+// the test.
+func cannedClient(t *testing.T, responses map[string]cannedResponse) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		canned, ok := responses[r.URL.String()]
+		if !ok {
+			t.Errorf("unexpected request for %s", r.URL)
+			canned = cannedResponse{status: http.StatusNotFound}
+		}
+		if canned.status == 0 {
+			canned.status = http.StatusOK
+		}
+		return &http.Response{
+			StatusCode: canned.status,
+			Body:       io.NopCloser(strings.NewReader(canned.body)),
+			Header:     make(http.Header),
+			Request:    r,
+		}, nil
+	})}
+}
+
+func TestOpenWeatherMapConditions(t *testing.T) {
+	p := openWeatherMap{apiKey: "key", baseURL: "http://owm.test", client: cannedClient(t, map[string]cannedResponse{
+		"http://owm.test/data/2.5/weather?q=london%2CGB&appid=key": {body: `{
+			"dt":1447797600,
+			"main":{"temp":288.15,"feels_like":287,"humidity":72,"pressure":1012},
+			"wind":{"speed":4.1,"deg":230}
+		}`},
+		"http://owm.test/data/2.5/weather?q=atlantis&appid=key": {status: http.StatusNotFound, body: `{"cod":"404","message":"city not found"}`},
+	})}
+
+	c, err := p.conditions(withCountry(context.Background(), "GB"), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.TempKelvin != 288.15 || *c.ApparentTempKelvin != 287 || *c.HumidityPercent != 72 ||
+		*c.WindSpeedMetersPerSec != 4.1 || *c.WindDirectionDegrees != 230 || *c.PressureHPa != 1012 ||
+		!c.ObservedAt.Equal(time.Unix(1447797600, 0)) {
+		t.Errorf("got %+v", c)
+	}
+
+	if _, err := p.conditions(context.Background(), "atlantis"); !errors.Is(err, errCityNotFound) {
+		t.Errorf("got %v, want %v", err, errCityNotFound)
+	}
+}
+
+func TestWeatherUndergroundConditions(t *testing.T) {
+	p := weatherUnderground{apiKey: "key", baseURL: "http://wu.test", client: cannedClient(t, map[string]cannedResponse{
+		"http://wu.test/api/key/conditions/q/new%20york.json": {body: `{"current_observation":{
+			"temp_c":20,"relative_humidity":"65%","wind_kph":18,"wind_degrees":90,"pressure_mb":"1009",
+			"observation_epoch":"1447796400"
+		}}`},
+	})}
+
+	c, err := p.conditions(context.Background(), "new york")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(c.TempKelvin-293.15) > 1e-9 || *c.HumidityPercent != 65 ||
+		math.Abs(*c.WindSpeedMetersPerSec-5) > 1e-9 || *c.WindDirectionDegrees != 90 || *c.PressureHPa != 1009 ||
+		!c.ObservedAt.Equal(time.Unix(1447796400, 0)) {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestForecastIoConditions(t *testing.T) {
+	f := forecastIo{
+		apiKey:  "key",
+		baseURL: "http://fio.test",
+		geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}},
+		client: cannedClient(t, map[string]cannedResponse{
+			"http://fio.test/forecast/key/51.5,-0.12": {body: `{"currently":{
+				"time":1447798200,"temperature":50,"apparentTemperature":41,"humidity":0.8,"windSpeed":10,"windBearing":270,"uvIndex":3
+			}}`},
+		}),
+	}
+
+	c, err := f.conditions(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(c.TempKelvin-283.15) > 1e-9 || math.Abs(*c.ApparentTempKelvin-278.15) > 1e-9 ||
+		math.Abs(*c.HumidityPercent-80) > 1e-9 || math.Abs(*c.WindSpeedMetersPerSec-4.4704) > 1e-9 ||
+		*c.WindDirectionDegrees != 270 || c.UVIndex == nil || *c.UVIndex != 3 ||
+		!c.ObservedAt.Equal(time.Unix(1447798200, 0)) {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestForecastIoUnits(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"currently":{"temperature":59},"flags":{"units":"us"}}`, true},
+		{`{"currently":{"temperature":59}}`, true},
+		// Celsius, flagged as such.
+		{`{"currently":{"temperature":15},"flags":{"units":"si"}}`, false},
+		// Kelvin, which would come out at 142°C.
+		{`{"currently":{"temperature":288.15}}`, false},
+	}
+
+	for _, tt := range tests {
+		f := forecastIo{client: recordingClient(new([]string), tt.body), geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+		_, err := f.conditions(context.Background(), "london")
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.body, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: expected an error", tt.body)
+		}
+	}
+}
+
+// An unflagged reading in °C can't be told from a cold day in °F by
+// forecastIo alone, so it is left to outlier rejection, which needs enough
+// other providers agreeing to pick it out.
+func TestUnflaggedCelsiusIsAnOutlier(t *testing.T) {
+	f := forecastIo{client: recordingClient(new([]string), `{"currently":{"temperature":15}}`), geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			f,
+			testConstantWeatherProvider(288.15),
+			testConstantWeatherProvider(288.15),
+			testConstantWeatherProvider(288.15),
+			testConstantWeatherProvider(288.15),
+		},
+		outlierK: 1.5,
+	}
+
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, sources := w.combine(readings); k != 288.15 || len(sources) != 4 {
+		t.Errorf("got %v from %v, want 288.15 without forecastIo", k, sources)
+	}
+}
+
+type testGeoCode struct {
+	l   location
+	err error
+}
+
+func (g testGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	return g.l, g.err
+}
+
+func TestProvidersReportUnexpectedStatus(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusNotFound} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"message":"nope"}`, code)
+		}))
+		c := serverClient(srv)
+
+		providers := map[string]weatherProvider{
+			"openweathermap": openWeatherMap{client: c},
+			"wunderground":   weatherUnderground{client: c},
+			"forecastio":     forecastIo{client: c, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}},
+		}
+
+		for name, p := range providers {
+			_, err := p.temperature(context.Background(), "london")
+			var se statusError
+			if !errors.As(err, &se) || se.code != code || se.provider != name {
+				t.Errorf("%s: got %v, want %s status %d", name, err, name, code)
+			}
+		}
+
+		srv.Close()
+	}
+}
+
+func TestProvidersRejectMalformedResponses(t *testing.T) {
+	bodies := []string{
+		"",
+		`{"main":{"temp":29`,
+		"<html><body>Service Unavailable</body></html>",
+		"{}",
+		`{"currently":{}}`,
+	}
+	for _, body := range bodies {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+		c := serverClient(srv)
+
+		providers := map[string]weatherProvider{
+			"openweathermap": openWeatherMap{client: c},
+			"wunderground":   weatherUnderground{client: c},
+			"forecastio":     forecastIo{client: c, geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}},
+			"accuweather":    accuWeather{client: c},
+		}
+
+		for name, p := range providers {
+			_, err := p.temperature(context.Background(), "london")
+			if err == nil || !strings.HasPrefix(err.Error(), name+": ") {
+				t.Errorf("%s, body %q: got %v, want a %s error", name, body, err, name)
+			}
+		}
+
+		srv.Close()
+	}
+}
+
+func TestIsZipCode(t *testing.T) {
+	for s, want := range map[string]bool{
+		"10001":    true,
+		"02134":    true,
+		"1000":     false,
+		"100011":   false,
+		"london":   false,
+		"1000a":    false,
+		"new york": false,
+	} {
+		if got := isZipCode(s); got != want {
+			t.Errorf("isZipCode(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+func TestOpenWeatherMapZipCode(t *testing.T) {
+	tests := []struct {
+		city, country, want string
+	}{
+		{"10001", "", "http://api.openweathermap.org/data/2.5/weather?zip=10001%2Cus"},
+		{"75001", "FR", "http://api.openweathermap.org/data/2.5/weather?zip=75001%2Cfr"},
+		{"london", "", "http://api.openweathermap.org/data/2.5/weather?q=london"},
+	}
+
+	for _, tt := range tests {
+		var urls []string
+		p := openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}
+		if _, err := p.temperature(withCountry(context.Background(), tt.country), tt.city); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(urls) != 1 || urls[0] != tt.want {
+			t.Errorf("%s: got %v, want [%s]", tt.city, urls, tt.want)
+		}
+	}
+}
+
+func TestGoogleGeoCodeZipCode(t *testing.T) {
+	var urls []string
+	g := googleGeoCode{client: recordingClient(&urls, `{"results":[{"geometry":{"location":{"lat":40.75,"lng":-73.99}}}],"status":"OK"}`)}
+
+	if _, err := g.findCityLocation(context.Background(), "10001", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "https://maps.googleapis.com/maps/api/geocode/json?address=10001&components=postal_code%3A10001%7Ccountry%3AUS"; len(urls) != 1 || urls[0] != want {
+		t.Errorf("got %v, want [%s]", urls, want)
+	}
+}
+
+func TestGoogleGeoCodeAPIKey(t *testing.T) {
+	var urls []string
+	g := googleGeoCode{apiKey: "secret", client: recordingClient(&urls, `{"results":[{
+		"geometry":{"location":{"lat":51.5,"lng":-0.12}},
+		"address_components":[{"long_name":"London","types":["locality"]}]
+	}]}`)}
+
+	if _, err := g.findCityLocation(context.Background(), "london", "GB"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := g.findCityName(context.Background(), location{Lat: 51.5, Lng: -0.12}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"https://maps.googleapis.com/maps/api/geocode/json?address=london&components=country%3AGB&key=secret",
+		"https://maps.googleapis.com/maps/api/geocode/json?key=secret&latlng=51.5%2C-0.12&result_type=locality",
+	}
+	if len(urls) != len(want) || urls[0] != want[0] || urls[1] != want[1] {
+		t.Errorf("got %v, want %v", urls, want)
+	}
+}
+
+func TestGoogleGeoCodeNoResults(t *testing.T) {
+	for _, body := range []string{"{}", `{"results":[]}`, `{"results":[],"status":"ZERO_RESULTS"}`} {
+		var urls []string
+		g := googleGeoCode{client: recordingClient(&urls, body)}
+		if _, err := g.findCityLocation(context.Background(), "atlantis", ""); !errors.Is(err, errCityNotFound) {
+			t.Errorf("body %q: got error %v, want %v", body, err, errCityNotFound)
+		}
+	}
+}
+
+func TestGoogleGeoCodeEmptyBody(t *testing.T) {
+	var urls []string
+	g := googleGeoCode{client: recordingClient(&urls, "")}
+	if _, err := g.findCityLocation(context.Background(), "atlantis", ""); err == nil || errors.Is(err, errCityNotFound) {
+		t.Errorf("got error %v, want a malformed response error", err)
+	}
+}
+
+func TestGoogleGeoCodeResultWithoutLocation(t *testing.T) {
+	for _, body := range []string{`{"results":[{}]}`, `{"results":[{"geometry":{}}]}`} {
+		var urls []string
+		g := googleGeoCode{client: recordingClient(&urls, body)}
+		_, err := g.findCityLocation(context.Background(), "atlantis", "")
+		if err == nil || !strings.Contains(err.Error(), "malformed response") {
+			t.Errorf("body %q: got error %v, want a malformed response error", body, err)
+		}
+	}
+}
+
+func TestGoogleGeoCodeRequestError(t *testing.T) {
+	failure := errors.New("no such host")
+	g := googleGeoCode{client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, failure
+	})}}
+
+	if _, err := g.findCityLocation(context.Background(), "london", ""); !errors.Is(err, failure) {
+		t.Errorf("got %v, want %v", err, failure)
+	}
+}
+
+func TestGoogleGeoCodeUnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	g := googleGeoCode{client: serverClient(srv)}
+	_, err := g.findCityLocation(context.Background(), "london", "")
+	var se statusError
+	if !errors.As(err, &se) || se.code != http.StatusForbidden {
+		t.Errorf("got %v, want status 403", err)
+	}
+}
+
+func TestGoogleGeoCodeHonoursContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	g := googleGeoCode{client: serverClient(srv)}
+	if _, err := g.findCityLocation(ctx, "london", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// testContextGeoCode fails with the error of the context it is given, if
+// there is one.
+type testContextGeoCode struct{}
+
+func (testContextGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	if err := ctx.Err(); err != nil {
+		return location{}, err
+	}
+	return location{Lat: 51.5, Lng: -0.12}, nil
+}
+
+func TestForecastIoPassesContextToGeoCode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	f := forecastIo{geoCode: testContextGeoCode{}}
+	if _, err := f.temperature(ctx, "london"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStatusErrorUnwrap(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusNotFound, errCityNotFound},
+		{http.StatusTooManyRequests, errUpstreamRateLimited},
+		{http.StatusInternalServerError, errUpstreamUnavailable},
+		{http.StatusServiceUnavailable, errUpstreamUnavailable},
+	}
+
+	for _, tt := range tests {
+		if err := (statusError{provider: "test", code: tt.code}); !errors.Is(err, tt.want) {
+			t.Errorf("status %d: got %v, want it to be %v", tt.code, err, tt.want)
+		}
+	}
+	if err := (statusError{provider: "test", code: http.StatusForbidden}); errors.Unwrap(err) != nil {
+		t.Errorf("status 403: unwrapped to %v, want nil", errors.Unwrap(err))
+	}
+}
+
+func TestMultiTemperaturesLocation(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"currently":{"temperature":59}}`))
+	}))
+	defer srv.Close()
+
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			openWeatherMapStub{},
+			forecastIo{client: serverClient(srv), geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}},
+		},
+	}
+
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if readings[0].Location != nil {
+		t.Errorf("openWeatherMap should have no location, got %+v", readings[0].Location)
+	}
+	if l := readings[1].Location; l == nil || l.Lat != 51.5 || l.Lng != -0.12 {
+		t.Errorf("got forecastIo location %+v, want 51.5,-0.12", l)
+	}
+}
+
+func TestOpenWeatherMapAPIKey(t *testing.T) {
+	var urls []string
+	p := openWeatherMap{apiKey: "s3cret", client: recordingClient(&urls, `{"main":{"temp":290}}`)}
+	if _, err := p.temperature(context.Background(), "london"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "http://api.openweathermap.org/data/2.5/weather?q=london&appid=s3cret"
+	if len(urls) != 1 || urls[0] != want {
+		t.Errorf("got %v, want [%s]", urls, want)
+	}
+}
+
+func TestOpenWeatherMapBaseURL(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		w.Write([]byte(`{"main":{"temp":290.5}}`))
+	}))
+	defer srv.Close()
+
+	p := openWeatherMap{client: srv.Client(), baseURL: srv.URL}
+	k, err := p.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k != 290.5 {
+		t.Errorf("got %v, want 290.5", k)
+	}
+	if want := "/data/2.5/weather?q=london"; path != want {
+		t.Errorf("got path %q, want %q", path, want)
+	}
+}
+
+func TestWeatherUndergroundBaseURL(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		w.Write([]byte(`{"current_observation":{"temp_c":17}}`))
+	}))
+	defer srv.Close()
+
+	p := weatherUnderground{apiKey: "k", client: srv.Client(), baseURL: srv.URL}
+	k, err := p.temperature(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k != 290.15 {
+		t.Errorf("got %v, want 290.15", k)
+	}
+	if want := "/api/k/conditions/q/london.json"; path != want {
+		t.Errorf("got path %q, want %q", path, want)
+	}
+}
+
+// testConcurrencyWeatherProvider tracks how many calls to it are in flight.
+type testConcurrencyWeatherProvider struct {
+	mu       *sync.Mutex
+	inFlight *int
+	max      *int
+}
+
+func (t testConcurrencyWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	t.mu.Lock()
+	*t.inFlight++
+	if *t.inFlight > *t.max {
+		*t.max = *t.inFlight
+	}
+	t.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	t.mu.Lock()
+	*t.inFlight--
+	t.mu.Unlock()
+	return 290, nil
+}
+
+func TestMultiTemperatureConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, max int
+
+	var providers []weatherProvider
+	for i := 0; i < 12; i++ {
+		providers = append(providers, testConcurrencyWeatherProvider{&mu, &inFlight, &max})
+	}
+	w := multiWeatherProvider{providers: providers, concurrency: 3}
+
+	temp, err := w.temperature(context.Background(), "london")
+	if err != nil || temp != 290 {
+		t.Fatalf("got %v, %v", temp, err)
+	}
+	if max > 3 {
+		t.Errorf("saw %d concurrent calls, want at most 3", max)
+	}
+	if max < 2 {
+		t.Errorf("saw %d concurrent calls, expected providers to run in parallel", max)
+	}
+}
+
+// forecastIoSample is a trimmed forecast.io response for London.
+const forecastIoSample = `{
+  "latitude": 51.5,
+  "longitude": -0.12,
+  "timezone": "Europe/London",
+  "currently": {
+    "time": 1792062000,
+    "summary": "Partly Cloudy",
+    "icon": "partly-cloudy-day",
+    "precipIntensity": 0,
+    "precipProbability": 0,
+    "temperature": 59.9,
+    "apparentTemperature": 59.4,
+    "dewPoint": 50.1,
+    "humidity": 0.7,
+    "pressure": 1016.2,
+    "windSpeed": 9.84,
+    "windGust": 17.2,
+    "windBearing": 240,
+    "cloudCover": 0.44,
+    "uvIndex": 2,
+    "visibility": 10
+  },
+  "hourly": {"summary": "Partly cloudy throughout the day.", "data": []},
+  "flags": {"units": "us"},
+  "offset": 1
+}`
+
+func TestForecastIoDecodesSample(t *testing.T) {
+	var urls []string
+	p := forecastIo{client: recordingClient(&urls, forecastIoSample), geoCode: testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}}
+	c, err := p.conditions(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	near := func(got *float64, want float64) bool { return got != nil && math.Abs(*got-want) < 1e-9 }
+	if !near(&c.TempKelvin, 288.65) {
+		t.Errorf("got temperature %v, want 288.65", c.TempKelvin)
+	}
+	if want := (59.4-32)/1.8 + 273.15; !near(c.ApparentTempKelvin, want) {
+		t.Errorf("got apparent temperature %v, want %v", c.ApparentTempKelvin, want)
+	}
+	if !near(c.HumidityPercent, 70) {
+		t.Errorf("got humidity %v, want 70", c.HumidityPercent)
+	}
+	if !near(c.WindSpeedMetersPerSec, 9.84*0.44704) {
+		t.Errorf("got wind speed %v, want %v", c.WindSpeedMetersPerSec, 9.84*0.44704)
+	}
+	if !near(c.WindDirectionDegrees, 240) {
+		t.Errorf("got wind direction %v, want 240", c.WindDirectionDegrees)
+	}
+	if !near(c.PressureHPa, 1016.2) {
+		t.Errorf("got pressure %v, want 1016.2", c.PressureHPa)
+	}
+}
+
+func TestForecastIoUsesCoordinates(t *testing.T) {
+	var urls []string
+	f := forecastIo{
+		apiKey:  "key",
+		client:  recordingClient(&urls, `{"currently":{"temperature":59}}`),
+		geoCode: testGeoCode{err: errors.New("geocoder should not be called")},
+	}
+
+	ctx := withCoordinates(context.Background(), location{Lat: 51.5, Lng: -0.12})
+	if _, err := f.temperature(ctx, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "https://api.forecast.io/forecast/key/51.5,-0.12"
+	if len(urls) != 1 || urls[0] != want {
+		t.Errorf("got %v, want [%s]", urls, want)
+	}
+}
+
+func TestForecastIoRejectsZeroLocation(t *testing.T) {
+	var urls []string
+	f := forecastIo{
+		apiKey:  "key",
+		client:  recordingClient(&urls, `{"currently":{"temperature":59}}`),
+		geoCode: testGeoCode{l: location{}},
+	}
+
+	if _, err := f.temperature(context.Background(), "xyzzy"); !errors.Is(err, errCityNotFound) {
+		t.Errorf("got %v, want %v", err, errCityNotFound)
+	}
+	if len(urls) != 0 {
+		t.Errorf("queried %v for a zero location", urls)
+	}
+
+	// Unless 0,0 is what was asked for.
+	ctx := withCoordinates(context.Background(), location{})
+	if _, err := f.temperature(ctx, ""); err != nil {
+		t.Errorf("unexpected error for explicit 0,0: %v", err)
+	}
+}
+
+func TestLocationValid(t *testing.T) {
+	tests := []struct {
+		l    location
+		want bool
+	}{
+		{location{Lat: 51.5, Lng: -0.12}, true},
+		{location{Lat: 0, Lng: 9.5}, true},
+		{location{Lat: -90, Lng: 180}, true},
+		{location{}, false},
+		{location{Lat: 91, Lng: 0.1}, false},
+		{location{Lat: 10, Lng: -181}, false},
+		{location{Lat: math.NaN(), Lng: 1}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.l.valid(); got != tt.want {
+			t.Errorf("%+v.valid() = %v, want %v", tt.l, got, tt.want)
+		}
+	}
+}
+
+func TestMultiTemperatureCoordinatesOnly(t *testing.T) {
+	var urls []string
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			openWeatherMap{client: recordingClient(&urls, `{}`)},
+			forecastIo{client: recordingClient(&urls, `{"currently":{"temperature":32}}`), geoCode: testGeoCode{}},
+		},
+		strict: true,
+	}
+
+	ctx := withCoordinates(context.Background(), location{Lat: 51.5, Lng: -0.12})
+	readings, err := w.temperatures(ctx, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(readings[0].Err, errCityRequired) {
+		t.Errorf("openWeatherMap should have been skipped, got %v", readings[0].Err)
+	}
+	if readings[1].Err != nil || readings[1].TempKelvin != 273.15 {
+		t.Errorf("got forecastIo reading %+v", readings[1])
+	}
+	if temp := w.aggregate(readings); temp != 273.15 {
+		t.Errorf("got %v, want 273.15", temp)
+	}
+	if len(urls) != 1 {
+		t.Errorf("got requests %v, want only forecast.io", urls)
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		lat, lng string
+		ok       bool
+	}{
+		{"51.5", "-0.12", true},
+		{"-90", "180", true},
+		{"91", "0", false},
+		{"0", "-181", false},
+		{"north", "0", false},
+		{"51.5", "", false},
+	}
+
+	for _, tt := range tests {
+		_, err := parseLocation(tt.lat, tt.lng)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseLocation(%q, %q) error = %v, want ok=%v", tt.lat, tt.lng, err, tt.ok)
+		}
+	}
+}
+
+func TestLocationUnmarshal(t *testing.T) {
+	// The "location" object from a Google geocode result.
+	var l location
+	if err := json.Unmarshal([]byte(`{"lat": 51.5073509, "lng": -0.1277583}`), &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Lat != 51.5073509 || l.Lng != -0.1277583 {
+		t.Errorf("got %+v", l)
+	}
+}
+
+func TestCountryQualifiesQueries(t *testing.T) {
+	ctx := withCountry(context.Background(), "GB")
+
+	var urls []string
+	if _, err := (openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}).temperature(ctx, "london"); err != nil {
+		t.Fatal(err)
+	}
+	g := googleGeoCode{client: recordingClient(&urls, `{"results":[{"geometry":{"location":{"lat":51.5,"lng":-0.12}}}]}`)}
+	if _, err := g.findCityLocation(context.Background(), "london", "GB"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"http://api.openweathermap.org/data/2.5/weather?q=london%2CGB",
+		"https://maps.googleapis.com/maps/api/geocode/json?address=london&components=country%3AGB",
+	}
+	for i := range want {
+		if i >= len(urls) || urls[i] != want[i] {
+			t.Errorf("got %v, want %v", urls, want)
+			break
+		}
+	}
+}
+
+func TestQualifiedLocations(t *testing.T) {
+	tests := []struct {
+		q           string
+		wantCity    string
+		wantOWM     string
+		wantGeoCode string
+	}{
+		{
+			"Paris, Texas", "paris, texas",
+			"http://api.openweathermap.org/data/2.5/weather?q=paris%2Ctexas",
+			"https://maps.googleapis.com/maps/api/geocode/json?address=paris%2C+texas",
+		},
+		{
+			"London,  Ontario ,Canada", "london, ontario, canada",
+			"http://api.openweathermap.org/data/2.5/weather?q=london%2Contario%2Ccanada",
+			"https://maps.googleapis.com/maps/api/geocode/json?address=london%2C+ontario%2C+canada",
+		},
+	}
+
+	for _, tt := range tests {
+		var owmURLs, geoURLs, fioURLs []string
+		h := weatherHandler{
+			mw: multiWeatherProvider{providers: []weatherProvider{
+				openWeatherMap{client: recordingClient(&owmURLs, `{"main":{"temp":290}}`)},
+				NewForecastIo("key",
+					googleGeoCode{client: recordingClient(&geoURLs, `{"results":[{"geometry":{"location":{"lat":43,"lng":-81.2}}}]}`)},
+					recordingClient(&fioURLs, `{"currently":{"temperature":59}}`)),
+			}},
+			timeout: time.Second,
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather?q="+url.QueryEscape(tt.q), nil))
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d: %s", tt.q, rec.Code, rec.Body)
+		}
+		if !strings.Contains(rec.Body.String(), `"city":"`+tt.wantCity+`"`) {
+			t.Errorf("%s: got %s, want city %q", tt.q, rec.Body, tt.wantCity)
+		}
+		if len(owmURLs) != 1 || owmURLs[0] != tt.wantOWM {
+			t.Errorf("%s: got OpenWeatherMap URLs %v, want %s", tt.q, owmURLs, tt.wantOWM)
+		}
+		if len(geoURLs) != 1 || geoURLs[0] != tt.wantGeoCode {
+			t.Errorf("%s: got geocoder URLs %v, want %s", tt.q, geoURLs, tt.wantGeoCode)
+		}
+	}
+}
+
+func TestNoCountryKeepsQueries(t *testing.T) {
+	var urls []string
+	if _, err := (openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}).temperature(context.Background(), "london"); err != nil {
+		t.Fatal(err)
+	}
+	g := googleGeoCode{client: recordingClient(&urls, `{"results":[{"geometry":{"location":{"lat":51.5,"lng":-0.12}}}]}`)}
+	if _, err := g.findCityLocation(context.Background(), "london", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"http://api.openweathermap.org/data/2.5/weather?q=london",
+		"https://maps.googleapis.com/maps/api/geocode/json?address=london",
+	}
+	for i := range want {
+		if i >= len(urls) || urls[i] != want[i] {
+			t.Errorf("got %v, want %v", urls, want)
+			break
+		}
+	}
+}
+
+func TestParseCountry(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"GB", "GB", true},
+		{"us", "US", true},
+		{"GBR", "", false},
+		{"G1", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseCountry(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseCountry(%q) = %q, %v; want %q, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeCity(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"New York", "new york"},
+		{"NEW YORK", "new york"},
+		{"  new york ", "new york"},
+		{"new  york", "new york"},
+		{"\tNew \n York\t", "new york"},
+		{"São Paulo", "são paulo"},
+		{"   ", ""},
+		{"Paris,Texas", "paris, texas"},
+		{" London ,  Ontario,Canada ", "london, ontario, canada"},
+		{"london,, ", "london"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeCity(tt.in); got != tt.want {
+			t.Errorf("normalizeCity(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerNormalizesCity(t *testing.T) {
+	var urls []string
+	h := weatherHandler{
+		mw:      multiWeatherProvider{providers: []weatherProvider{openWeatherMap{client: recordingClient(&urls, `{"main":{"temp":290}}`)}}},
+		timeout: time.Second,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/New%20%20York%20", nil))
+
+	want := "http://api.openweathermap.org/data/2.5/weather?q=new+york"
+	if len(urls) != 1 || urls[0] != want {
+		t.Errorf("got %v, want [%s]", urls, want)
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.WriteTimeout = duration{time.Minute}
+	srv := newServer(cfg, http.NotFoundHandler())
+
+	if srv.Addr != cfg.Listen {
+		t.Errorf("got address %q, want %q", srv.Addr, cfg.Listen)
+	}
+	if srv.ReadHeaderTimeout != 5*time.Second || srv.ReadTimeout != 10*time.Second ||
+		srv.WriteTimeout != time.Minute || srv.IdleTimeout != 2*time.Minute {
+		t.Errorf("got timeouts %v, %v, %v, %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+// metOffice looks up the latest hourly observation from the UK Met Office's
+// DataPoint API, at the observing site nearest the city.
+type metOffice struct {
+	apiKey string
+	geoCode
+	client  *http.Client
+	baseURL string // defaults to defaultMetOfficeURL
+
+	mu    sync.Mutex
+	sites []metOfficeSite // fetched on first use
+}
+
+const defaultMetOfficeURL = "http://datapoint.metoffice.gov.uk/public/data"
+
+// maxSiteDistanceKm is how far the nearest observing site may be from the
+// city. The Met Office only observes the UK, and the nearest site to
+// anywhere much further afield says little about its weather.
+const maxSiteDistanceKm = 50
+
+func NewMetOffice(apiKey string, gc geoCode, c *http.Client) *metOffice {
+	return &metOffice{apiKey: apiKey, geoCode: gc, client: c}
+}
+
+type metOfficeSite struct {
+	id  string
+	loc location
+}
+
+func (m *metOffice) name() string {
+	return "metOffice"
+}
+
+func (m *metOffice) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := m.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (m *metOffice) conditions(ctx context.Context, city string) (Conditions, error) {
+	l, err := locate(ctx, "metoffice", m.geoCode, city)
+	if err != nil {
+		return Conditions{}, err
+	}
+	recordLocation(ctx, l)
+
+	site, err := m.nearestSite(ctx, l)
+	if err != nil {
+		return Conditions{}, err
+	}
+
+	var d struct {
+		SiteRep struct {
+			DV struct {
+				Location struct {
+					Period json.RawMessage `json:"Period"`
+				} `json:"Location"`
+			} `json:"DV"`
+		} `json:"SiteRep"`
+	}
+	if err := m.get(ctx, m.observationsURL(url.PathEscape(site.id)), &d); err != nil {
+		return Conditions{}, err
+	}
+
+	// Observations come in periods of a day, each with a report an hour, in
+	// order. Either can be a single object rather than an array.
+	var latest struct {
+		Temperature   string `json:"T"` // °C
+		Humidity      string `json:"H"` // %
+		WindSpeed     string `json:"S"` // mph
+		WindDirection string `json:"D"` // 16-point compass
+	}
+	periods, err := oneOrMany(d.SiteRep.DV.Location.Period)
+	if err != nil {
+		return Conditions{}, malformedResponse("metoffice", err)
+	}
+	if len(periods) == 0 {
+		return Conditions{}, errors.New("metoffice: response has no observations")
+	}
+	var period struct {
+		Rep json.RawMessage `json:"Rep"`
+	}
+	if err := json.Unmarshal(periods[len(periods)-1], &period); err != nil {
+		return Conditions{}, malformedResponse("metoffice", err)
+	}
+	reps, err := oneOrMany(period.Rep)
+	if err != nil {
+		return Conditions{}, malformedResponse("metoffice", err)
+	}
+	if len(reps) == 0 {
+		return Conditions{}, errors.New("metoffice: response has no observations")
+	}
+	if err := json.Unmarshal(reps[len(reps)-1], &latest); err != nil {
+		return Conditions{}, malformedResponse("metoffice", err)
+	}
+
+	celsius, err := strconv.ParseFloat(latest.Temperature, 64)
+	if err != nil {
+		return Conditions{}, errors.New("metoffice: response has no temperature")
+	}
+	t, err := rawTemperature("metoffice", celsius, unitCelsius)
+	if err != nil {
+		return Conditions{}, err
+	}
+	c := Conditions{TempKelvin: t.Kelvin()}
+	if h, err := strconv.ParseFloat(latest.Humidity, 64); err == nil {
+		c.HumidityPercent = &h
+	}
+	if mph, err := strconv.ParseFloat(latest.WindSpeed, 64); err == nil {
+		ms := mph * 0.44704
+		c.WindSpeedMetersPerSec = &ms
+	}
+	if deg, ok := compassDegrees[latest.WindDirection]; ok {
+		c.WindDirectionDegrees = &deg
+	}
+
+	logf(ctx, "metOffice: %s: %.2f", city, c.TempKelvin)
+	return c, nil
+}
+
+// nearestSite returns the observing site closest to l.
+func (m *metOffice) nearestSite(ctx context.Context, l location) (metOfficeSite, error) {
+	sites, err := m.siteList(ctx)
+	if err != nil {
+		return metOfficeSite{}, err
+	}
+
+	var nearest metOfficeSite
+	best := math.Inf(1)
+	for _, s := range sites {
+		if d := distanceKm(l, s.loc); d < best {
+			nearest, best = s, d
+		}
+	}
+	if best > maxSiteDistanceKm {
+		return metOfficeSite{}, fmt.Errorf("metoffice: no observing site within %dkm of %v,%v", maxSiteDistanceKm, l.Lat, l.Lng)
+	}
+	return nearest, nil
+}
+
+// siteList returns the Met Office's observing sites. They rarely change, so
+// the list is fetched once and kept.
+func (m *metOffice) siteList(ctx context.Context) ([]metOfficeSite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sites != nil {
+		return m.sites, nil
+	}
+
+	var d struct {
+		Locations struct {
+			Location []struct {
+				ID        string `json:"id"`
+				Latitude  string `json:"latitude"`
+				Longitude string `json:"longitude"`
+			} `json:"Location"`
+		} `json:"Locations"`
+	}
+	if err := m.get(ctx, m.apiURL("/val/wxobs/all/json/sitelist", nil), &d); err != nil {
+		return nil, err
+	}
+
+	var sites []metOfficeSite
+	for _, s := range d.Locations.Location {
+		loc, err := parseLocation(s.Latitude, s.Longitude)
+		if err != nil || s.ID == "" {
+			continue
+		}
+		sites = append(sites, metOfficeSite{id: s.ID, loc: loc})
+	}
+	if len(sites) == 0 {
+		return nil, errors.New("metoffice: site list is empty")
+	}
+	m.sites = sites
+	return sites, nil
+}
+
+// buildURL returns the URL to fetch the observations for city. Which site
+// to ask for depends on the site list, so the URL has a placeholder for it.
+func (m *metOffice) buildURL(ctx context.Context, city string) string {
+	return m.observationsURL("{site}")
+}
+
+func (m *metOffice) secret() string {
+	return m.apiKey
+}
+
+// observationsURL returns the URL of the hourly observations at site, which
+// must already be escaped.
+func (m *metOffice) observationsURL(site string) string {
+	return m.apiURL("/val/wxobs/all/json/"+site, url.Values{"res": {"hourly"}})
+}
+
+// apiURL returns the URL of path on the DataPoint API, with the query q and
+// the API key.
+func (m *metOffice) apiURL(path string, q url.Values) string {
+	v := url.Values{"key": {m.apiKey}}
+	for k, vs := range q {
+		v[k] = vs
+	}
+	return orDefault(m.baseURL, defaultMetOfficeURL) + path + "?" + v.Encode()
+}
+
+// get fetches u from the DataPoint API and decodes the JSON response into v.
+func (m *metOffice) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("metoffice", resp); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return malformedResponse("metoffice", err)
+	}
+	return nil
+}
+
+// oneOrMany splits b, a JSON array or a single value, into its elements.
+func oneOrMany(b json.RawMessage) ([]json.RawMessage, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		return nil, nil
+	}
+	if b[0] != '[' {
+		return []json.RawMessage{b}, nil
+	}
+	var many []json.RawMessage
+	err := json.Unmarshal(b, &many)
+	return many, err
+}
+
+// compassDegrees gives the bearing of each point of a 16-point compass.
+var compassDegrees = map[string]float64{
+	"N": 0, "NNE": 22.5, "NE": 45, "ENE": 67.5,
+	"E": 90, "ESE": 112.5, "SE": 135, "SSE": 157.5,
+	"S": 180, "SSW": 202.5, "SW": 225, "WSW": 247.5,
+	"W": 270, "WNW": 292.5, "NW": 315, "NNW": 337.5,
+}
+
+// distanceKm returns the great-circle distance between a and b.
+func distanceKm(a, b location) float64 {
+	const earthRadiusKm = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLng := rad(b.Lat-a.Lat), rad(b.Lng-a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
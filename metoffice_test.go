@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// metOfficeServer serves a site list with Heathrow and Edinburgh, and
+// observations for Heathrow. It counts the site list requests in *siteLists.
+func metOfficeServer(t *testing.T, siteLists *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") != "secret" {
+			http.Error(w, "bad key", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/val/wxobs/all/json/sitelist":
+			*siteLists++
+			w.Write([]byte(`{"Locations":{"Location":[
+				{"id":"3772","latitude":"51.479","longitude":"-0.449","name":"Heathrow"},
+				{"id":"3166","latitude":"55.928","longitude":"-3.343","name":"Edinburgh/Gogarbank"}
+			]}}`))
+		case "/val/wxobs/all/json/3772":
+			// A single period, with the latest report last.
+			w.Write([]byte(`{"SiteRep":{"DV":{"Location":{"i":"3772","Period":
+				{"type":"Day","value":"2015-11-20Z","Rep":[
+					{"D":"W","H":"90.0","S":"5","T":"8.1","$":"540"},
+					{"D":"SW","H":"85.1","S":"10","T":"10.3","$":"600"}
+				]}
+			}}}}`))
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestMetOffice(t *testing.T) {
+	var siteLists int
+	srv := metOfficeServer(t, &siteLists)
+	defer srv.Close()
+
+	m := NewMetOffice("secret", testGeoCode{l: location{Lat: 51.5, Lng: -0.12}}, serverClient(srv))
+	m.baseURL = srv.URL
+
+	for i := 0; i < 2; i++ {
+		c, err := m.conditions(context.Background(), "london")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if math.Abs(c.TempKelvin-283.45) > 1e-9 {
+			t.Errorf("got %v, want 283.45", c.TempKelvin)
+		}
+		if c.HumidityPercent == nil || *c.HumidityPercent != 85.1 {
+			t.Errorf("got humidity %v, want 85.1", c.HumidityPercent)
+		}
+		if c.WindSpeedMetersPerSec == nil || math.Abs(*c.WindSpeedMetersPerSec-4.4704) > 1e-9 {
+			t.Errorf("got wind speed %v, want 4.4704", c.WindSpeedMetersPerSec)
+		}
+		if c.WindDirectionDegrees == nil || *c.WindDirectionDegrees != 225 {
+			t.Errorf("got wind direction %v, want 225", c.WindDirectionDegrees)
+		}
+	}
+	if siteLists != 1 {
+		t.Errorf("fetched the site list %d times, want 1", siteLists)
+	}
+}
+
+func TestMetOfficeTooFarFromAnySite(t *testing.T) {
+	var siteLists int
+	srv := metOfficeServer(t, &siteLists)
+	defer srv.Close()
+
+	m := NewMetOffice("secret", testGeoCode{l: location{Lat: 48.86, Lng: 2.35}}, serverClient(srv))
+	m.baseURL = srv.URL
+
+	_, err := m.temperature(context.Background(), "paris")
+	if err == nil || !strings.Contains(err.Error(), "no observing site") {
+		t.Errorf("got error %v, want one about there being no site nearby", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+// They match the Prometheus client's default buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics collects provider and request statistics and serves them in the
+// Prometheus text exposition format.
+type metrics struct {
+	mu               sync.Mutex
+	providerRequests map[string]uint64
+	providerErrors   map[string]uint64
+	providerLatency  map[string]*histogram
+	requestLatency   *histogram
+	breakers         []*circuitBreakerProvider
+	lastCalls        map[string]providerCall
+}
+
+// providerCall is the outcome of the most recent call to a provider.
+type providerCall struct {
+	err     error
+	latency time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		providerRequests: make(map[string]uint64),
+		providerErrors:   make(map[string]uint64),
+		providerLatency:  make(map[string]*histogram),
+		requestLatency:   newHistogram(),
+		lastCalls:        make(map[string]providerCall),
+	}
+}
+
+// registerBreaker adds b's state to the exported metrics.
+func (m *metrics) registerBreaker(b *circuitBreakerProvider) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.breakers = append(m.breakers, b)
+}
+
+// observeProvider records the outcome of a single provider call.
+func (m *metrics) observeProvider(name string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.providerRequests[name]++
+	if err != nil {
+		m.providerErrors[name]++
+	}
+	h, ok := m.providerLatency[name]
+	if !ok {
+		h = newHistogram()
+		m.providerLatency[name] = h
+	}
+	h.observe(d.Seconds())
+	m.lastCalls[name] = providerCall{err: err, latency: d}
+}
+
+// lastCall returns the outcome of the last call to the named provider, if
+// there has been one.
+func (m *metrics) lastCall(name string) (providerCall, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.lastCalls[name]
+	return c, ok
+}
+
+// breakerState returns the state of the named provider's circuit breaker, if
+// it has one.
+func (m *metrics) breakerState(name string) (circuitState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range m.breakers {
+		if b.name() == name {
+			return b.State(), true
+		}
+	}
+	return 0, false
+}
+
+// instrument wraps h so that the time taken to serve each request is recorded.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		h.ServeHTTP(w, r)
+
+		m.mu.Lock()
+		m.requestLatency.observe(time.Since(begin).Seconds())
+		m.mu.Unlock()
+	})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.providerRequests))
+	for name := range m.providerRequests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP weather_provider_requests_total Number of temperature lookups made against each provider.")
+	fmt.Fprintln(w, "# TYPE weather_provider_requests_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "weather_provider_requests_total{providerName=%q} %d\n", name, m.providerRequests[name])
+	}
+
+	fmt.Fprintln(w, "# HELP weather_provider_errors_total Number of failed temperature lookups for each provider.")
+	fmt.Fprintln(w, "# TYPE weather_provider_errors_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "weather_provider_errors_total{providerName=%q} %d\n", name, m.providerErrors[name])
+	}
+
+	fmt.Fprintln(w, "# HELP weather_provider_duration_seconds Time taken by each provider to return a temperature.")
+	fmt.Fprintln(w, "# TYPE weather_provider_duration_seconds histogram")
+	for _, name := range names {
+		m.providerLatency[name].write(w, "weather_provider_duration_seconds", fmt.Sprintf("providerName=%q,", name))
+	}
+
+	fmt.Fprintln(w, "# HELP weather_request_duration_seconds Time taken to serve /weather/ requests.")
+	fmt.Fprintln(w, "# TYPE weather_request_duration_seconds histogram")
+	m.requestLatency.write(w, "weather_request_duration_seconds", "")
+
+	if len(m.breakers) > 0 {
+		fmt.Fprintln(w, "# HELP weather_provider_circuit_state Circuit breaker state for each provider: 0 closed, 1 open, 2 half-open.")
+		fmt.Fprintln(w, "# TYPE weather_provider_circuit_state gauge")
+		for _, b := range m.breakers {
+			fmt.Fprintf(w, "weather_provider_circuit_state{providerName=%q} %d\n", b.name(), b.State())
+		}
+	}
+}
+
+// histogram is a cumulative Prometheus-style histogram over latencyBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write prints the histogram's series; labels, if not empty, must end in a comma.
+func (h *histogram) write(w io.Writer, name, labels string) {
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, le, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// instrumentedWeatherProvider records the latency and outcome of every call
+// to the wrapped provider.
+type instrumentedWeatherProvider struct {
+	provider weatherProvider
+	metrics  *metrics
+}
+
+func (p instrumentedWeatherProvider) name() string {
+	return providerName(p.provider)
+}
+
+func (p instrumentedWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := p.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (p instrumentedWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	begin := time.Now()
+	c, err := conditionsOf(ctx, p.provider, city)
+	p.metrics.observeProvider(p.name(), time.Since(begin), err)
+	return c, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentedWeatherProvider(t *testing.T) {
+	m := newMetrics()
+	ok := instrumentedWeatherProvider{provider: openWeatherMapStub{}, metrics: m}
+	failing := instrumentedWeatherProvider{provider: namedFailingProvider{}, metrics: m}
+
+	ok.temperature(context.Background(), "london")
+	ok.temperature(context.Background(), "paris")
+	failing.temperature(context.Background(), "london")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		`weather_provider_requests_total{providerName="openWeatherMap"} 2`,
+		`weather_provider_errors_total{providerName="openWeatherMap"} 0`,
+		`weather_provider_requests_total{providerName="forecastIo"} 1`,
+		`weather_provider_errors_total{providerName="forecastIo"} 1`,
+		`weather_provider_duration_seconds_count{providerName="openWeatherMap"} 2`,
+		`weather_provider_duration_seconds_bucket{providerName="forecastIo",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q:\n%s", want, body)
+		}
+	}
+}
+
+type namedFailingProvider struct{}
+
+func (namedFailingProvider) name() string { return "forecastIo" }
+
+func (namedFailingProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	return 0, errors.New("forecastio: unexpected status 500")
+}
+
+func TestMetricsInstrumentHandler(t *testing.T) {
+	m := newMetrics()
+	h := m.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/weather/london", nil))
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "weather_request_duration_seconds_count 1") {
+		t.Errorf("request was not recorded:\n%s", rec.Body)
+	}
+}
+
+func TestMetricsCircuitState(t *testing.T) {
+	m := newMetrics()
+	b := NewCircuitBreakerProvider(namedFailingProvider{}, 1, time.Hour)
+	m.registerBreaker(b)
+	b.temperature(context.Background(), "london")
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `weather_provider_circuit_state{providerName="forecastIo"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics output missing %q:\n%s", want, rec.Body)
+	}
+}
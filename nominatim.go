@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// nominatimGeoCode looks cities up with OpenStreetMap's Nominatim service,
+// which unlike Google's geocoder needs no API key. The zero value uses
+// http.DefaultClient and defaultUserAgent.
+type nominatimGeoCode struct {
+	client    *http.Client
+	userAgent string
+	baseURL   string // defaults to defaultNominatimURL
+}
+
+const defaultNominatimURL = "https://nominatim.openstreetmap.org"
+
+func (g nominatimGeoCode) findCityLocation(ctx context.Context, city, country string) (location, error) {
+	u := orDefault(g.baseURL, defaultNominatimURL) + "/search?format=json&q=" + url.QueryEscape(city)
+	if isZipCode(city) {
+		u = orDefault(g.baseURL, defaultNominatimURL) + "/search?format=json&postalcode=" + city
+		country = zipCountry(country)
+	}
+	if country != "" {
+		u += "&countrycodes=" + url.QueryEscape(strings.ToLower(country))
+	}
+
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := g.get(ctx, u, &results); err != nil {
+		return location{}, err
+	}
+	if len(results) == 0 {
+		return location{}, fmt.Errorf("nominatim: %w: %s", errCityNotFound, city)
+	}
+
+	lat, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return location{}, err
+	}
+	lng, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return location{}, err
+	}
+
+	return location{Lat: lat, Lng: lng}, nil
+}
+
+// findCityName returns the name of the city, town or village at l.
+func (g nominatimGeoCode) findCityName(ctx context.Context, l location) (string, error) {
+	u := orDefault(g.baseURL, defaultNominatimURL) + "/reverse?format=json&zoom=10" +
+		"&lat=" + strconv.FormatFloat(l.Lat, 'f', -1, 64) +
+		"&lon=" + strconv.FormatFloat(l.Lng, 'f', -1, 64)
+
+	var result struct {
+		Address struct {
+			City    string `json:"city"`
+			Town    string `json:"town"`
+			Village string `json:"village"`
+		} `json:"address"`
+	}
+	if err := g.get(ctx, u, &result); err != nil {
+		return "", err
+	}
+
+	for _, name := range []string{result.Address.City, result.Address.Town, result.Address.Village} {
+		if name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("nominatim: no city at %v,%v", l.Lat, l.Lng)
+}
+
+// get fetches u and decodes the JSON response into v.
+func (g nominatimGeoCode) get(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	// Nominatim's usage policy requires an identifying User-Agent.
+	ua := g.userAgent
+	if ua == "" {
+		ua = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+
+	client := g.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus("nominatim", resp); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return malformedResponse("nominatim", err)
+	}
+	return nil
+}
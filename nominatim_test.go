@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const nominatimSample = `[
+  {
+    "place_id": 235549103,
+    "licence": "Data © OpenStreetMap contributors, ODbL 1.0. https://osm.org/copyright",
+    "osm_type": "relation",
+    "osm_id": 65606,
+    "lat": "51.5073219",
+    "lon": "-0.1276474",
+    "display_name": "London, Greater London, England, United Kingdom",
+    "class": "place",
+    "type": "city",
+    "importance": 0.9307827616237295
+  }
+]`
+
+func TestNominatimGeoCode(t *testing.T) {
+	var gotQuery, gotUA string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("q")
+		gotUA = r.Header.Get("User-Agent")
+		w.Write([]byte(nominatimSample))
+	}))
+	defer srv.Close()
+
+	g := nominatimGeoCode{client: serverClient(srv)}
+	l, err := g.findCityLocation(context.Background(), "london", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if l.Lat != 51.5073219 || l.Lng != -0.1276474 {
+		t.Errorf("got %+v", l)
+	}
+	if gotQuery != "london" {
+		t.Errorf("got query %q, want london", gotQuery)
+	}
+	if gotUA != defaultUserAgent {
+		t.Errorf("got User-Agent %q, want %q", gotUA, defaultUserAgent)
+	}
+}
+
+func TestNominatimGeoCodeZipCode(t *testing.T) {
+	var gotQuery url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query()
+		w.Write([]byte(nominatimSample))
+	}))
+	defer srv.Close()
+
+	g := nominatimGeoCode{client: serverClient(srv)}
+	if _, err := g.findCityLocation(context.Background(), "10001", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotQuery.Get("postalcode") != "10001" || gotQuery.Get("countrycodes") != "us" || gotQuery.Has("q") {
+		t.Errorf("got query %v, want a postal code search in the US", gotQuery)
+	}
+}
+
+func TestNominatimGeoCodeNoResults(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	g := nominatimGeoCode{client: serverClient(srv)}
+	if _, err := g.findCityLocation(context.Background(), "nowhere", ""); err == nil {
+		t.Error("expected an error for an empty result set")
+	}
+}
+
+func TestNominatimReverseGeoCode(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte(`{"address":{"town":"Reading","county":"Berkshire"}}`))
+	}))
+	defer srv.Close()
+
+	g := nominatimGeoCode{client: srv.Client(), baseURL: srv.URL}
+	name, err := g.findCityName(context.Background(), location{Lat: 51.45, Lng: -0.97})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name != "Reading" {
+		t.Errorf("got %q, want Reading", name)
+	}
+	if gotPath != "/reverse" {
+		t.Errorf("got path %q, want /reverse", gotPath)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// An Option configures a multiWeatherProvider built by
+// NewMultiWeatherProvider.
+type Option func(*multiWeatherProvider) error
+
+// NewMultiWeatherProvider returns a multiWeatherProvider asking providers,
+// configured by opts. With no options it averages whichever providers
+// answer, as a bare multiWeatherProvider{providers: providers} does.
+func NewMultiWeatherProvider(providers []weatherProvider, opts ...Option) (multiWeatherProvider, error) {
+	w := multiWeatherProvider{providers: providers}
+	for _, opt := range opts {
+		if err := opt(&w); err != nil {
+			return multiWeatherProvider{}, err
+		}
+	}
+	if w.weights != nil && len(w.weights) != len(providers) {
+		return multiWeatherProvider{}, fmt.Errorf("got %d weights for %d providers", len(w.weights), len(providers))
+	}
+	return w, nil
+}
+
+// WithAggregator combines readings with agg instead of taking their mean.
+func WithAggregator(agg Aggregator) Option {
+	return func(w *multiWeatherProvider) error {
+		if agg == nil {
+			return errors.New("nil aggregator")
+		}
+		w.aggregator = agg
+		return nil
+	}
+}
+
+// WithWeights gives each provider the weight at the same index in weights,
+// for aggregators that take weights into account.
+func WithWeights(weights ...float64) Option {
+	return func(w *multiWeatherProvider) error {
+		for i, wt := range weights {
+			if wt < 0 || math.IsNaN(wt) || math.IsInf(wt, 0) {
+				return fmt.Errorf("invalid weight %v for provider %d", wt, i)
+			}
+		}
+		w.weights = weights
+		return nil
+	}
+}
+
+// WithStrict, if strict is true, fails a lookup as soon as any provider
+// fails.
+func WithStrict(strict bool) Option {
+	return func(w *multiWeatherProvider) error {
+		w.strict = strict
+		return nil
+	}
+}
+
+// WithMinProviders fails a lookup that fewer than n providers answered.
+func WithMinProviders(n int) Option {
+	return func(w *multiWeatherProvider) error {
+		if n < 0 {
+			return fmt.Errorf("minimum providers %d is negative", n)
+		}
+		w.minProviders = n
+		return nil
+	}
+}
+
+// WithConcurrency asks at most n providers at once. Zero means no limit.
+func WithConcurrency(n int) Option {
+	return func(w *multiWeatherProvider) error {
+		if n < 0 {
+			return fmt.Errorf("concurrency %d is negative", n)
+		}
+		w.concurrency = n
+		return nil
+	}
+}
+
+// WithOutlierRejection drops readings more than k standard deviations from
+// the mean, both taken over all the readings, the outlier included. That
+// limits how far out a single outlier can look: among n readings it is at
+// most (n-1)/sqrt(n) standard deviations away, about 1.15 with three, so k
+// must be below that for it ever to be dropped. Zero turns it off.
+func WithOutlierRejection(k float64) Option {
+	return func(w *multiWeatherProvider) error {
+		if k < 0 || math.IsNaN(k) {
+			return fmt.Errorf("invalid outlier threshold %v", k)
+		}
+		w.outlierK = k
+		return nil
+	}
+}
+
+// WithSoftDeadline answers with the readings so far once d has passed.
+func WithSoftDeadline(d time.Duration) Option {
+	return func(w *multiWeatherProvider) error {
+		if d < 0 {
+			return fmt.Errorf("soft deadline %v is negative", d)
+		}
+		w.softDeadline = d
+		return nil
+	}
+}
+
+// WithValidator treats readings that validate returns an error for as
+// failures.
+func WithValidator(validate func(kelvin float64) error) Option {
+	return func(w *multiWeatherProvider) error {
+		w.validate = validate
+		return nil
+	}
+}
+
+// WithRecencyHalfLife halves a reading's weight for each halfLife since it
+// was observed.
+func WithRecencyHalfLife(halfLife time.Duration) Option {
+	return func(w *multiWeatherProvider) error {
+		if halfLife < 0 {
+			return fmt.Errorf("recency half-life %v is negative", halfLife)
+		}
+		w.recencyHalfLife = halfLife
+		return nil
+	}
+}
+
+// WithSwitches lets providers be taken out of rotation through s.
+func WithSwitches(s *providerSwitches) Option {
+	return func(w *multiWeatherProvider) error {
+		w.switches = s
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewMultiWeatherProvider(t *testing.T) {
+	providers := []weatherProvider{
+		testConstantWeatherProvider(280),
+		testConstantWeatherProvider(290),
+		testConstantWeatherProvider(400),
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		want Temperature
+	}{
+		{"defaults", nil, 970.0 / 3},
+		{"median", []Option{WithAggregator(MedianAggregator{})}, 290},
+		{"weighted", []Option{WithWeights(3, 1, 0)}, 282.5},
+		{"outliers and concurrency", []Option{WithOutlierRejection(1), WithConcurrency(1)}, 285},
+	}
+
+	for _, tt := range tests {
+		w, err := NewMultiWeatherProvider(providers, tt.opts...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		got, err := w.temperature(context.Background(), "london")
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestNewMultiWeatherProviderMinProvidersAndStrict(t *testing.T) {
+	providers := []weatherProvider{
+		testConstantWeatherProvider(290),
+		testFailingWeatherProvider{errors.New("wunderground: unexpected status 500")},
+	}
+
+	w, err := NewMultiWeatherProvider(providers, WithMinProviders(2), WithSoftDeadline(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.temperature(context.Background(), "london"); !errors.Is(err, errTooFewReadings) {
+		t.Errorf("got %v, want %v", err, errTooFewReadings)
+	}
+
+	w, err = NewMultiWeatherProvider(providers, WithStrict(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pe *ProviderError
+	if _, err := w.temperature(context.Background(), "london"); !errors.As(err, &pe) {
+		t.Errorf("got %v in strict mode, want the provider's failure", err)
+	}
+}
+
+func TestNewMultiWeatherProviderBadOptions(t *testing.T) {
+	providers := []weatherProvider{testConstantWeatherProvider(290)}
+	for i, opt := range []Option{
+		WithWeights(1, 2),
+		WithWeights(-1),
+		WithAggregator(nil),
+		WithMinProviders(-1),
+		WithConcurrency(-1),
+		WithSoftDeadline(-time.Second),
+	} {
+		if _, err := NewMultiWeatherProvider(providers, opt); err == nil {
+			t.Errorf("expected an error for option %d", i)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// prewarmer keeps popular cities in the caches by refreshing them every
+// interval, before their entries expire, so that requests for them don't
+// wait on upstream APIs.
+type prewarmer struct {
+	caches   []*cachingWeatherProvider
+	cities   []string
+	interval time.Duration
+	timeout  time.Duration // for each refresh
+}
+
+// minPrewarmInterval keeps a tiny cache TTL, which the interval defaults to
+// half of, from having the prewarmer refresh in a busy loop.
+const minPrewarmInterval = time.Second
+
+// run refreshes every city straight away and then every interval, or
+// minPrewarmInterval if that is longer, until ctx is done.
+func (p prewarmer) run(ctx context.Context) {
+	interval := p.interval
+	if interval < minPrewarmInterval {
+		interval = minPrewarmInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p.refreshAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// refreshAll refreshes every city in every cache, at the same time.
+func (p prewarmer) refreshAll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	n := 0
+	for _, c := range p.caches {
+		for _, city := range p.cities {
+			n++
+			go func(c *cachingWeatherProvider, city string) {
+				defer func() { done <- struct{}{} }()
+				if err := c.refresh(ctx, normalizeCity(city)); err != nil && ctx.Err() == nil {
+					log.Printf("prewarming %s from %s: %v", city, providerName(c), err)
+				}
+			}(c, city)
+		}
+	}
+	for ; n > 0; n-- {
+		<-done
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrewarmerPopulatesCache(t *testing.T) {
+	upstream := &testCountingWeatherProvider{}
+	cache := NewCachingWeatherProvider(upstream, time.Minute, 0)
+	p := prewarmer{
+		caches:   []*cachingWeatherProvider{cache},
+		cities:   []string{"London", "Paris"},
+		interval: time.Hour,
+		timeout:  time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&upstream.calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("prewarmer still running after shutdown")
+	}
+
+	// Both cities are served from the cache without asking upstream again.
+	for _, city := range []string{"london", "paris"} {
+		if _, err := cache.temperature(context.Background(), city); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&upstream.calls); calls != 2 {
+		t.Errorf("upstream called %d times, want 2", calls)
+	}
+}
+
+func TestPrewarmerZeroInterval(t *testing.T) {
+	upstream := &testCountingWeatherProvider{}
+	cache := NewCachingWeatherProvider(upstream, time.Nanosecond, 0)
+	p := prewarmer{
+		caches:  []*cachingWeatherProvider{cache},
+		cities:  []string{"London"},
+		timeout: time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx) // mustn't panic on a zero interval
+}
+
+func TestCachingWeatherProviderRefresh(t *testing.T) {
+	upstream := &testCountingWeatherProvider{}
+	cache := NewCachingWeatherProvider(upstream, time.Minute, 0)
+
+	cache.temperature(context.Background(), "london")
+	if err := cache.refresh(context.Background(), "london"); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.calls != 2 {
+		t.Errorf("upstream called %d times, want 2 for a refresh of a fresh entry", upstream.calls)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ProviderConfig declares one of the providers to ask, in the "providers"
+// list of the config file.
+type ProviderConfig struct {
+	// Type is one of openweathermap, wunderground, forecastio, accuweather
+	// or metoffice.
+	Type string `json:"type"`
+
+	// APIKey defaults to the key for the type given by flag or environment
+	// variable, such as FORECASTIO_API_KEY.
+	APIKey string `json:"apiKey"`
+
+	// Geocoder, for providers that geocode, overrides the -geocoder used
+	// to locate cities: google or nominatim.
+	Geocoder string `json:"geocoder"`
+}
+
+// buildProviders returns the providers declared in cfg.Providers, sharing
+// client, and locating cities with gc unless they name their own geocoder.
+// Without any declared, it asks OpenWeatherMap, Weather Underground and
+// forecast.io, and AccuWeather and the Met Office if they have keys.
+func buildProviders(cfg Config, client *http.Client, gc geoCode) ([]weatherProvider, error) {
+	configs := cfg.Providers
+	if len(configs) == 0 {
+		configs = []ProviderConfig{{Type: "openweathermap"}, {Type: "wunderground"}, {Type: "forecastio"}}
+		if cfg.AccuWeatherAPIKey != "" {
+			configs = append(configs, ProviderConfig{Type: "accuweather"})
+		}
+		if cfg.MetOfficeAPIKey != "" {
+			configs = append(configs, ProviderConfig{Type: "metoffice"})
+		}
+	}
+
+	var providers []weatherProvider
+	seen := make(map[string]bool)
+	for i, pc := range configs {
+		typ := strings.ToLower(pc.Type)
+		if seen[typ] {
+			return nil, fmt.Errorf("provider %d: %s is listed more than once", i, typ)
+		}
+		seen[typ] = true
+
+		var key string
+		switch typ {
+		case "openweathermap":
+			key = orDefault(pc.APIKey, cfg.OpenWeatherMapAPIKey)
+		case "wunderground":
+			key = orDefault(pc.APIKey, cfg.WundergroundAPIKey)
+		case "forecastio":
+			key = orDefault(pc.APIKey, cfg.ForecastIoAPIKey)
+		case "accuweather":
+			key = orDefault(pc.APIKey, cfg.AccuWeatherAPIKey)
+		case "metoffice":
+			key = orDefault(pc.APIKey, cfg.MetOfficeAPIKey)
+		default:
+			return nil, fmt.Errorf("provider %d: unknown type %q, expected openweathermap, wunderground, forecastio, accuweather or metoffice", i, pc.Type)
+		}
+		// OpenWeatherMap has always been asked, key or not, so that a
+		// missing key shows up as rejected requests.
+		if key == "" && typ != "openweathermap" {
+			return nil, fmt.Errorf("provider %d: %s needs an apiKey", i, typ)
+		}
+
+		pgc := gc
+		if pc.Geocoder != "" {
+			if typ == "wunderground" || typ == "accuweather" {
+				return nil, fmt.Errorf("provider %d: %s looks cities up itself and takes no geocoder", i, typ)
+			}
+			g, _, err := newGeoCode(cfg, pc.Geocoder, client)
+			if err != nil {
+				return nil, fmt.Errorf("provider %d: %v", i, err)
+			}
+			pgc = NewCachingGeoCode(g, cfg.GeocodeCacheTTL.Duration, cfg.NegativeCacheTTL.Duration)
+		}
+
+		switch typ {
+		case "openweathermap":
+			providers = append(providers, openWeatherMap{client: client, apiKey: key, geoCode: pgc})
+		case "wunderground":
+			providers = append(providers, weatherUnderground{client: client, apiKey: key})
+		case "forecastio":
+			providers = append(providers, NewForecastIo(key, pgc, client))
+		case "accuweather":
+			providers = append(providers, accuWeather{apiKey: key, client: client})
+		case "metoffice":
+			providers = append(providers, NewMetOffice(key, pgc, client))
+		}
+	}
+	return providers, nil
+}
+
+// newGeoCode returns the geocoder called name, which also finds the names
+// of cities from their coordinates. Google's needs an API key, and without
+// one Nominatim is used instead.
+func newGeoCode(cfg Config, name string, client *http.Client) (geoCode, reverseGeoCode, error) {
+	switch name {
+	case "google":
+		if cfg.GoogleGeocodeAPIKey != "" {
+			g := googleGeoCode{apiKey: cfg.GoogleGeocodeAPIKey, client: client}
+			return g, g, nil
+		}
+		log.Print("warning: no Google geocoding API key set, geocoding with Nominatim instead")
+		fallthrough
+	case "nominatim":
+		g := nominatimGeoCode{client: client, userAgent: cfg.UserAgent}
+		return g, g, nil
+	}
+	return nil, nil, fmt.Errorf("unknown geocoder %q, expected google or nominatim", name)
+}
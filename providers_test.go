@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBuildProviders(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ForecastIoAPIKey = "from-env"
+	cfg.Providers = []ProviderConfig{
+		{Type: "openweathermap", APIKey: "owm-key"},
+		{Type: "forecastio", Geocoder: "nominatim"},
+		{Type: "MetOffice", APIKey: "mo-key"},
+	}
+	gc := testGeoCode{}
+
+	providers, err := buildProviders(cfg, http.DefaultClient, gc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, p := range providers {
+		names = append(names, providerName(p))
+	}
+	if got := strings.Join(names, ","); got != "openWeatherMap,forecastIo,metOffice" {
+		t.Fatalf("got providers %s", got)
+	}
+
+	if owm := providers[0].(openWeatherMap); owm.apiKey != "owm-key" || owm.geoCode != gc {
+		t.Errorf("got %+v, want the configured key and geocoder", owm)
+	}
+	fio := providers[1].(*forecastIo)
+	if fio.apiKey != "from-env" {
+		t.Errorf("got forecast.io key %q, want the one from the environment", fio.apiKey)
+	}
+	if c, ok := fio.geoCode.(*cachingGeoCode); !ok {
+		t.Errorf("got geocoder %T, want a cached Nominatim", fio.geoCode)
+	} else if _, ok := c.geoCode.(nominatimGeoCode); !ok {
+		t.Errorf("got geocoder %T, want Nominatim", c.geoCode)
+	}
+	if mo := providers[2].(*metOffice); mo.apiKey != "mo-key" {
+		t.Errorf("got Met Office key %q, want mo-key", mo.apiKey)
+	}
+}
+
+func TestBuildProvidersDefaults(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AccuWeatherAPIKey = "aw-key"
+
+	providers, err := buildProviders(cfg, http.DefaultClient, testGeoCode{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, p := range providers {
+		names = append(names, providerName(p))
+	}
+	if got := strings.Join(names, ","); got != "openWeatherMap,weatherUnderground,forecastIo,accuWeather" {
+		t.Errorf("got providers %s", got)
+	}
+}
+
+func TestBuildProvidersErrors(t *testing.T) {
+	tests := []struct {
+		providers []ProviderConfig
+		want      string
+	}{
+		{[]ProviderConfig{{Type: "yahoo", APIKey: "key"}}, `unknown type "yahoo"`},
+		{[]ProviderConfig{{Type: "metoffice"}}, "needs an apiKey"},
+		{[]ProviderConfig{{Type: "forecastio", Geocoder: "bing"}}, `unknown geocoder "bing"`},
+		{[]ProviderConfig{{Type: "wunderground", Geocoder: "nominatim"}}, "takes no geocoder"},
+		{[]ProviderConfig{{Type: "forecastio"}, {Type: "forecastio"}}, "more than once"},
+	}
+
+	for _, tt := range tests {
+		cfg := defaultConfig()
+		cfg.Providers = tt.providers
+		if _, err := buildProviders(cfg, http.DefaultClient, testGeoCode{}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got error %v, want one mentioning %q", tt.providers, err, tt.want)
+		}
+	}
+}
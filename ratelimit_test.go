@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := newFakeClock()
+	l := newRateLimiter(1, 3)
+	l.clock = clock
+
+	h := l.limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := get("10.0.0.1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want 200", i, rec.Code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		rec := get("10.0.0.1")
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("got status %d past the burst, want 429", rec.Code)
+		}
+		if ra := rec.Header().Get("Retry-After"); ra != "1" {
+			t.Errorf("got Retry-After %q, want 1", ra)
+		}
+	}
+
+	if rec := get("10.0.0.2"); rec.Code != http.StatusOK {
+		t.Errorf("another client got status %d, want 200", rec.Code)
+	}
+
+	clock.Advance(time.Second)
+	if rec := get("10.0.0.1"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d after refilling, want 200", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("192.0.2.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr, xff, want string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+		{"192.0.2.1:1234", "203.0.113.7", "203.0.113.7"},
+		// Only the last hop the proxies didn't add is believed.
+		{"192.0.2.1:1234", " 203.0.113.7 , 198.51.100.2", "198.51.100.2"},
+		{"192.0.2.1:1234", "203.0.113.7, 198.51.100.2, 10.1.2.3", "198.51.100.2"},
+		{"192.0.2.1:1234", "10.1.2.3", "10.1.2.3"},
+		// Clients talking to us directly can't claim to be someone else.
+		{"198.51.100.9:1234", "203.0.113.7", "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r, trusted); got != tt.want {
+			t.Errorf("%s, %q: got %q, want %q", tt.remoteAddr, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterIgnoresSpoofedForwardedFor(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	l.clock = newFakeClock()
+	h := l.limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/weather/london", nil)
+		req.RemoteAddr = "198.51.100.9:1234"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			allowed++
+		}
+	}
+	if allowed != 1 {
+		t.Errorf("allowed %d of 20 requests, want 1", allowed)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies("192.0.2.1, 2001:db8::/32")
+	if err != nil || len(nets) != 2 {
+		t.Fatalf("got %v, %v", nets, err)
+	}
+	if _, err := parseTrustedProxies("192.0.2.1, proxy.example.com"); err == nil {
+		t.Error("expected an error for a hostname")
+	}
+}
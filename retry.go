@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// retryingWeatherProvider retries transient failures of the wrapped provider,
+// waiting exponentially longer between each attempt.
+type retryingWeatherProvider struct {
+	provider   weatherProvider
+	maxRetries int
+	baseDelay  time.Duration
+
+	// budget, if set, is shared by every retrying provider and limits how
+	// often any of them retries, so that an outage doesn't multiply the
+	// load on upstream APIs. Once it runs out, failures are returned as
+	// they are.
+	budget *retryBudget
+}
+
+// retryBudget allows up to burst retries at once, refilling at rate retries
+// a second.
+type retryBudget struct {
+	limiter *rateLimiter
+}
+
+func newRetryBudget(rate float64, burst int) *retryBudget {
+	return &retryBudget{limiter: newRateLimiter(rate, burst)}
+}
+
+// take uses up one retry, reporting false if there are none left.
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	ok, _ := b.limiter.allow("")
+	return ok
+}
+
+func NewRetryingWeatherProvider(p weatherProvider, maxRetries int, baseDelay time.Duration) *retryingWeatherProvider {
+	return &retryingWeatherProvider{provider: p, maxRetries: maxRetries, baseDelay: baseDelay}
+}
+
+func (r *retryingWeatherProvider) name() string {
+	return providerName(r.provider)
+}
+
+func (r *retryingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := r.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (r *retryingWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	for attempt := 0; ; attempt++ {
+		c, err := conditionsOf(ctx, r.provider, city)
+		if err == nil || attempt >= r.maxRetries || !isRetryable(err) {
+			return c, err
+		}
+		if !r.budget.take() {
+			logf(ctx, "%s: retry budget exhausted, not retrying: %v", r.name(), err)
+			return c, err
+		}
+
+		t := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return Conditions{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns how long to wait before retry number attempt (from 0):
+// between half and all of baseDelay * 2^attempt, chosen at random so that
+// retries from concurrent requests don't line up.
+func (r *retryingWeatherProvider) backoff(attempt int) time.Duration {
+	d := r.baseDelay << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isRetryable reports whether err is worth trying again: network failures
+// and 5xx responses are, client errors and cancellations are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var se statusError
+	if errors.As(err, &se) {
+		return se.code >= 500
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
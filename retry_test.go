@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testFlakyWeatherProvider fails with err the first failures times it is
+// called, then succeeds.
+type testFlakyWeatherProvider struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (t *testFlakyWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	t.calls++
+	if t.calls <= t.failures {
+		return 0, t.err
+	}
+	return 290, nil
+}
+
+func TestRetryingWeatherProviderRecovers(t *testing.T) {
+	p := &testFlakyWeatherProvider{failures: 2, err: statusError{provider: "wunderground", code: 503}}
+	r := NewRetryingWeatherProvider(p, 3, time.Millisecond)
+
+	k, err := r.temperature(context.Background(), "london")
+	if err != nil || k != 290 {
+		t.Fatalf("got %v, %v", k, err)
+	}
+	if p.calls != 3 {
+		t.Errorf("provider called %d times, want 3", p.calls)
+	}
+}
+
+func TestRetryingWeatherProviderGivesUp(t *testing.T) {
+	failure := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	p := &testFlakyWeatherProvider{failures: 5, err: failure}
+	r := NewRetryingWeatherProvider(p, 2, time.Millisecond)
+
+	if _, err := r.temperature(context.Background(), "london"); !errors.Is(err, failure) {
+		t.Fatalf("got %v, want %v", err, failure)
+	}
+	if p.calls != 3 {
+		t.Errorf("provider called %d times, want 3", p.calls)
+	}
+}
+
+func TestRetryingWeatherProviderSkipsClientErrors(t *testing.T) {
+	p := &testFlakyWeatherProvider{failures: 2, err: statusError{provider: "openweathermap", code: 401}}
+	r := NewRetryingWeatherProvider(p, 3, time.Millisecond)
+
+	if _, err := r.temperature(context.Background(), "london"); err == nil {
+		t.Fatal("expected the 401 to be returned")
+	}
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
+
+func TestRetryingWeatherProviderBudget(t *testing.T) {
+	clk := newFakeClock()
+	budget := newRetryBudget(1, 3)
+	budget.limiter.clock = clk
+
+	// Two providers share three retries between them.
+	failure := statusError{provider: "wunderground", code: 503}
+	first := &testFlakyWeatherProvider{failures: 10, err: failure}
+	second := &testFlakyWeatherProvider{failures: 10, err: failure}
+	for _, p := range []*testFlakyWeatherProvider{first, second} {
+		r := NewRetryingWeatherProvider(p, 5, 0)
+		r.budget = budget
+		if _, err := r.temperature(context.Background(), "london"); !errors.Is(err, failure) {
+			t.Fatalf("got %v, want %v", err, failure)
+		}
+	}
+	if first.calls != 4 || second.calls != 1 {
+		t.Errorf("providers called %d and %d times, want 4 and 1", first.calls, second.calls)
+	}
+
+	// The budget refills with time.
+	clk.Advance(time.Second)
+	r := NewRetryingWeatherProvider(second, 5, 0)
+	r.budget = budget
+	r.temperature(context.Background(), "london")
+	if second.calls != 3 {
+		t.Errorf("provider called %d times after a second, want 3", second.calls)
+	}
+}
+
+func TestRetryingWeatherProviderStopsWhenCancelled(t *testing.T) {
+	p := &testFlakyWeatherProvider{failures: 5, err: statusError{provider: "wunderground", code: 502}}
+	r := NewRetryingWeatherProvider(p, 5, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := r.temperature(ctx, "london"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	if p.calls != 1 {
+		t.Errorf("provider called %d times, want 1", p.calls)
+	}
+}
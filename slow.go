@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// slowLoggingWeatherProvider logs a warning whenever a lookup by the
+// wrapped provider takes longer than threshold, whether or not it succeeds.
+type slowLoggingWeatherProvider struct {
+	provider  weatherProvider
+	threshold time.Duration
+	clock     clock // the system clock if nil
+}
+
+func NewSlowLoggingWeatherProvider(p weatherProvider, threshold time.Duration) *slowLoggingWeatherProvider {
+	return &slowLoggingWeatherProvider{provider: p, threshold: threshold}
+}
+
+func (s *slowLoggingWeatherProvider) name() string {
+	return providerName(s.provider)
+}
+
+func (s *slowLoggingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := s.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (s *slowLoggingWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	begin := nowOn(s.clock)
+	c, err := conditionsOf(ctx, s.provider, city)
+	if took := since(s.clock, begin); took > s.threshold {
+		logf(ctx, "warning: slow lookup by %s for %q took %v", s.name(), city, took)
+	}
+	return c, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowLoggingWeatherProvider(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	clock := newFakeClock()
+	slow := NewSlowLoggingWeatherProvider(testSlowClockWeatherProvider{clock, 20 * time.Millisecond}, 5*time.Millisecond)
+	slow.clock = clock
+	if _, err := slow.temperature(context.Background(), "london"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line := buf.String()
+	for _, want := range []string{"slow lookup", "main.testSlowClockWeatherProvider", `"london"`} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log %q does not mention %q", line, want)
+		}
+	}
+
+	buf.Reset()
+	fast := NewSlowLoggingWeatherProvider(testSlowClockWeatherProvider{clock, 5 * time.Millisecond}, 5*time.Millisecond)
+	fast.clock = clock
+	if _, err := fast.temperature(context.Background(), "london"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got log %q for a fast lookup, want nothing", buf.String())
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// smoothingWeatherProvider evens out a noisy provider by reporting an
+// exponential moving average of its temperatures in each city, rather than
+// the latest reading. Each new reading moves the average alpha of the way
+// towards it, so an alpha of 1 turns smoothing off. The first reading for a
+// city is taken as it is, and so is one coming more than window after the
+// last, since an average that old says little about the weather now.
+type smoothingWeatherProvider struct {
+	provider weatherProvider
+	alpha    float64
+	window   time.Duration
+	clock    clock
+
+	mu       sync.Mutex
+	averages map[string]smoothedReading // by queryKey
+}
+
+type smoothedReading struct {
+	kelvin float64
+	at     time.Time
+}
+
+// defaultSmoothingWindow is how long an average is kept without a new
+// reading, unless told otherwise.
+const defaultSmoothingWindow = time.Hour
+
+// maxSmoothedCities bounds the memory held for averages; past it, averages
+// older than the window are forgotten, and new cities aren't smoothed until
+// there is room.
+const maxSmoothedCities = 10000
+
+func NewSmoothingWeatherProvider(p weatherProvider, alpha float64) (*smoothingWeatherProvider, error) {
+	// Written so that NaN fails too.
+	if !(alpha > 0 && alpha <= 1) {
+		return nil, fmt.Errorf("smoothing factor %v is not in (0, 1]", alpha)
+	}
+	return &smoothingWeatherProvider{
+		provider: p,
+		alpha:    alpha,
+		window:   defaultSmoothingWindow,
+		clock:    realClock{},
+		averages: make(map[string]smoothedReading),
+	}, nil
+}
+
+func (s *smoothingWeatherProvider) name() string {
+	return providerName(s.provider)
+}
+
+func (s *smoothingWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := s.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+// conditions smooths the temperature. Other conditions are passed on as
+// they are.
+func (s *smoothingWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	c, err := conditionsOf(ctx, s.provider, city)
+	if err != nil {
+		return Conditions{}, err
+	}
+
+	key := queryKey(ctx, city)
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	avg, ok := s.averages[key]
+	if ok && now.Sub(avg.at) <= s.window {
+		c.TempKelvin = avg.kelvin + s.alpha*(c.TempKelvin-avg.kelvin)
+	}
+	if !ok && len(s.averages) >= maxSmoothedCities {
+		s.prune(now)
+		if len(s.averages) >= maxSmoothedCities {
+			return c, nil
+		}
+	}
+	s.averages[key] = smoothedReading{kelvin: c.TempKelvin, at: now}
+	return c, nil
+}
+
+// prune forgets the averages older than the window.
+func (s *smoothingWeatherProvider) prune(now time.Time) {
+	for key, avg := range s.averages {
+		if now.Sub(avg.at) > s.window {
+			delete(s.averages, key)
+		}
+	}
+}
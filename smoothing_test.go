@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSequenceWeatherProvider reports each of its temperatures in turn.
+type testSequenceWeatherProvider struct {
+	mu    sync.Mutex
+	temps []float64
+}
+
+func (t *testSequenceWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := t.temps[0]
+	t.temps = t.temps[1:]
+	return FromKelvin(k), nil
+}
+
+func TestSmoothingWeatherProvider(t *testing.T) {
+	p := &testSequenceWeatherProvider{temps: []float64{280, 290, 290, 270}}
+	s, err := NewSmoothingWeatherProvider(p, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 280, then halfway to 290, then halfway again, then halfway to 270.
+	for i, want := range []float64{280, 285, 287.5, 278.75} {
+		got, err := s.temperature(context.Background(), "london")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got.Kelvin()-want) > 1e-9 {
+			t.Errorf("reading %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSmoothingWeatherProviderPerCity(t *testing.T) {
+	p := &testSequenceWeatherProvider{temps: []float64{280, 300, 290}}
+	s, err := NewSmoothingWeatherProvider(p, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s.temperature(ctx, "london")
+	// Paris hasn't been seen, so its first reading isn't blended with London's.
+	if got, _ := s.temperature(ctx, "paris"); got != 300 {
+		t.Errorf("got %v for paris, want 300", got)
+	}
+	if got, _ := s.temperature(ctx, "London"); math.Abs(got.Kelvin()-282.5) > 1e-9 {
+		t.Errorf("got %v for london, want 282.5", got)
+	}
+}
+
+func TestSmoothingWeatherProviderWindow(t *testing.T) {
+	p := &testSequenceWeatherProvider{temps: []float64{280, 290, 300}}
+	s, err := NewSmoothingWeatherProvider(p, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	s.clock = clock
+	s.window = time.Hour
+
+	ctx := context.Background()
+	s.temperature(ctx, "london")
+	clock.Advance(time.Hour)
+	if got, _ := s.temperature(ctx, "london"); got != 285 {
+		t.Errorf("got %v within the window, want 285", got)
+	}
+	// An average from before the window is dropped, not blended in.
+	clock.Advance(time.Hour + time.Second)
+	if got, _ := s.temperature(ctx, "london"); got != 300 {
+		t.Errorf("got %v past the window, want 300", got)
+	}
+}
+
+func TestSmoothingWeatherProviderBounded(t *testing.T) {
+	p := &testSequenceWeatherProvider{}
+	for i := 0; i < maxSmoothedCities+2; i++ {
+		p.temps = append(p.temps, 290)
+	}
+	s, err := NewSmoothingWeatherProvider(p, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	s.clock = clock
+
+	ctx := context.Background()
+	for i := 0; i < maxSmoothedCities+1; i++ {
+		s.temperature(ctx, fmt.Sprintf("city%d", i))
+	}
+	if n := len(s.averages); n != maxSmoothedCities {
+		t.Errorf("holding %d averages, want %d", n, maxSmoothedCities)
+	}
+
+	// Once the old averages have aged out, there's room again.
+	clock.Advance(s.window + time.Second)
+	s.temperature(ctx, "paris")
+	if n := len(s.averages); n != 1 {
+		t.Errorf("holding %d averages after pruning, want 1", n)
+	}
+}
+
+func TestNewSmoothingWeatherProviderAlpha(t *testing.T) {
+	for _, alpha := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if _, err := NewSmoothingWeatherProvider(testFastWeatherProvider{}, alpha); err == nil {
+			t.Errorf("alpha %v: expected an error", alpha)
+		}
+	}
+	for _, alpha := range []float64{0.1, 1} {
+		if _, err := NewSmoothingWeatherProvider(testFastWeatherProvider{}, alpha); err != nil {
+			t.Errorf("alpha %v: unexpected error %v", alpha, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// staticWeatherProvider reports fixed temperatures in Kelvin, keyed by
+// normalized city name. It needs no network, for tests and offline demos.
+type staticWeatherProvider map[string]float64
+
+// demoTemperatures are served by the -demo flag.
+var demoTemperatures = staticWeatherProvider{
+	"london":    288.15,
+	"new york":  291.15,
+	"paris":     289.65,
+	"tokyo":     294.25,
+	"sydney":    297.05,
+	"reykjavik": 277.55,
+}
+
+func (s staticWeatherProvider) name() string {
+	return "static"
+}
+
+func (s staticWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	if city == "" {
+		return 0, errCityRequired
+	}
+	k, ok := s[normalizeCity(city)]
+	if !ok {
+		return 0, fmt.Errorf("static: %w: %s", errCityNotFound, city)
+	}
+	return FromKelvin(k), nil
+}
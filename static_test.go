@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStaticWeatherProvider(t *testing.T) {
+	p := staticWeatherProvider{"new york": 291.15}
+
+	k, err := p.temperature(context.Background(), "New York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if k != 291.15 {
+		t.Errorf("got %v, want 291.15", k)
+	}
+}
+
+func TestStaticWeatherProviderUnknownCity(t *testing.T) {
+	p := staticWeatherProvider{"new york": 291.15}
+
+	if _, err := p.temperature(context.Background(), "atlantis"); !errors.Is(err, errCityNotFound) {
+		t.Errorf("got %v for an unknown city, want %v", err, errCityNotFound)
+	}
+	if _, err := p.temperature(context.Background(), ""); !errors.Is(err, errCityRequired) {
+		t.Errorf("got %v for no city, want %v", err, errCityRequired)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// streamHandler serves /weather/stream/<city>, a WebSocket that is sent the
+// aggregate temperature from mw straight away and then every interval, until
+// the client goes away.
+type streamHandler struct {
+	mw       multiWeatherProvider
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// streamMessage is sent for each update on a stream.
+type streamMessage struct {
+	City  string    `json:"city"`
+	Temp  *float64  `json:"temp,omitempty"` // nil if the lookup failed
+	Unit  string    `json:"unit"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+func (h streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, unit, ok := parseStreamRequest(w, r, "/weather/stream/")
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	ws, err := acceptWebSocket(w, r)
+	if err != nil {
+		return // acceptWebSocket has answered already
+	}
+	defer ws.close()
+
+	// A hijacked connection isn't watched by the server any more, so read
+	// from it ourselves to find out when the client leaves.
+	go func() {
+		ws.readUntilClosed()
+		cancel()
+	}()
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ws.writeJSON(h.update(ctx, city, unit)); err != nil {
+			logf(ctx, "streaming %s: %v", city, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sseHandler serves /weather/sse/<city>, the same updates as streamHandler
+// sent as Server-Sent Events, for clients that only need to listen.
+type sseHandler struct {
+	streamHandler
+}
+
+func (h sseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	city, unit, ok := parseStreamRequest(w, r, "/weather/sse/")
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported here", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream outlasts the server's write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ctx := r.Context()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		b, err := json.Marshal(h.update(ctx, city, unit))
+		if err != nil {
+			logf(ctx, "streaming %s: %v", city, err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: weather\ndata: %s\n\n", b); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseStreamRequest reads the city and unit from a request for one of the
+// streams, or the comparison, under prefix, answering with an error itself
+// if they're bad.
+func parseStreamRequest(w http.ResponseWriter, r *http.Request, prefix string) (city, unit string, ok bool) {
+	city, ok = cityFromPath(r.URL.Path, prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return "", "", false
+	}
+	if city == "" {
+		http.Error(w, "missing city, expected "+prefix+"<city>", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	unit = orDefault(r.URL.Query().Get("units"), unitKelvin)
+	if _, err := convertFromKelvin(0, unit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return city, unit, true
+}
+
+// update looks up the temperature in city for the next message.
+func (h streamHandler) update(ctx context.Context, city, unit string) streamMessage {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	msg := streamMessage{City: city, Unit: unit, Time: time.Now().UTC()}
+	t, err := h.mw.temperature(ctx, city)
+	if err != nil {
+		msg.Error = err.Error()
+		return msg
+	}
+	v, _ := t.In(unit)
+	msg.Temp = roundedPtr(v, defaultPrecision)
+	return msg
+}
+
+// webSocket is the server end of a WebSocket connection. It implements just
+// enough of RFC 6455 to send text messages and to notice the client closing.
+type webSocket struct {
+	conn net.Conn
+	buf  *bufio.ReadWriter
+
+	mu sync.Mutex // serializes writes
+}
+
+// WebSocket frame opcodes.
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// acceptWebSocket completes the opening handshake for r and takes over its
+// connection. If r isn't a WebSocket handshake it answers with an error
+// itself.
+func acceptWebSocket(w http.ResponseWriter, r *http.Request) (*webSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported websocket version %q", v)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets are not supported here", http.StatusInternalServerError)
+		return nil, errors.New("response writer can't be hijacked")
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	// The server's read and write timeouts are still set on the connection,
+	// but the stream outlasts them.
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &webSocket{conn: conn, buf: buf}, nil
+}
+
+// headerHasToken reports whether the comma-separated header name contains
+// token, ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeJSON sends v as a text message.
+func (ws *webSocket) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(wsText, b)
+}
+
+// writeFrame sends a single unfragmented frame. Frames from the server are
+// not masked.
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	ws.buf.Write(header)
+	ws.buf.Write(payload)
+	return ws.buf.Flush()
+}
+
+// readUntilClosed reads frames from the client, answering pings, until it
+// sends a close frame or the connection fails. Anything else the client
+// sends is ignored.
+func (ws *webSocket) readUntilClosed() {
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(wsPong, payload)
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return
+		}
+	}
+}
+
+// maxControlPayload is the largest payload a control frame may carry. Data
+// frames are skipped rather than held, so they aren't limited.
+const maxControlPayload = 125
+
+// readFrame reads a frame from the client. The payload is only returned for
+// control frames.
+func (ws *webSocket) readFrame() (opcode byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err := io.ReadFull(ws.buf, h[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = h[0] & 0x0f
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(ws.buf, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(ws.buf, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("websocket: unmasked frame from client")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.buf, mask[:]); err != nil {
+		return 0, nil, err
+	}
+
+	if opcode < wsClose {
+		_, err := io.CopyN(io.Discard, ws.buf, int64(n))
+		return opcode, nil, err
+	}
+	if n > maxControlPayload {
+		return 0, nil, errors.New("websocket: control frame too large")
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.buf, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+func (ws *webSocket) close() error {
+	return ws.conn.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebSocket opens a WebSocket to path on srv.
+func dialWebSocket(t *testing.T, srv *httptest.Server, path string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	// The example key and its answer from RFC 6455.
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got Sec-WebSocket-Accept %q", got)
+	}
+	return conn, br
+}
+
+// readTextFrame reads an unmasked text frame sent by the server.
+func readTextFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h[0] != 0x80|wsText {
+		t.Fatalf("got frame header %#x, want a final text frame", h[0])
+	}
+	n := int(h[1])
+	if n == 126 {
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		n = int(binary.BigEndian.Uint16(b[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestStreamSendsUpdates(t *testing.T) {
+	done := make(chan struct{})
+	h := streamHandler{
+		mw:       multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout:  time.Second,
+		interval: 10 * time.Millisecond,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	conn, br := dialWebSocket(t, srv, "/weather/stream/London?units=celsius")
+	for i := 0; i < 2; i++ {
+		var msg streamMessage
+		if err := json.Unmarshal(readTextFrame(t, br), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.City != "london" || msg.Temp == nil || *msg.Temp != 16.85 || msg.Unit != unitCelsius || msg.Error != "" {
+			t.Errorf("message %d: got %+v", i, msg)
+		}
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler still running after the client went away")
+	}
+}
+
+func TestStreamRejectsPlainRequests(t *testing.T) {
+	h := streamHandler{
+		mw:       multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout:  time.Second,
+		interval: time.Minute,
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/stream/london", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSSESendsEvents(t *testing.T) {
+	h := sseHandler{streamHandler{
+		mw:       multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout:  time.Second,
+		interval: 10 * time.Millisecond,
+	}}
+
+	// The handler runs until the client goes away, which here is once a few
+	// intervals have passed.
+	ctx, cancel := context.WithTimeout(context.Background(), 35*time.Millisecond)
+	defer cancel()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/sse/london", nil).WithContext(ctx))
+
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("got Content-Type %q, want text/event-stream", got)
+	}
+	if !rec.Flushed {
+		t.Error("events were not flushed")
+	}
+
+	events := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n\n"), "\n\n")
+	if len(events) < 2 {
+		t.Fatalf("got %d events, want at least 2: %q", len(events), rec.Body.String())
+	}
+	for i, e := range events[:2] {
+		lines := strings.Split(e, "\n")
+		if len(lines) != 2 || lines[0] != "event: weather" || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("event %d: got %q", i, e)
+		}
+		var msg streamMessage
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.City != "london" || msg.Temp == nil || *msg.Temp != 290 || msg.Time.IsZero() {
+			t.Errorf("event %d: got %+v", i, msg)
+		}
+	}
+}
+
+func TestSSEOutlastsWriteTimeout(t *testing.T) {
+	h := sseHandler{streamHandler{
+		mw:       multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(290)}},
+		timeout:  time.Second,
+		interval: 10 * time.Millisecond,
+	}}
+	srv := httptest.NewUnstartedServer(withGzip(h, gzipMinSize))
+	srv.Config.WriteTimeout = 30 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/weather/sse/london")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Ten events take well past the write timeout.
+	br := bufio.NewReader(resp.Body)
+	for i := 0; i < 10; i++ {
+		line, err := br.ReadString('\n')
+		for err == nil && line != "event: weather\n" {
+			line, err = br.ReadString('\n')
+		}
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+	}
+}
+
+func TestStreamUpdateAtZero(t *testing.T) {
+	h := streamHandler{mw: multiWeatherProvider{providers: []weatherProvider{testConstantWeatherProvider(273.15)}}, timeout: time.Second}
+
+	b, err := json.Marshal(h.update(context.Background(), "london", unitCelsius))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"temp":0,`) {
+		t.Errorf("got %s, want a temp of 0", b)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeoutWeatherProvider gives each lookup by the wrapped provider its own
+// deadline, so that a slow API can be given less long than the others.
+// Each of its requests is still bound by the timeout shared by every
+// provider's HTTP client, so giving it longer means raising that too.
+type timeoutWeatherProvider struct {
+	provider weatherProvider
+	timeout  time.Duration
+}
+
+func NewTimeoutWeatherProvider(p weatherProvider, timeout time.Duration) *timeoutWeatherProvider {
+	return &timeoutWeatherProvider{provider: p, timeout: timeout}
+}
+
+func (t *timeoutWeatherProvider) name() string {
+	return providerName(t.provider)
+}
+
+func (t *timeoutWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := t.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (t *timeoutWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return conditionsOf(ctx, t.provider, city)
+}
+
+// parseProviderTimeouts parses a comma-separated list of provider=duration
+// pairs, like "forecastIo=8s,openWeatherMap=2s".
+func parseProviderTimeouts(s string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for _, v := range splitList(s) {
+		name, d, ok := strings.Cut(v, "=")
+		if !ok {
+			return nil, fmt.Errorf("provider timeout %q should look like name=duration", v)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("provider timeout for %s: %v", name, err)
+		}
+		if timeout <= 0 {
+			return nil, fmt.Errorf("provider timeout for %s must be positive, got %v", name, timeout)
+		}
+		timeouts[strings.TrimSpace(name)] = timeout
+	}
+	return timeouts, nil
+}
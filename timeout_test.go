@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeoutWeatherProvider(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			NewTimeoutWeatherProvider(testSleepyWeatherProvider{d: 50 * time.Millisecond}, 5*time.Millisecond),
+			NewTimeoutWeatherProvider(testSleepyWeatherProvider{d: 50 * time.Millisecond}, time.Second),
+		},
+	}
+
+	readings, err := w.temperatures(context.Background(), "london")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(readings[0].Err, context.DeadlineExceeded) {
+		t.Errorf("got %v for the impatient provider, want %v", readings[0].Err, context.DeadlineExceeded)
+	}
+	if readings[1].Err != nil || readings[1].TempKelvin != 300 {
+		t.Errorf("got %+v for the patient provider, want 300", readings[1])
+	}
+}
+
+func TestParseProviderTimeouts(t *testing.T) {
+	got, err := parseProviderTimeouts("forecastIo=8s, openWeatherMap = 2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["forecastIo"] != 8*time.Second || got["openWeatherMap"] != 2*time.Second {
+		t.Errorf("got %v", got)
+	}
+
+	for _, s := range []string{"forecastIo", "forecastIo=soon", "forecastIo=0s"} {
+		if _, err := parseProviderTimeouts(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
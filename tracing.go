@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer records spans for the lookups made to serve each request and hands
+// them to an exporter. It follows the OpenTelemetry data model, and picks up
+// and passes on W3C traceparent headers, so its spans join traces started by
+// other services. A nil *tracer records nothing.
+type tracer struct {
+	exporter spanExporter
+}
+
+// spanExporter receives every span once it has ended.
+type spanExporter interface {
+	exportSpan(s *span)
+}
+
+// Span kinds, as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// span is a single timed operation within a trace.
+type span struct {
+	tracer   *tracer
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span in ctx, or nil if there isn't one.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// start begins a span that is a child of the span in ctx, if there is one,
+// and returns a context carrying the new span.
+func (t *tracer) start(ctx context.Context, name string, kind int, attrs map[string]string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// finish ends s, recording err if the operation failed.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.exporter.exportSpan(s)
+}
+
+// handler wraps h in a server span named name, continuing the trace in the
+// request's traceparent header if there is a valid one.
+func (t *tracer) handler(name string, h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, remote)
+		}
+		ctx, s := t.start(ctx, name, spanKindServer, map[string]string{
+			"http.request.method": r.Method,
+			"url.path":            r.URL.Path,
+		})
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+
+		s.attrs["http.response.status_code"] = strconv.Itoa(rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = errorStatus(rec.status)
+		}
+		s.finish(err)
+	})
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string {
+	return http.StatusText(int(e))
+}
+
+// parseTraceparent reads a W3C traceparent header into a span that can be
+// used as a parent.
+func parseTraceparent(h string) (*span, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, false
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	if s.traceID == ([16]byte{}) || s.spanID == ([8]byte{}) {
+		return nil, false
+	}
+	return s, true
+}
+
+// tracedWeatherProvider records a span for every call to the wrapped
+// provider.
+type tracedWeatherProvider struct {
+	provider weatherProvider
+	tracer   *tracer
+}
+
+func (p tracedWeatherProvider) name() string {
+	return providerName(p.provider)
+}
+
+func (p tracedWeatherProvider) temperature(ctx context.Context, city string) (Temperature, error) {
+	c, err := p.conditions(ctx, city)
+	return FromKelvin(c.TempKelvin), err
+}
+
+func (p tracedWeatherProvider) conditions(ctx context.Context, city string) (Conditions, error) {
+	ctx, s := p.tracer.start(ctx, "weather.provider "+p.name(), spanKindInternal, map[string]string{
+		"weather.provider": p.name(),
+		"weather.city":     city,
+	})
+	c, err := conditionsOf(ctx, p.provider, city)
+	s.finish(err)
+	return c, err
+}
+
+// otlpExporter sends spans in batches to an OpenTelemetry collector, using
+// OTLP's JSON encoding over HTTP.
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+}
+
+// maxSpanBatch is how many spans are sent at once, at most.
+const maxSpanBatch = 512
+
+// otlpExporterFromEnv configures an exporter from the standard
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_ENDPOINT and
+// OTEL_SERVICE_NAME variables. It returns nil if no endpoint is set.
+func otlpExporterFromEnv(getenv func(string) string, client *http.Client) *otlpExporter {
+	u := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if u == "" {
+		base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		u = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	return &otlpExporter{
+		url:     u,
+		service: orDefault(getenv("OTEL_SERVICE_NAME"), "how-i-start-go"),
+		client:  client,
+	}
+}
+
+func (e *otlpExporter) exportSpan(s *span) {
+	e.mu.Lock()
+	e.pending = append(e.pending, s)
+	full := len(e.pending) >= maxSpanBatch
+	e.mu.Unlock()
+
+	if full {
+		go e.flush()
+	}
+}
+
+// run flushes the pending spans every interval. It doesn't return.
+func (e *otlpExporter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.flush()
+	}
+}
+
+// flush sends the pending spans. Spans that can't be sent are dropped.
+func (e *otlpExporter) flush() {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		log.Printf("exporting spans: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Printf("exporting spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if err := checkStatus("otlp", resp); err != nil {
+		log.Printf("exporting spans: %v", err)
+	}
+}
+
+// otlpKeyValue is an OTLP attribute with a string value.
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+// payload builds an OTLP ExportTraceServiceRequest for spans.
+func (e *otlpExporter) payload(spans []*span) interface{} {
+	type otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes"`
+		Status            otlpStatus     `json:"status"`
+	}
+
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+			Status:            otlpStatus{Code: 1}, // ok
+		}
+		if s.parentID != ([8]byte{}) {
+			out[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			out[i].Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+	}
+
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	ss := scopeSpans{Spans: out}
+	ss.Scope.Name = "how-i-start-go"
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": e.service}),
+				},
+				"scopeSpans": []scopeSpans{ss},
+			},
+		},
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSpanExporter keeps every span it is given.
+type testSpanExporter struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+func (e *testSpanExporter) exportSpan(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, s)
+}
+
+func TestTracingSpans(t *testing.T) {
+	exp := &testSpanExporter{}
+	tr := &tracer{exporter: exp}
+	mw := multiWeatherProvider{providers: []weatherProvider{
+		tracedWeatherProvider{provider: openWeatherMapStub{}, tracer: tr},
+		tracedWeatherProvider{provider: testSlowWeatherProvider{}, tracer: tr},
+	}}
+	h := tr.handler("GET /weather/", weatherHandler{mw: mw, timeout: time.Second})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/london", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(exp.spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(exp.spans))
+	}
+	root := exp.spans[2] // the server span ends last
+	if root.name != "GET /weather/" || root.kind != spanKindServer || root.parentID != ([8]byte{}) {
+		t.Errorf("got root span %q, kind %d, parent %x", root.name, root.kind, root.parentID)
+	}
+
+	names := map[string]bool{}
+	for _, s := range exp.spans[:2] {
+		names[s.name] = true
+		if s.traceID != root.traceID || s.parentID != root.spanID {
+			t.Errorf("span %q is not a child of the root span", s.name)
+		}
+		if s.attrs["weather.city"] != "london" {
+			t.Errorf("span %q has city %q, want london", s.name, s.attrs["weather.city"])
+		}
+	}
+	for _, want := range []string{"weather.provider openWeatherMap", "weather.provider main.testSlowWeatherProvider"} {
+		if !names[want] {
+			t.Errorf("missing span %q, got %v", want, names)
+		}
+	}
+}
+
+func TestTracingContinuesTraceparent(t *testing.T) {
+	exp := &testSpanExporter{}
+	tr := &tracer{exporter: exp}
+	h := tr.handler("GET /weather/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/weather/london", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	s := exp.spans[0]
+	if got := hex.EncodeToString(s.traceID[:]); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("got trace ID %s", got)
+	}
+	if got := hex.EncodeToString(s.parentID[:]); got != "00f067aa0ba902b7" {
+		t.Errorf("got parent span ID %s", got)
+	}
+}
+
+func TestParseTraceparentRejectsInvalid(t *testing.T) {
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(h); ok {
+			t.Errorf("accepted %q", h)
+		}
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *tracer
+	p := tracedWeatherProvider{provider: openWeatherMapStub{}, tracer: tr}
+	if k, err := p.temperature(context.Background(), "london"); err != nil || k != 290.1 {
+		t.Errorf("got %v, %v", k, err)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue
+			}
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID, SpanID, ParentSpanID, Name string
+				}
+			}
+		}
+	}
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	env := map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": srv.URL + "/", "OTEL_SERVICE_NAME": "weather"}
+	exp := otlpExporterFromEnv(func(k string) string { return env[k] }, srv.Client())
+	tr := &tracer{exporter: exp}
+	ctx, root := tr.start(context.Background(), "root", spanKindServer, map[string]string{})
+	_, child := tr.start(ctx, "child", spanKindInternal, map[string]string{})
+	child.finish(nil)
+	root.finish(nil)
+	exp.flush()
+
+	if path != "/v1/traces" {
+		t.Errorf("got path %q, want /v1/traces", path)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected payload %+v", got)
+	}
+	if attrs := got.ResourceSpans[0].Resource.Attributes; len(attrs) != 1 || attrs[0].Value.StringValue != "weather" {
+		t.Errorf("got resource attributes %+v", attrs)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "child" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("got spans %+v", spans)
+	}
+}
+
+func TestOTLPExporterFromEnvUnset(t *testing.T) {
+	if exp := otlpExporterFromEnv(func(string) string { return "" }, nil); exp != nil {
+		t.Errorf("got %+v, want nil", exp)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Units accepted by the ?units= query parameter.
+const (
+	unitKelvin     = "kelvin"
+	unitCelsius    = "celsius"
+	unitFahrenheit = "fahrenheit"
+)
+
+// convertFromKelvin converts a temperature in Kelvin to the given unit.
+func convertFromKelvin(k float64, unit string) (float64, error) {
+	return FromKelvin(k).In(unit)
+}
+
+// Decimal places accepted by the ?precision= query parameter.
+const (
+	defaultPrecision = 2
+	maxPrecision     = 6
+)
+
+// roundTo rounds v to the given number of decimal places.
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// Temperature is a temperature, held in Kelvin. Providers build one from
+// whatever unit their API reports in, and it is converted to the unit asked
+// for on the way out.
+type Temperature float64
+
+// FromKelvin returns the temperature k Kelvin.
+func FromKelvin(k float64) Temperature {
+	return Temperature(k)
+}
+
+// FromCelsius returns the temperature c degrees Celsius.
+func FromCelsius(c float64) Temperature {
+	return Temperature(c + 273.15)
+}
+
+// FromFahrenheit returns the temperature f degrees Fahrenheit.
+func FromFahrenheit(f float64) Temperature {
+	return FromCelsius((f - 32) / 1.8)
+}
+
+// Temperatures on Earth, in °C, fall within these bounds with room to
+// spare. The records are -89.2°C and 56.7°C.
+const (
+	minPlausibleCelsius = -95
+	maxPlausibleCelsius = 65
+)
+
+// rawTemperature returns the temperature v in unit, as reported by
+// provider, checking it could be the weather here on Earth. That catches
+// an API reporting in Kelvin when we expected degrees, which would
+// otherwise be converted into nonsense, but not a mix-up between Celsius
+// and Fahrenheit: 15°C is a plausible 15°F too. Only outlier rejection,
+// which compares providers, can catch those, when it is enabled and there
+// are enough of them; see WithOutlierRejection.
+func rawTemperature(provider string, v float64, unit string) (Temperature, error) {
+	var t Temperature
+	switch unit {
+	case unitKelvin:
+		t = FromKelvin(v)
+	case unitCelsius:
+		t = FromCelsius(v)
+	case unitFahrenheit:
+		t = FromFahrenheit(v)
+	default:
+		return 0, fmt.Errorf("unknown unit %q", unit)
+	}
+	if c := t.Celsius(); c < minPlausibleCelsius || c > maxPlausibleCelsius || math.IsNaN(c) {
+		return 0, fmt.Errorf("%s: %w: %v %s, is it in another unit?", provider, errImplausibleReading, v, unitSymbol(unit))
+	}
+	return t, nil
+}
+
+// Kelvin returns t in Kelvin.
+func (t Temperature) Kelvin() float64 {
+	return float64(t)
+}
+
+// Celsius returns t in degrees Celsius.
+func (t Temperature) Celsius() float64 {
+	return float64(t) - 273.15
+}
+
+// Fahrenheit returns t in degrees Fahrenheit.
+func (t Temperature) Fahrenheit() float64 {
+	return t.Celsius()*1.8 + 32
+}
+
+// In returns t in the named unit.
+func (t Temperature) In(unit string) (float64, error) {
+	switch unit {
+	case unitKelvin:
+		return t.Kelvin(), nil
+	case unitCelsius:
+		return t.Celsius(), nil
+	case unitFahrenheit:
+		return t.Fahrenheit(), nil
+	}
+	return 0, fmt.Errorf("unknown unit %q, expected one of %s, %s or %s", unit, unitKelvin, unitCelsius, unitFahrenheit)
+}
+
+// fahrenheitRegions are the countries that still use Fahrenheit for the
+// weather, by ISO 3166 code.
+var fahrenheitRegions = map[string]bool{
+	"US": true, "BS": true, "BZ": true, "KY": true, "LR": true, "PW": true,
+}
+
+// localeUnit returns the unit people in locale, a language tag like
+// "en-US", expect temperatures in. Anywhere not known to use Fahrenheit
+// gets Celsius.
+func localeUnit(locale string) string {
+	_, region, _ := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	region, _, _ = strings.Cut(region, "-")
+	if fahrenheitRegions[strings.ToUpper(region)] {
+		return unitFahrenheit
+	}
+	return unitCelsius
+}
+
+// formatTemperature formats k Kelvin for display to people in locale, in
+// whole degrees of the unit they expect, like "72°F" or "22°C".
+func formatTemperature(k float64, locale string) string {
+	unit := localeUnit(locale)
+	t, _ := convertFromKelvin(k, unit)
+	t = math.Round(t)
+	if t == 0 {
+		t = 0 // not -0, for temperatures just below freezing
+	}
+	return strconv.FormatFloat(t, 'f', 0, 64) + unitSymbol(unit)
+}
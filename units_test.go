@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestConvertFromKelvin(t *testing.T) {
+	tests := []struct {
+		unit string
+		want float64
+	}{
+		{unitKelvin, 300},
+		{unitCelsius, 26.85},
+		{unitFahrenheit, 80.33},
+	}
+
+	for _, tt := range tests {
+		got, err := convertFromKelvin(300, tt.unit)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.unit, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestConvertFromKelvinUnknownUnit(t *testing.T) {
+	if _, err := convertFromKelvin(300, "rankine"); err == nil {
+		t.Error("expected an error for an unknown unit")
+	}
+}
+
+func TestTemperatureRoundTrip(t *testing.T) {
+	for _, v := range []float64{-40, 0, 21.5, 100} {
+		if got := FromCelsius(v).Celsius(); math.Abs(got-v) > 1e-9 {
+			t.Errorf("FromCelsius(%v).Celsius() = %v", v, got)
+		}
+		if got := FromFahrenheit(v).Fahrenheit(); math.Abs(got-v) > 1e-9 {
+			t.Errorf("FromFahrenheit(%v).Fahrenheit() = %v", v, got)
+		}
+		if got := FromKelvin(v).Kelvin(); got != v {
+			t.Errorf("FromKelvin(%v).Kelvin() = %v", v, got)
+		}
+	}
+}
+
+func TestTemperatureConversions(t *testing.T) {
+	tests := []struct {
+		t                           Temperature
+		kelvin, celsius, fahrenheit float64
+	}{
+		{FromCelsius(0), 273.15, 0, 32},
+		{FromFahrenheit(212), 373.15, 100, 212},
+		{FromKelvin(233.15), 233.15, -40, -40},
+	}
+
+	for _, tt := range tests {
+		if got := tt.t.Kelvin(); math.Abs(got-tt.kelvin) > 1e-9 {
+			t.Errorf("Kelvin() = %v, want %v", got, tt.kelvin)
+		}
+		if got := tt.t.Celsius(); math.Abs(got-tt.celsius) > 1e-9 {
+			t.Errorf("Celsius() = %v, want %v", got, tt.celsius)
+		}
+		if got := tt.t.Fahrenheit(); math.Abs(got-tt.fahrenheit) > 1e-9 {
+			t.Errorf("Fahrenheit() = %v, want %v", got, tt.fahrenheit)
+		}
+	}
+}
+
+func TestRawTemperature(t *testing.T) {
+	tests := []struct {
+		v    float64
+		unit string
+		ok   bool
+	}{
+		{288.15, unitKelvin, true},
+		{15, unitKelvin, false},
+		{15, unitCelsius, true},
+		{288.15, unitCelsius, false},
+		{59, unitFahrenheit, true},
+		{-129, unitFahrenheit, true},
+		{288.15, unitFahrenheit, false},
+		{math.NaN(), unitCelsius, false},
+	}
+
+	for _, tt := range tests {
+		_, err := rawTemperature("test", tt.v, tt.unit)
+		if tt.ok && err != nil {
+			t.Errorf("%v %s: unexpected error: %v", tt.v, tt.unit, err)
+		}
+		if !tt.ok && !errors.Is(err, errImplausibleReading) {
+			t.Errorf("%v %s: got %v, want %v", tt.v, tt.unit, err, errImplausibleReading)
+		}
+	}
+}
+
+func TestFormatTemperature(t *testing.T) {
+	tests := []struct {
+		k      float64
+		locale string
+		want   string
+	}{
+		{295.37, "en-US", "72°F"},
+		{295.37, "en_us", "72°F"},
+		{295.37, "en-GB", "22°C"},
+		{295.37, "de-DE", "22°C"},
+		{295.37, "tlh", "22°C"},
+		{273, "en-GB", "0°C"},
+		{263.15, "en-US", "14°F"},
+	}
+
+	for _, tt := range tests {
+		if got := formatTemperature(tt.k, tt.locale); got != tt.want {
+			t.Errorf("formatTemperature(%v, %q) = %q, want %q", tt.k, tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	tests := []struct {
+		v      float64
+		places int
+		want   float64
+	}{
+		{285.00000000000006, 2, 285},
+		{16.849999999999966, 1, 16.8},
+		{16.85, 1, 16.9},
+		{-17.861, 1, -17.9},
+		{2.5, 0, 3},
+		{1.23456789, 6, 1.234568},
+	}
+
+	for _, tt := range tests {
+		if got := roundTo(tt.v, tt.places); got != tt.want {
+			t.Errorf("roundTo(%v, %d) = %v, want %v", tt.v, tt.places, got, tt.want)
+		}
+	}
+}
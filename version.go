@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build details, which can be set when building with
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.buildDate=2026-10-15"
+//
+// Any left unset are filled in from the build info the go command embeds.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// versionString describes this build, preferring the given details to those
+// in info, which may be nil.
+func versionString(version, commit, date string, info *debug.BuildInfo) string {
+	if info != nil {
+		if version == "" && info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+
+	return fmt.Sprintf("how-i-start-go %s (commit %s, built %s)", orDefault(version, "(devel)"), orDefault(commit, "unknown"), orDefault(date, "unknown"))
+}
+
+// buildVersion describes the running binary.
+func buildVersion() string {
+	info, _ := debug.ReadBuildInfo()
+	return versionString(version, commit, buildDate, info)
+}
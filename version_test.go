@@ -0,0 +1,32 @@
+package main
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	info := &debug.BuildInfo{
+		Main: debug.Module{Version: "v1.1.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123456789abcdef0123"},
+			{Key: "vcs.time", Value: "2026-10-01T12:00:00Z"},
+		},
+	}
+
+	tests := []struct {
+		version, commit, date string
+		info                  *debug.BuildInfo
+		want                  string
+	}{
+		{"", "", "", nil, "how-i-start-go (devel) (commit unknown, built unknown)"},
+		{"", "", "", info, "how-i-start-go v1.1.0 (commit 0123456789ab, built 2026-10-01T12:00:00Z)"},
+		{"v1.2.0", "abc1234", "2026-10-15", info, "how-i-start-go v1.2.0 (commit abc1234, built 2026-10-15)"},
+	}
+
+	for _, tt := range tests {
+		if got := versionString(tt.version, tt.commit, tt.date, tt.info); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}